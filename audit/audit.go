@@ -0,0 +1,131 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// SystemActor is recorded for actions taken by background jobs.
+const SystemActor = "system"
+
+// Entry is one row of the audit log. Before and After hold JSON snapshots
+// of whatever changed and are empty when not applicable.
+type Entry struct {
+	ID        int
+	Actor     string
+	Action    string
+	Target    string
+	IP        string
+	Before    string
+	After     string
+	CreatedAt time.Time
+}
+
+// Auditor is what services record their actions through.
+type Auditor interface {
+	Record(r *http.Request, action string, target string, before interface{}, after interface{})
+}
+
+// Log is the Auditor that writes to the audit_log table.
+type Log struct {
+	db *sql.DB
+}
+
+func NewLog(db *sql.DB) *Log {
+	return &Log{db: db}
+}
+
+// Record appends an entry to the audit log. The actor is the user behind
+// the request's token cookie; pass a nil request for background jobs.
+// Failures are logged rather than returned so auditing never blocks the
+// action itself.
+func (l *Log) Record(r *http.Request, action string, target string, before interface{}, after interface{}) {
+	var token, ip string
+	if r != nil {
+		if cookie, err := r.Cookie("token"); err == nil {
+			token = cookie.Value
+		}
+		ip = ClientIP(r)
+	}
+
+	fallback := SystemActor
+	if r != nil {
+		fallback = "anonymous"
+	}
+
+	_, err := l.db.Exec(`INSERT INTO audit_log (actor, action, target, ip, before_value, after_value, created_at)
+		VALUES (COALESCE((SELECT email FROM user_table WHERE token = $1 AND token <> ''), $2), $3, $4, $5, $6, $7, $8)`,
+		token, fallback, action, target, ip, snapshot(before), snapshot(after), time.Now().UTC())
+	if err != nil {
+		log.WithError(err).WithFields(logrus.Fields{
+			"action": action,
+			"target": target,
+		}).Error("Error writing audit log")
+	}
+}
+
+// ClientIP returns the connection address unless it is one of the trusted
+// proxies. Then it walks X-Forwarded-For from the right, past the hops our
+// own proxies appended, and returns the first address they saw; anything
+// further left was written by the client and can't be trusted.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+func snapshot(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+func init() {
+	// Create or open the log file
+	file, err := os.OpenFile("logfile.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err == nil {
+		// Set the logrus output to the file
+		log.SetOutput(file)
+	} else {
+		// If unable to open the log file, log to standard output
+		log.Warn("Failed to open log file. Logging to standard output.")
+	}
+
+	log.SetFormatter(&logrus.JSONFormatter{})
+	log.SetLevel(logrus.InfoLevel)
+}
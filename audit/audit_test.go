@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	Configure(Config{TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"}})
+	defer Configure(DefaultConfig())
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"spoofed header from a client", "203.0.113.5:4000", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"through a proxy", "10.0.0.1:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"client prepends a hop", "10.0.0.1:4000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.1:4000", []string{"198.51.100.1, 192.168.4.4"}, "198.51.100.1"},
+		{"repeated headers", "10.0.0.1:4000", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"only proxies", "10.0.0.1:4000", []string{"192.168.4.4"}, "192.168.4.4"},
+		{"proxy without header", "10.0.0.1:4000", nil, "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := ClientIP(r); got != test.want {
+			t.Errorf("%s: ClientIP = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+	if err := (Config{TrustedProxies: []string{"10.0.0.1", "::1", "172.16.0.0/12"}}).Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (Config{TrustedProxies: []string{"proxy.internal"}}).Validate(); err == nil {
+		t.Error("expected an error for a host name")
+	}
+}
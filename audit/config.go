@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Config holds the audit settings. The env tags name the variables the
+// config package reads them from.
+type Config struct {
+	// TrustedProxies lists the addresses or CIDR ranges of the reverse
+	// proxies in front of the app. X-Forwarded-For is ignored unless the
+	// request came through one of them.
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+}
+
+func DefaultConfig() Config {
+	return Config{}
+}
+
+func (c Config) Validate() error {
+	_, err := parseProxies(c.TrustedProxies)
+	return err
+}
+
+var trustedProxies []*net.IPNet
+
+// Configure applies the settings loaded at startup, which have already
+// been through Validate.
+func Configure(c Config) {
+	trustedProxies, _ = parseProxies(c.TrustedProxies)
+}
+
+// parseProxies accepts plain addresses as well as CIDR ranges.
+func parseProxies(values []string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an IP address or CIDR range", value)
+			}
+			bits := 128
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an IP address or CIDR range", value)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
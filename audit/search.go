@@ -0,0 +1,195 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pageSize = 50
+
+// Query filters the audit log. Empty fields match everything.
+type Query struct {
+	Actor  string
+	Action string
+	Target string
+	From   string // YYYY-MM-DD, inclusive
+	To     string // YYYY-MM-DD, inclusive
+	Page   int
+}
+
+func ParseQuery(values url.Values) Query {
+	q := Query{
+		Actor:  strings.TrimSpace(values.Get("actor")),
+		Action: strings.TrimSpace(values.Get("action")),
+		Target: strings.TrimSpace(values.Get("target")),
+		From:   values.Get("from"),
+		To:     values.Get("to"),
+	}
+
+	page, err := strconv.Atoi(values.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	q.Page = page
+
+	return q
+}
+
+// Encode returns the query string for this search at the given page.
+func (q Query) Encode(page int) template.URL {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"actor":  q.Actor,
+		"action": q.Action,
+		"target": q.Target,
+		"from":   q.From,
+		"to":     q.To,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if page > 0 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	return template.URL(values.Encode())
+}
+
+func (q Query) where() (string, []interface{}) {
+	var args []interface{}
+	param := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	conditions := []string{"1 = 1"}
+	if q.Actor != "" {
+		conditions = append(conditions, "LOWER(actor) LIKE "+param("%"+strings.ToLower(q.Actor)+"%"))
+	}
+	if q.Action != "" {
+		conditions = append(conditions, "action = "+param(q.Action))
+	}
+	if q.Target != "" {
+		conditions = append(conditions, "LOWER(target) LIKE "+param("%"+strings.ToLower(q.Target)+"%"))
+	}
+	if from, err := time.Parse("2006-01-02", q.From); err == nil {
+		conditions = append(conditions, "created_at >= "+param(from))
+	}
+	if to, err := time.Parse("2006-01-02", q.To); err == nil {
+		conditions = append(conditions, "created_at < "+param(to.AddDate(0, 0, 1)))
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// Search returns one page of matching entries, newest first, and the total
+// number of matches. A page of 0 returns every match.
+func Search(db *sql.DB, q Query) ([]Entry, int, error) {
+	conditions, args := q.where()
+
+	var total int
+	err := db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE "+conditions, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting audit log: %s", err)
+	}
+
+	statement := "SELECT id, actor, action, target, ip, before_value, after_value, created_at FROM audit_log WHERE " + conditions + " ORDER BY created_at DESC, id DESC"
+	if q.Page > 0 {
+		statement += fmt.Sprintf(" LIMIT %d OFFSET %d", pageSize, (q.Page-1)*pageSize)
+	}
+
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error querying audit log: %s", err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.Target, &e.IP, &e.Before, &e.After, &e.CreatedAt)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error scanning audit entry: %s", err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, total, rows.Err()
+}
+
+func ShowAuditLog(w http.ResponseWriter, r *http.Request, db *sql.DB) error {
+	q := ParseQuery(r.URL.Query())
+
+	entries, total, err := Search(db, q)
+	if err != nil {
+		return err
+	}
+
+	totalPages := (total + pageSize - 1) / pageSize
+	data := struct {
+		Entries  []Entry
+		Query    Query
+		Total    int
+		PrevPage int
+		NextPage int
+	}{
+		Entries: entries,
+		Query:   q,
+		Total:   total,
+	}
+	if q.Page > 1 {
+		data.PrevPage = q.Page - 1
+	}
+	if q.Page < totalPages {
+		data.NextPage = q.Page + 1
+	}
+
+	tmpl, err := template.ParseFiles("audit.html")
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(w, data)
+}
+
+// ExportCSV writes every entry matching the query as CSV.
+func ExportCSV(w io.Writer, db *sql.DB, q Query) error {
+	q.Page = 0
+	entries, _, err := Search(db, q)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	err = writer.Write([]string{"id", "created_at", "actor", "action", "target", "ip", "before", "after"})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		err := writer.Write([]string{
+			strconv.Itoa(e.ID),
+			e.CreatedAt.Format(time.RFC3339),
+			e.Actor,
+			e.Action,
+			e.Target,
+			e.IP,
+			e.Before,
+			e.After,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -2,14 +2,18 @@
 package books
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"main.go/audit"
+	mail "main.go/mail-service"
+	"main.go/notifications"
+	"main.go/store"
 )
 
 type Book struct {
@@ -20,7 +24,7 @@ type Book struct {
 	BookDate   string `json:"book_date"`
 	// User_id       int    `json:"user_id"`
 	ImageFilename string `json:"image_filename"`
-	Borrowed      string `json:"borrowed`
+	Borrowed      string `json:"borrowed"`
 }
 
 type BorrowedBook struct {
@@ -31,9 +35,21 @@ type BorrowedBook struct {
 
 var DefaultBookService bookService
 
-type bookService struct{}
+type bookService struct {
+	Mailer        mail.Mailer
+	Books         store.BookRepository
+	Borrowings    store.BorrowingRepository
+	Users         store.UserRepository
+	Audit         audit.Auditor
+	Notifications notifications.Notifier
+}
+
+// LoanPeriod is how long a member may keep a borrowed book.
+func LoanPeriod() time.Duration {
+	return settings.loanPeriod()
+}
 
-func (bookService) ShowBooks(w http.ResponseWriter, r *http.Request, db *sql.DB) error {
+func (s bookService) ShowBooks(w http.ResponseWriter, r *http.Request) error {
 	filter := r.URL.Query().Get("filter")
 	sort := r.URL.Query().Get("sort")
 	pageStr := r.URL.Query().Get("page")
@@ -45,43 +61,39 @@ func (bookService) ShowBooks(w http.ResponseWriter, r *http.Request, db *sql.DB)
 		page = 1
 	}
 
-	offset := (page - 1) * limit
-
-	query := "SELECT * FROM books WHERE borrowed = false"
-	if filter != "" {
-		query += " AND (book_name LIKE '%" + filter + "%' OR book_author LIKE '%" + filter + "%' OR book_genre LIKE '%" + filter + "%')"
-	}
-	if sort != "" {
-		query += " ORDER BY " + sort
+	query := store.BookFilter{
+		Search:        filter,
+		AvailableOnly: true,
+		Sort:          sort,
+		Limit:         limit,
+		Offset:        (page - 1) * limit,
 	}
-	query += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
 
-	rows, err := db.Query(query)
+	found, err := s.Books.ListBooks(query)
 	if err != nil {
 		logrus.WithError(err).Error("Error querying database for books")
 		return err
 	}
-	defer rows.Close()
 
 	var books []Book
-
-	for rows.Next() {
-		var b Book
-
-		err := rows.Scan(&b.ID, &b.BookName, &b.BookAuthor, &b.BookGenre, &b.BookDate, &b.Borrowed)
-		if err != nil {
-			logrus.WithError(err).Error("Error scanning row for books")
-			return err
-		}
-		b.ImageFilename = fmt.Sprintf("img%d.jpg", b.ID)
-		books = append(books, b)
-	}
-
-	totalPages, err := getTotalPages(db, limit, filter)
+	for _, b := range found {
+		books = append(books, Book{
+			ID:            b.ID,
+			BookName:      b.Name,
+			BookAuthor:    b.Author,
+			BookGenre:     b.Genre,
+			BookDate:      b.Date,
+			ImageFilename: fmt.Sprintf("img%d.jpg", b.ID),
+			Borrowed:      strconv.FormatBool(b.Borrowed),
+		})
+	}
+
+	totalBooks, err := s.Books.CountBooks(query)
 	if err != nil {
 		logrus.WithError(err).Error("Error calculating total number of pages")
 		return err
 	}
+	totalPages := (totalBooks + limit - 1) / limit
 
 	err = renderBooksHTML(w, books, page, totalPages, filter, sort)
 	if err != nil {
@@ -92,22 +104,6 @@ func (bookService) ShowBooks(w http.ResponseWriter, r *http.Request, db *sql.DB)
 	return nil
 }
 
-func getTotalPages(db *sql.DB, limit int, filter string) (int, error) {
-	countQuery := "SELECT COUNT(*) FROM books"
-	if filter != "" {
-		countQuery += " WHERE book_name LIKE '%" + filter + "%' OR book_author LIKE '%" + filter + "%' OR book_genre LIKE '%" + filter + "%'"
-	}
-
-	var totalBooks int
-	err := db.QueryRow(countQuery).Scan(&totalBooks)
-	if err != nil {
-		return 0, err
-	}
-
-	totalPages := (totalBooks + limit - 1) / limit
-	return totalPages, nil
-}
-
 func renderBooksHTML(w http.ResponseWriter, books []Book, currentPage, totalPages int, filter, sort string) error {
 	tmpl, err := template.ParseFiles("library.html")
 	if err != nil {
@@ -150,7 +146,17 @@ func renderBooksHTML(w http.ResponseWriter, books []Book, currentPage, totalPage
 	return nil
 }
 
-func (bookService) BorrowBook(w http.ResponseWriter, r *http.Request, db *sql.DB) error {
+// currentUser resolves the logged-in member from the token cookie.
+func (s bookService) currentUser(r *http.Request) (store.User, error) {
+	cookie, err := r.Cookie("token")
+	if err != nil {
+		return store.User{}, errors.New("token not found in cookies")
+	}
+
+	return s.Users.UserByToken(cookie.Value)
+}
+
+func (s bookService) BorrowBook(w http.ResponseWriter, r *http.Request) error {
 	// Parse form data to get the book ID
 	err := r.ParseForm()
 	if err != nil {
@@ -162,29 +168,26 @@ func (bookService) BorrowBook(w http.ResponseWriter, r *http.Request, db *sql.DB
 		return errors.New("book ID is required")
 	}
 
-	cookie, err := r.Cookie("token")
+	user, err := s.currentUser(r)
 	if err != nil {
-		return errors.New("token not found in cookies")
+		return err
 	}
 
-	token := cookie.Value
-
 	// Convert book ID to integer
 	id, err := strconv.Atoi(bookID)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("INSERT INTO borrowings (book_id, user_id, borrowed_at) VALUES ($1, (SELECT id FROM user_table WHERE token = $2), CURRENT_TIMESTAMP)", id, token)
+	now := time.Now().UTC()
+	loan, err := s.Borrowings.Borrow(id, user.ID, now, now.Add(settings.loanPeriod()))
 	if err != nil {
 		return err
 	}
 
-	// Update the database to mark the book as borrowed
-	_, err = db.Exec("UPDATE books SET borrowed = true WHERE id = $1", id)
-	if err != nil {
-		return err
-	}
+	s.Audit.Record(r, "book.borrow", bookID, nil, nil)
+	s.Notifications.Create(user.ID, notifications.Borrowed, "You borrowed "+loan.BookName,
+		"Please return it by "+loan.DueAt.Format("Mon, 2 Jan 2006")+".", "/profile")
 
 	// Respond with a success message or any necessary response
 	fmt.Fprintf(w, "Book with ID %d has been borrowed successfully", id)
@@ -192,40 +195,24 @@ func (bookService) BorrowBook(w http.ResponseWriter, r *http.Request, db *sql.DB
 	return nil
 }
 
-func (bookService) ShowBorrowedBooks(w http.ResponseWriter, r *http.Request, db *sql.DB) error {
-	// Retrieve user ID from token in request cookies
-	cookie, err := r.Cookie("token")
-	if err != nil {
-		return errors.New("token not found in cookies")
-	}
-	token := cookie.Value
-
-	var userID int
-	var username string
-
-	err = db.QueryRow("SELECT id, username FROM user_table WHERE token = $1", token).Scan(&userID, &username)
+func (s bookService) ShowBorrowedBooks(w http.ResponseWriter, r *http.Request) error {
+	user, err := s.currentUser(r)
 	if err != nil {
 		return err
 	}
 
-	// Query the database to get borrowed books for the user
-	rows, err := db.Query("SELECT book_name, book_author, book_genre FROM books INNER JOIN borrowings ON books.id = borrowings.book_id WHERE borrowings.user_id = (SELECT id FROM user_table WHERE token = $1)", token)
+	loans, err := s.Borrowings.OpenLoans(user.ID)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
 
-	// Create a slice to hold BorrowedBook objects
 	var borrowedBooks []BorrowedBook
-
-	// Iterate over the rows and populate the borrowedBooks slice
-	for rows.Next() {
-		var b BorrowedBook
-		err := rows.Scan(&b.BookName, &b.BookAuthor, &b.BookGenre)
-		if err != nil {
-			return err
-		}
-		borrowedBooks = append(borrowedBooks, b)
+	for _, loan := range loans {
+		borrowedBooks = append(borrowedBooks, BorrowedBook{
+			BookName:   loan.BookName,
+			BookAuthor: loan.BookAuthor,
+			BookGenre:  loan.BookGenre,
+		})
 	}
 
 	// Render the borrowed books HTML template
@@ -236,11 +223,27 @@ func (bookService) ShowBorrowedBooks(w http.ResponseWriter, r *http.Request, db
 
 	data := struct {
 		Username      string
+		Email         string
+		DisplayName   string
+		Avatar        string
+		PendingEmail  string
+		DeletionDate  string
 		BorrowedBooks []BorrowedBook
+		Preferences   struct{ Announcements, Reminders, Holds bool }
 	}{
-		Username:      username,
+		Username:      user.Username,
+		Email:         user.Email,
+		DisplayName:   user.DisplayName,
+		Avatar:        user.Avatar,
+		PendingEmail:  user.PendingEmail,
 		BorrowedBooks: borrowedBooks,
 	}
+	data.Preferences.Announcements = user.EmailAnnouncements
+	data.Preferences.Reminders = user.EmailReminders
+	data.Preferences.Holds = user.EmailHolds
+	if user.DeletionRequestedAt != nil {
+		data.DeletionDate = user.DeletionRequestedAt.Format("2006-01-02")
+	}
 
 	err = tmpl.Execute(w, data)
 	if err != nil {
@@ -250,7 +253,7 @@ func (bookService) ShowBorrowedBooks(w http.ResponseWriter, r *http.Request, db
 	return nil
 }
 
-func (bookService) ReturnBook(w http.ResponseWriter, r *http.Request, db *sql.DB) error {
+func (s bookService) ReturnBook(w http.ResponseWriter, r *http.Request) error {
 	// Parse form data to get the book name
 	err := r.ParseForm()
 	if err != nil {
@@ -262,40 +265,22 @@ func (bookService) ReturnBook(w http.ResponseWriter, r *http.Request, db *sql.DB
 		return errors.New("book name is required")
 	}
 
-	// Retrieve user ID using token from cookies
-	cookie, err := r.Cookie("token")
-	if err != nil {
-		return errors.New("token not found in cookies")
-	}
-
-	token := cookie.Value
-	var userID int
-	err = db.QueryRow("SELECT id FROM user_table WHERE token = $1", token).Scan(&userID)
+	user, err := s.currentUser(r)
 	if err != nil {
 		return err
 	}
 
-	// Check if the user has borrowed the book
-	var exists bool
-	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM books INNER JOIN borrowings ON books.id = borrowings.book_id WHERE books.book_name = $1 AND borrowings.user_id = $2)", bookName, userID).Scan(&exists)
-	if err != nil {
-		return err
-	}
-	if !exists {
+	// Close the borrowing record, keeping it as loan history
+	_, err = s.Borrowings.Return(user.ID, bookName, time.Now().UTC())
+	if err == store.ErrNotFound {
 		return errors.New("the user has not borrowed this book")
 	}
-
-	// Remove borrowing record from the database
-	_, err = db.Exec("DELETE FROM borrowings WHERE book_id IN (SELECT id FROM books WHERE book_name = $1) AND user_id = $2", bookName, userID)
 	if err != nil {
 		return err
 	}
 
-	// Update the database to mark the book as returned
-	_, err = db.Exec("UPDATE books SET borrowed = false WHERE book_name = $1", bookName)
-	if err != nil {
-		return err
-	}
+	s.Audit.Record(r, "book.return", bookName, nil, nil)
+	s.Notifications.Create(user.ID, notifications.Returned, "You returned "+bookName, "Thanks for bringing it back.", "/library")
 
 	// Respond with a success message or any necessary response
 	fmt.Fprintf(w, "Book '%s' has been returned successfully", bookName)
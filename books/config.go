@@ -0,0 +1,65 @@
+package books
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Config holds the lending settings. Reminder offsets are in days: a "due
+// soon" email when a loan is due within that many days, an "overdue" email
+// once it is that many days late.
+type Config struct {
+	LoanPeriodDays      int   `env:"LOAN_PERIOD_DAYS"`
+	ReminderDaysBefore  []int `env:"REMINDER_DAYS_BEFORE"`
+	ReminderDaysOverdue []int `env:"REMINDER_DAYS_OVERDUE"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		LoanPeriodDays:      14,
+		ReminderDaysBefore:  []int{1, 3},
+		ReminderDaysOverdue: []int{1, 7, 14},
+	}
+}
+
+func (c Config) Validate() error {
+	if c.LoanPeriodDays < 1 {
+		return fmt.Errorf("LOAN_PERIOD_DAYS must be at least 1, got %d", c.LoanPeriodDays)
+	}
+	if err := validateOffsets("REMINDER_DAYS_BEFORE", c.ReminderDaysBefore); err != nil {
+		return err
+	}
+	return validateOffsets("REMINDER_DAYS_OVERDUE", c.ReminderDaysOverdue)
+}
+
+func validateOffsets(key string, offsets []int) error {
+	if len(offsets) == 0 {
+		return fmt.Errorf("%s must list at least one day", key)
+	}
+	for _, days := range offsets {
+		if days < 0 {
+			return fmt.Errorf("%s must not contain negative days, got %d", key, days)
+		}
+	}
+	return nil
+}
+
+var settings = DefaultConfig()
+
+// Configure applies the settings loaded at startup.
+func Configure(c Config) {
+	c.ReminderDaysBefore = sortedDays(c.ReminderDaysBefore)
+	c.ReminderDaysOverdue = sortedDays(c.ReminderDaysOverdue)
+	settings = c
+}
+
+func sortedDays(days []int) []int {
+	sorted := append([]int(nil), days...)
+	sort.Ints(sorted)
+	return sorted
+}
+
+func (c Config) loanPeriod() time.Duration {
+	return time.Duration(c.LoanPeriodDays) * 24 * time.Hour
+}
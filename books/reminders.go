@@ -0,0 +1,208 @@
+package books
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"main.go/events"
+	mail "main.go/mail-service"
+	"main.go/notifications"
+	"main.go/store"
+)
+
+type dueLoan struct {
+	BorrowingID int
+	UserID      int
+	Email       string
+	Username    string
+	DisplayName string
+	mail.LoanNotice
+}
+
+// reminderKind picks the reminder a loan is due for, e.g. "due-1" or
+// "overdue-7", or "" when none applies yet. Only the closest offset is
+// used, so a loan first seen a day before its due date gets one email
+// rather than one per offset it has already passed.
+func reminderKind(dueAt, now time.Time) string {
+	if dueAt.After(now) {
+		daysLeft := dueAt.Sub(now).Hours() / 24
+		for _, offset := range settings.ReminderDaysBefore {
+			if daysLeft <= float64(offset) {
+				return "due-" + strconv.Itoa(offset)
+			}
+		}
+		return ""
+	}
+
+	daysLate := now.Sub(dueAt).Hours() / 24
+	kind := ""
+	for _, offset := range settings.ReminderDaysOverdue {
+		if daysLate >= float64(offset) {
+			kind = "overdue-" + strconv.Itoa(offset)
+		}
+	}
+	return kind
+}
+
+// SendReminders emails members about loans coming due or overdue. Each
+// (loan, reminder) pair is recorded in loan_reminders before the email is
+// queued, so a restart never sends the same reminder twice.
+func (s bookService) SendReminders() (int, error) {
+	now := time.Now().UTC()
+
+	due, err := s.Borrowings.DueLoans(now.AddDate(0, 0, settings.ReminderDaysBefore[len(settings.ReminderDaysBefore)-1]))
+	if err != nil {
+		return 0, fmt.Errorf("error loading loans for reminders: %s", err)
+	}
+
+	type batch struct {
+		template string
+		loans    []dueLoan
+		kinds    []string
+	}
+	batches := map[string]*batch{}
+	var order []string
+	members := map[int]store.User{}
+
+	for _, l := range due {
+		member, ok := members[l.UserID]
+		if !ok {
+			member, err = s.Users.User(l.UserID)
+			if err != nil && err != store.ErrNotFound {
+				return 0, fmt.Errorf("error loading member for reminders: %s", err)
+			}
+			members[l.UserID] = member
+		}
+		if member.ID == 0 || member.DeletedAt != nil || !member.EmailReminders {
+			continue
+		}
+
+		kind := reminderKind(*l.DueAt, now)
+		if kind == "" {
+			continue
+		}
+
+		loan := dueLoan{
+			BorrowingID: l.ID,
+			UserID:      member.ID,
+			Email:       member.Email,
+			Username:    member.Username,
+			DisplayName: member.DisplayName,
+			LoanNotice:  mail.LoanNotice{Title: l.BookName, Author: l.BookAuthor, DueAt: *l.DueAt},
+		}
+
+		template := "due-soon"
+		if strings.HasPrefix(kind, "overdue") {
+			template = "overdue"
+		}
+
+		// One email per member and template, listing every loan in it.
+		key := strconv.Itoa(loan.UserID) + "/" + template
+		if batches[key] == nil {
+			batches[key] = &batch{template: template}
+			order = append(order, key)
+		}
+		batches[key].loans = append(batches[key].loans, loan)
+		batches[key].kinds = append(batches[key].kinds, kind)
+	}
+
+	sent := 0
+	for _, key := range order {
+		b := batches[key]
+
+		loans, kinds, err := s.claimReminders(b.loans, b.kinds, now)
+		if err != nil {
+			return sent, err
+		}
+		if len(loans) == 0 {
+			continue
+		}
+
+		data := mail.TemplateData{Name: loans[0].DisplayName}
+		if data.Name == "" {
+			data.Name = loans[0].Username
+		}
+		for _, loan := range loans {
+			data.Loans = append(data.Loans, loan.LoanNotice)
+		}
+
+		err = mail.SendTemplate(s.Mailer, b.template, loans[0].Email, data)
+		if err != nil {
+			// Give the reminder back so the next run can retry it.
+			s.releaseReminders(loans, kinds)
+			logrus.WithError(err).WithField("user_id", loans[0].UserID).Error("Error sending loan reminder")
+			continue
+		}
+		event, kind, title := events.DueSoon, notifications.DueSoon, "Books due soon"
+		if b.template == "overdue" {
+			event, kind, title = events.Overdue, notifications.Overdue, "Overdue books"
+		}
+		events.Publish(loans[0].UserID, event, map[string]interface{}{"loans": data.Loans})
+		s.Notifications.Create(loans[0].UserID, kind, title, loanSummary(data.Loans), "/profile")
+		sent++
+	}
+
+	return sent, nil
+}
+
+func loanSummary(loans []mail.LoanNotice) string {
+	var lines []string
+	for _, loan := range loans {
+		lines = append(lines, loan.Title+" (due "+loan.Due()+")")
+	}
+	return strings.Join(lines, ", ")
+}
+
+// claimReminders records the reminders and returns the loans that didn't
+// already have theirs.
+func (s bookService) claimReminders(loans []dueLoan, kinds []string, now time.Time) ([]dueLoan, []string, error) {
+	var claimedLoans []dueLoan
+	var claimedKinds []string
+
+	for i, loan := range loans {
+		claimed, err := s.Borrowings.ClaimReminder(loan.BorrowingID, kinds[i], now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if claimed {
+			claimedLoans = append(claimedLoans, loan)
+			claimedKinds = append(claimedKinds, kinds[i])
+		}
+	}
+
+	return claimedLoans, claimedKinds, nil
+}
+
+func (s bookService) releaseReminders(loans []dueLoan, kinds []string) {
+	for i, loan := range loans {
+		err := s.Borrowings.ReleaseReminder(loan.BorrowingID, kinds[i])
+		if err != nil {
+			logrus.WithError(err).Error("Error releasing loan reminder")
+		}
+	}
+}
+
+// RunReminders checks for due and overdue loans now and then every
+// interval. It is meant to run in its own goroutine for the server's
+// lifetime.
+func (s bookService) RunReminders(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sent, err := s.SendReminders()
+		if err != nil {
+			logrus.WithError(err).Error("Error sending loan reminders")
+		} else if sent > 0 {
+			logrus.WithFields(logrus.Fields{
+				"action": "loan_reminders",
+				"emails": sent,
+			}).Info("Loan reminders sent")
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,129 @@
+package books
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	mail "main.go/mail-service"
+	"main.go/store"
+)
+
+// recordingNotifier keeps the titles of the notices it is asked to create.
+type recordingNotifier struct {
+	titles []string
+}
+
+func (n *recordingNotifier) Create(userID int, notificationType, title, body, link string) {
+	n.titles = append(n.titles, title)
+}
+
+func (n *recordingNotifier) CreateForEmail(email string, notificationType, title, body, link string) {
+	n.titles = append(n.titles, title)
+}
+
+func TestReminderKind(t *testing.T) {
+	Configure(DefaultConfig())
+	now := time.Date(2024, 3, 10, 9, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		dueIn time.Duration
+		want  string
+	}{
+		{5 * day, ""},
+		{3 * day, "due-3"},
+		{2 * day, "due-3"},
+		{12 * time.Hour, "due-1"},
+		{-time.Hour, ""},
+		{-2 * day, "overdue-1"},
+		{-7 * day, "overdue-7"},
+		{-13 * day, "overdue-7"},
+		{-30 * day, "overdue-14"},
+	}
+
+	for _, test := range tests {
+		if got := reminderKind(now.Add(test.dueIn), now); got != test.want {
+			t.Errorf("due in %s: reminderKind = %q, want %q", test.dueIn, got, test.want)
+		}
+	}
+}
+
+func newReminderService(t *testing.T) (bookService, *store.Memory, *mail.MemoryMailer, *recordingNotifier) {
+	t.Helper()
+	Configure(DefaultConfig())
+
+	repos := store.NewMemory()
+	mailer := mail.NewMemoryMailer("library@example.com")
+	notifier := &recordingNotifier{}
+	return bookService{Mailer: mailer, Books: repos, Borrowings: repos, Users: repos, Notifications: notifier}, repos, mailer, notifier
+}
+
+// lend creates a member's loan due dueIn from now.
+func lend(t *testing.T, repos *store.Memory, member store.User, title string, dueIn time.Duration) {
+	t.Helper()
+	book := store.Book{Name: title, Author: "Anon"}
+	if err := repos.CreateBook(&book); err != nil {
+		t.Fatal(err)
+	}
+	dueAt := time.Now().UTC().Add(dueIn)
+	if _, err := repos.Borrow(book.ID, member.ID, dueAt.Add(-settings.loanPeriod()), dueAt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendRemindersSendsEachReminderOnce(t *testing.T) {
+	s, repos, mailer, notifier := newReminderService(t)
+
+	ada := store.User{Email: "ada@example.com", Username: "ada"}
+	if err := repos.CreateUser(&ada); err != nil {
+		t.Fatal(err)
+	}
+	lend(t, repos, ada, "Emma", 12*time.Hour)
+	lend(t, repos, ada, "Persuasion", 20*time.Hour)
+	lend(t, repos, ada, "Middlemarch", -3*24*time.Hour)
+
+	sent, err := s.SendReminders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One due-soon email listing both books and one overdue email.
+	if sent != 2 || len(mailer.Messages()) != 2 || len(notifier.titles) != 2 {
+		t.Fatalf("first run: sent %d, mailed %d, notified %v", sent, len(mailer.Messages()), notifier.titles)
+	}
+	for _, msg := range mailer.Messages() {
+		if strings.Contains(msg.Text, "Emma") != strings.Contains(msg.Text, "Persuasion") {
+			t.Errorf("books due soon were split across emails:\n%s", msg.Text)
+		}
+	}
+
+	sent, err = s.SendReminders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 0 || len(mailer.Messages()) != 2 || len(notifier.titles) != 2 {
+		t.Errorf("second run: sent %d, mailed %d in total", sent, len(mailer.Messages()))
+	}
+}
+
+func TestSendRemindersRespectsPreference(t *testing.T) {
+	s, repos, mailer, _ := newReminderService(t)
+
+	bob := store.User{Email: "bob@example.com", Username: "bob"}
+	if err := repos.CreateUser(&bob); err != nil {
+		t.Fatal(err)
+	}
+	bob.EmailReminders = false
+	if err := repos.UpdateUser(bob); err != nil {
+		t.Fatal(err)
+	}
+	lend(t, repos, bob, "Emma", -3*24*time.Hour)
+
+	sent, err := s.SendReminders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 0 || len(mailer.Messages()) != 0 {
+		t.Errorf("sent %d reminders to a member who turned them off", sent)
+	}
+}
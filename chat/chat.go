@@ -0,0 +1,241 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"main.go/events"
+)
+
+var log = logrus.New()
+
+const maxMessageLength = 2000
+
+// Conversation is a member's support thread. Each member has one; it is
+// created the first time they open the chat window.
+type Conversation struct {
+	ID            int        `json:"id"`
+	UserID        int        `json:"user_id"`
+	Username      string     `json:"username"`
+	Email         string     `json:"email"`
+	AdminUnread   int        `json:"admin_unread"`
+	MemberUnread  int        `json:"member_unread"`
+	LastMessage   string     `json:"last_message"`
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"`
+}
+
+type Message struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	FromAdmin      bool      `json:"from_admin"`
+	Body           string    `json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+var ErrNotFound = errors.New("conversation not found")
+
+// Service stores conversations and relays new messages to connected
+// members and admins.
+type Service struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	clients map[*client]bool
+}
+
+func NewService(db *sql.DB) *Service {
+	return &Service{db: db, clients: map[*client]bool{}}
+}
+
+const conversationColumns = `c.id, c.user_id, COALESCE(u.username, ''), COALESCE(u.email, ''), c.admin_unread, c.member_unread,
+	COALESCE((SELECT m.body FROM chat_messages m WHERE m.conversation_id = c.id ORDER BY m.id DESC LIMIT 1), ''),
+	c.last_message_at`
+
+func scanConversation(row interface{ Scan(...interface{}) error }) (Conversation, error) {
+	var c Conversation
+	var last sql.NullTime
+	err := row.Scan(&c.ID, &c.UserID, &c.Username, &c.Email, &c.AdminUnread, &c.MemberUnread, &c.LastMessage, &last)
+	if last.Valid {
+		c.LastMessageAt = &last.Time
+	}
+	return c, err
+}
+
+func (s *Service) Get(id int) (Conversation, error) {
+	c, err := scanConversation(s.db.QueryRow(`SELECT `+conversationColumns+`
+		FROM chat_conversations c LEFT JOIN user_table u ON u.id = c.user_id
+		WHERE c.id = $1`, id))
+	if err == sql.ErrNoRows {
+		return c, ErrNotFound
+	}
+	if err != nil {
+		return c, fmt.Errorf("error loading conversation: %s", err)
+	}
+	return c, nil
+}
+
+// Open returns the member's conversation, starting one if needed.
+func (s *Service) Open(userID int) (Conversation, error) {
+	var id int
+	err := s.db.QueryRow(`INSERT INTO chat_conversations (user_id, created_at) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+		RETURNING id`, userID, time.Now().UTC()).Scan(&id)
+	if err != nil {
+		return Conversation{}, fmt.Errorf("error opening conversation: %s", err)
+	}
+	return s.Get(id)
+}
+
+// Inbox lists conversations for admins, unread and most recent first.
+func (s *Service) Inbox() ([]Conversation, error) {
+	rows, err := s.db.Query(`SELECT ` + conversationColumns + `
+		FROM chat_conversations c LEFT JOIN user_table u ON u.id = c.user_id
+		WHERE c.last_message_at IS NOT NULL
+		ORDER BY c.admin_unread > 0 DESC, c.last_message_at DESC
+		LIMIT 200`)
+	if err != nil {
+		return nil, fmt.Errorf("error loading chat inbox: %s", err)
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		c, err := scanConversation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning conversation: %s", err)
+		}
+		conversations = append(conversations, c)
+	}
+	return conversations, rows.Err()
+}
+
+// Messages returns the conversation's history, oldest first.
+func (s *Service) Messages(conversationID int) ([]Message, error) {
+	rows, err := s.db.Query(`SELECT id, conversation_id, from_admin, body, created_at FROM (
+			SELECT id, conversation_id, from_admin, body, created_at FROM chat_messages
+			WHERE conversation_id = $1 ORDER BY id DESC LIMIT 500
+		) recent ORDER BY id`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading chat messages: %s", err)
+	}
+	return scanMessages(rows)
+}
+
+// History returns every message in the member's conversation, oldest
+// first, for their data export.
+func (s *Service) History(userID int) ([]Message, error) {
+	rows, err := s.db.Query(`SELECT m.id, m.conversation_id, m.from_admin, m.body, m.created_at
+		FROM chat_messages m JOIN chat_conversations c ON c.id = m.conversation_id
+		WHERE c.user_id = $1 ORDER BY m.id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading chat history: %s", err)
+	}
+	return scanMessages(rows)
+}
+
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.FromAdmin, &m.Body, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning chat message: %s", err)
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// MarkRead clears the unread count for the admins' or the member's side.
+func (s *Service) MarkRead(conversationID int, admin bool) error {
+	column := "member_unread"
+	if admin {
+		column = "admin_unread"
+	}
+	_, err := s.db.Exec("UPDATE chat_conversations SET "+column+" = 0 WHERE id = $1", conversationID)
+	if err != nil {
+		return fmt.Errorf("error marking conversation read: %s", err)
+	}
+
+	c, err := s.Get(conversationID)
+	if err != nil {
+		return err
+	}
+	s.broadcast(c, event{Type: "read", Conversation: &c})
+	return nil
+}
+
+// Post stores a message and delivers it to everyone watching the
+// conversation.
+func (s *Service) Post(conversationID int, senderID int, fromAdmin bool, body string) (Message, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return Message{}, errors.New("message is empty")
+	}
+	if len(body) > maxMessageLength {
+		return Message{}, fmt.Errorf("message is longer than %d characters", maxMessageLength)
+	}
+
+	// The other side gets the unread message.
+	column := "admin_unread"
+	if fromAdmin {
+		column = "member_unread"
+	}
+
+	now := time.Now().UTC()
+	m := Message{ConversationID: conversationID, FromAdmin: fromAdmin, Body: body, CreatedAt: now}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return m, fmt.Errorf("error saving chat message: %s", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE chat_conversations SET "+column+" = "+column+" + 1, last_message_at = $1 WHERE id = $2", now, conversationID)
+	if err != nil {
+		return m, fmt.Errorf("error saving chat message: %s", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return m, ErrNotFound
+	}
+	err = tx.QueryRow("INSERT INTO chat_messages (conversation_id, sender_id, from_admin, body, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		conversationID, senderID, fromAdmin, body, now).Scan(&m.ID)
+	if err != nil {
+		return m, fmt.Errorf("error saving chat message: %s", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return m, fmt.Errorf("error saving chat message: %s", err)
+	}
+
+	c, err := s.Get(conversationID)
+	if err != nil {
+		return m, err
+	}
+	s.broadcast(c, event{Type: "message", Message: &m, Conversation: &c})
+	if fromAdmin {
+		events.Publish(c.UserID, events.ChatReply, m)
+	}
+	return m, nil
+}
+
+func init() {
+	// Create or open the log file
+	file, err := os.OpenFile("logfile.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err == nil {
+		// Set the logrus output to the file
+		log.SetOutput(file)
+	} else {
+		// If unable to open the log file, log to standard output
+		log.Warn("Failed to open log file. Logging to standard output.")
+	}
+
+	log.SetFormatter(&logrus.JSONFormatter{})
+	log.SetLevel(logrus.InfoLevel)
+}
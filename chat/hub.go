@@ -0,0 +1,198 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	sendBuffer = 32
+)
+
+// The default origin check only accepts pages served by this server.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// event is what the server pushes to browsers: a new message, or a change
+// in a conversation's unread counts.
+type event struct {
+	Type         string        `json:"type"`
+	Message      *Message      `json:"message,omitempty"`
+	Conversation *Conversation `json:"conversation,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// command is what browsers send. Members may omit ConversationID; their
+// own conversation is always used.
+type command struct {
+	Type           string `json:"type"`
+	ConversationID int    `json:"conversation_id"`
+	Body           string `json:"body"`
+}
+
+type client struct {
+	conn   *websocket.Conn
+	send   chan []byte
+	userID int
+	admin  bool
+}
+
+// ServeWS upgrades the request and relays messages for an authenticated
+// member or admin until the connection closes.
+func (s *Service) ServeWS(w http.ResponseWriter, r *http.Request, userID int, admin bool) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.WithError(err).Warn("Error upgrading chat connection")
+		return
+	}
+
+	c := &client{conn: conn, send: make(chan []byte, sendBuffer), userID: userID, admin: admin}
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+
+	go s.writePump(c)
+	s.readPump(c)
+}
+
+func (s *Service) remove(c *client) {
+	s.mu.Lock()
+	if s.clients[c] {
+		delete(s.clients, c)
+		close(c.send)
+	}
+	s.mu.Unlock()
+}
+
+// broadcast sends e to the conversation's member and to every admin. A
+// client too slow to keep up is disconnected rather than stalling the rest.
+func (s *Service) broadcast(conversation Conversation, e event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.WithError(err).Error("Error encoding chat event")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		if !c.admin && c.userID != conversation.UserID {
+			continue
+		}
+		s.queue(c, data)
+	}
+}
+
+// reply sends e to one client. A client that broadcast has already dropped
+// is skipped, since its send channel is closed.
+func (s *Service) reply(c *client, e event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.WithError(err).Error("Error encoding chat event")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[c] {
+		s.queue(c, data)
+	}
+}
+
+// queue hands data to the client's writer, disconnecting the client if its
+// buffer is full. The caller holds s.mu.
+func (s *Service) queue(c *client, data []byte) {
+	select {
+	case c.send <- data:
+	default:
+		delete(s.clients, c)
+		close(c.send)
+	}
+}
+
+func (s *Service) readPump(c *client) {
+	defer func() {
+		s.remove(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(4 * maxMessageLength)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		var cmd command
+		err := c.conn.ReadJSON(&cmd)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.WithError(err).Warn("Chat connection closed unexpectedly")
+			}
+			return
+		}
+
+		err = s.handle(c, cmd)
+		if err != nil {
+			log.WithError(err).WithFields(logrus.Fields{"user_id": c.userID, "command": cmd.Type}).Warn("Chat command failed")
+			s.reply(c, event{Type: "error", Error: err.Error()})
+		}
+	}
+}
+
+func (s *Service) handle(c *client, cmd command) error {
+	conversationID := cmd.ConversationID
+	if !c.admin {
+		conversation, err := s.Open(c.userID)
+		if err != nil {
+			return err
+		}
+		conversationID = conversation.ID
+	}
+
+	switch cmd.Type {
+	case "message":
+		_, err := s.Post(conversationID, c.userID, c.admin, cmd.Body)
+		return err
+	case "read":
+		return s.MarkRead(conversationID, c.admin)
+	default:
+		return nil
+	}
+}
+
+func (s *Service) writePump(c *client) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
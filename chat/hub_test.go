@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/gorilla/websocket"
+	"main.go/migrations"
+)
+
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "library.db")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrations.Up(db, "sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	return NewService(db)
+}
+
+// connect opens a chat connection as the given member or admin.
+func connect(t *testing.T, s *Service, userID int, admin bool) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeWS(w, r, userID, admin)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readEvent(t *testing.T, conn *websocket.Conn) event {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var e event
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestMessageReachesMemberAndAdmins(t *testing.T) {
+	s := newTestService(t)
+	admin := connect(t, s, 1, true)
+	member := connect(t, s, 2, false)
+
+	err := member.WriteJSON(command{Type: "message", Body: "Is Emma back yet?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, conn := range map[string]*websocket.Conn{"member": member, "admin": admin} {
+		e := readEvent(t, conn)
+		if e.Type != "message" || e.Message == nil || e.Message.Body != "Is Emma back yet?" {
+			t.Errorf("%s got %+v", name, e)
+		}
+	}
+}
+
+func TestFailedCommandRepliesWithError(t *testing.T) {
+	s := newTestService(t)
+	member := connect(t, s, 2, false)
+
+	err := member.WriteJSON(command{Type: "message", Body: "   "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := readEvent(t, member)
+	if e.Type != "error" || e.Error != "message is empty" {
+		t.Errorf("got %+v, want an error event", e)
+	}
+}
+
+func TestSlowClientIsDroppedWithoutPanics(t *testing.T) {
+	s := newTestService(t)
+
+	// Nothing drains this client's buffer, as if its connection had
+	// stalled.
+	slow := &client{send: make(chan []byte, 1), userID: 2}
+	s.mu.Lock()
+	s.clients[slow] = true
+	s.mu.Unlock()
+
+	conversation := Conversation{ID: 1, UserID: 2}
+	s.broadcast(conversation, event{Type: "read"})
+	s.broadcast(conversation, event{Type: "read"})
+
+	s.mu.Lock()
+	registered := s.clients[slow]
+	s.mu.Unlock()
+	if registered {
+		t.Fatal("slow client is still registered after its buffer filled")
+	}
+	if data, ok := <-slow.send; !ok || !json.Valid(data) {
+		t.Errorf("first event = %q, %v", data, ok)
+	}
+	if _, ok := <-slow.send; ok {
+		t.Error("send channel of a dropped client is still open")
+	}
+
+	// Replying to a client broadcast has dropped must not send on its
+	// closed channel.
+	s.reply(slow, event{Type: "error", Error: "message is empty"})
+	s.remove(slow)
+}
@@ -0,0 +1,242 @@
+// Package config loads the application settings once at startup and hands
+// each service its typed section.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+	"main.go/audit"
+	"main.go/books"
+	mail "main.go/mail-service"
+	"main.go/users"
+)
+
+type Config struct {
+	Port       string `env:"PORT"`
+	DriverName string `env:"DRIVERNAME"`
+	ConnStr    string `env:"CONN_STR"`
+
+	Users users.Config
+	Books books.Config
+	Mail  mail.Config
+	Audit audit.Config
+}
+
+// required lists the settings that have no sensible default.
+var required = []string{"DRIVERNAME", "CONN_STR", "API_URL", "FROM_MAIL"}
+
+func Default() Config {
+	return Config{
+		Port:  ":8000",
+		Users: users.DefaultConfig(),
+		Books: books.DefaultConfig(),
+		Audit: audit.DefaultConfig(),
+	}
+}
+
+// Load reads the settings from, lowest priority first, the YAML or TOML
+// file named by CONFIG_FILE, a .env file in the working directory and the
+// process environment. Both files are optional.
+func Load() (Config, error) {
+	dotenv, err := godotenv.Read(".env")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Config{}, fmt.Errorf("error reading .env: %s", err)
+	}
+
+	lookup := func(key string) (string, bool) {
+		if value, ok := os.LookupEnv(key); ok {
+			return value, true
+		}
+		value, ok := dotenv[key]
+		return value, ok
+	}
+
+	var file map[string]string
+	if path, ok := lookup("CONFIG_FILE"); ok && path != "" {
+		file, err = ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	return FromSources(lookup, file)
+}
+
+// FromSources builds the configuration from a lookup function, such as
+// os.LookupEnv, falling back to the values read from a config file.
+func FromSources(lookup func(string) (string, bool), file map[string]string) (Config, error) {
+	source := func(key string) (string, bool) {
+		if value, ok := lookup(key); ok {
+			return value, true
+		}
+		value, ok := file[key]
+		return value, ok
+	}
+
+	c := Default()
+	present, err := decode(reflect.ValueOf(&c).Elem(), source)
+	if err != nil {
+		return Config{}, err
+	}
+	c.Mail = c.Mail.WithDefaults()
+
+	var missing []string
+	for _, key := range required {
+		if !present[key] {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return Config{}, fmt.Errorf("missing required settings: %s", strings.Join(missing, ", "))
+	}
+
+	// The migrations own the schema and always create user_table, so an
+	// install that kept its users elsewhere has to rename the table.
+	table, _ := source("TABLENAME")
+	if table = strings.TrimSpace(table); table != "" && table != "user_table" {
+		return Config{}, fmt.Errorf("TABLENAME is no longer supported: rename table %s to user_table and remove the setting", table)
+	}
+
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	if c.Port == "" {
+		return errors.New("PORT must not be empty")
+	}
+	for _, section := range []interface{ Validate() error }{c.Users, c.Books, c.Mail, c.Audit} {
+		if err := section.Validate(); err != nil {
+			return fmt.Errorf("invalid configuration: %s", err)
+		}
+	}
+	return nil
+}
+
+// decode sets every field with an env tag that has a non-empty value in
+// source, and reports which keys were set.
+func decode(v reflect.Value, source func(string) (string, bool)) (map[string]bool, error) {
+	present := map[string]bool{}
+
+	var walk func(v reflect.Value) error
+	walk = func(v reflect.Value) error {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			key := v.Type().Field(i).Tag.Get("env")
+			if key == "" {
+				if field.Kind() == reflect.Struct {
+					if err := walk(field); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			value, ok := source(key)
+			value = strings.TrimSpace(value)
+			if !ok || value == "" {
+				continue
+			}
+			if err := set(field, value); err != nil {
+				return fmt.Errorf("%s: %s", key, err)
+			}
+			present[key] = true
+		}
+		return nil
+	}
+
+	return present, walk(v)
+}
+
+func set(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		items := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			item := reflect.New(field.Type().Elem()).Elem()
+			if err := set(item, part); err != nil {
+				return err
+			}
+			items = reflect.Append(items, item)
+		}
+		field.Set(items)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// ReadFile reads a YAML or TOML config file into the same keys as the
+// environment. Nested tables are joined with underscores and lists with
+// commas, so smtp: {host: ...} sets SMTP_HOST.
+func ReadFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %s", err)
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %s", path, err)
+	}
+
+	values := map[string]string{}
+	flatten("", raw, values)
+	return values, nil
+}
+
+func flatten(prefix string, value interface{}, values map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+			if prefix != "" {
+				name = prefix + "_" + name
+			}
+			flatten(name, item, values)
+		}
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, fmt.Sprint(item))
+		}
+		values[prefix] = strings.Join(parts, ",")
+	case nil:
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+}
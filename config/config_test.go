@@ -0,0 +1,143 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func lookupMap(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+}
+
+var minimal = map[string]string{
+	"DRIVERNAME": "postgres",
+	"CONN_STR":   "postgres://localhost/library",
+	"API_URL":    "http://localhost:8000",
+	"FROM_MAIL":  "library@example.com",
+	"SMTP_HOST":  "smtp.example.com",
+	"SMTP_PORT":  "587",
+}
+
+func withValues(extra map[string]string) map[string]string {
+	values := map[string]string{}
+	for key, value := range minimal {
+		values[key] = value
+	}
+	for key, value := range extra {
+		values[key] = value
+	}
+	return values
+}
+
+func TestFromSourcesAppliesDefaults(t *testing.T) {
+	c, err := FromSources(lookupMap(minimal), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Port != ":8000" || c.Books.LoanPeriodDays != 14 {
+		t.Errorf("defaults not applied: %+v", c)
+	}
+	if c.Users.APIURL != "http://localhost:8000" || c.Mail.BaseURL != "http://localhost:8000" {
+		t.Errorf("API_URL not shared: %q, %q", c.Users.APIURL, c.Mail.BaseURL)
+	}
+	if c.Mail.Backend != "smtp" || c.Mail.Username != "library@example.com" {
+		t.Errorf("mail defaults not applied: %+v", c.Mail)
+	}
+}
+
+func TestFromSourcesParsesTypedValues(t *testing.T) {
+	c, err := FromSources(lookupMap(withValues(map[string]string{
+		"BCRYPT_COST":          "12",
+		"REMINDER_DAYS_BEFORE": "5, 2",
+		"MAIL_RATE_PER_SECOND": "2.5",
+		"DKIM_HEADERS":         "From,Subject",
+		"TRUSTED_PROXIES":      "10.0.0.1, 192.168.0.0/16",
+		"TABLENAME":            "user_table", // left over in older .env files
+	})), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Users.BcryptCost != 12 {
+		t.Errorf("BcryptCost = %d", c.Users.BcryptCost)
+	}
+	if !reflect.DeepEqual(c.Books.ReminderDaysBefore, []int{5, 2}) {
+		t.Errorf("ReminderDaysBefore = %v", c.Books.ReminderDaysBefore)
+	}
+	if c.Mail.RatePerSecond != 2.5 {
+		t.Errorf("RatePerSecond = %v", c.Mail.RatePerSecond)
+	}
+	if !reflect.DeepEqual(c.Mail.DKIMHeaders, []string{"From", "Subject"}) {
+		t.Errorf("DKIMHeaders = %v", c.Mail.DKIMHeaders)
+	}
+	if !reflect.DeepEqual(c.Audit.TrustedProxies, []string{"10.0.0.1", "192.168.0.0/16"}) {
+		t.Errorf("TrustedProxies = %v", c.Audit.TrustedProxies)
+	}
+}
+
+func TestFromSourcesReportsErrors(t *testing.T) {
+	tests := []struct {
+		values map[string]string
+		want   string
+	}{
+		{map[string]string{"DRIVERNAME": "postgres", "FROM_MAIL": ""}, "missing required settings: CONN_STR, API_URL, FROM_MAIL"},
+		{withValues(map[string]string{"LOAN_PERIOD_DAYS": "two weeks"}), `LOAN_PERIOD_DAYS: "two weeks" is not a whole number`},
+		{withValues(map[string]string{"BCRYPT_COST": "99"}), "BCRYPT_COST must be between"},
+		{withValues(map[string]string{"MAIL_BACKEND": "pigeon"}), "MAIL_BACKEND must be smtp, file or memory"},
+		{withValues(map[string]string{"TRUSTED_PROXIES": "10.0.0.1, proxy"}), `TRUSTED_PROXIES: "proxy" is not an IP address`},
+		{withValues(map[string]string{"TABLENAME": "members"}), "TABLENAME is no longer supported: rename table members to user_table"},
+	}
+
+	for _, test := range tests {
+		_, err := FromSources(lookupMap(test.values), nil)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("error = %v, want %q", err, test.want)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.yaml": "port: \":9000\"\nsmtp:\n  host: mail.example.com\nreminder_days_overdue: [2, 4]\n",
+		"config.toml": "port = \":9000\"\nreminder_days_overdue = [2, 4]\n\n[smtp]\nhost = \"mail.example.com\"\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		want := map[string]string{"PORT": ":9000", "SMTP_HOST": "mail.example.com", "REMINDER_DAYS_OVERDUE": "2,4"}
+		if !reflect.DeepEqual(values, want) {
+			t.Errorf("%s: values = %v, want %v", name, values, want)
+		}
+	}
+
+	if _, err := ReadFile(filepath.Join(dir, "config.json")); err == nil {
+		t.Error("expected an error for an unsupported file")
+	}
+}
+
+func TestEnvironmentOverridesFile(t *testing.T) {
+	file := withValues(map[string]string{"PORT": ":9000", "SMTP_HOST": "file.example.com"})
+	c, err := FromSources(lookupMap(map[string]string{"SMTP_HOST": "env.example.com"}), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != ":9000" || c.Mail.Host != "env.example.com" {
+		t.Errorf("Port = %q, Host = %q", c.Port, c.Mail.Host)
+	}
+}
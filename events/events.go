@@ -0,0 +1,153 @@
+// Package events is an in-process pub/sub hub for pushing notifications to
+// logged-in members as they happen. Services publish; the /events handler
+// subscribes and streams to the browser.
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types pushed to browsers.
+const (
+	HoldReady      = "hold_ready"
+	DueSoon        = "due_soon"
+	Overdue        = "overdue"
+	AdminMessage   = "admin_message"
+	Announcement   = "announcement"
+	ChatReply      = "chat_reply"
+	AccountUpdated = "account_updated"
+	Notification   = "notification"
+)
+
+const (
+	subscriptionBuffer = 16
+	replaySize         = 200
+)
+
+type Event struct {
+	ID        int64       `json:"id"`
+	Type      string      `json:"type"`
+	Data      interface{} `json:"data"`
+	CreatedAt time.Time   `json:"created_at"`
+
+	userID int
+	email  string
+	all    bool
+}
+
+func (e Event) matches(s *Subscription) bool {
+	return e.all || (e.userID != 0 && e.userID == s.userID) || (e.email != "" && e.email == s.email)
+}
+
+// Hub fans published events out to matching subscriptions. It keeps the
+// last few events so a reconnecting browser can catch up on what it missed.
+type Hub struct {
+	mu     sync.Mutex
+	nextID int64
+	subs   map[*Subscription]bool
+	recent []Event
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: map[*Subscription]bool{}}
+}
+
+// Subscription receives the events for one member. Events are dropped if
+// the subscriber falls more than a buffer behind.
+type Subscription struct {
+	C <-chan Event
+
+	c      chan Event
+	hub    *Hub
+	userID int
+	email  string
+}
+
+// Subscribe registers a member. Events newer than lastID that are still
+// held for replay are delivered first.
+func (h *Hub) Subscribe(userID int, email string, lastID int64) *Subscription {
+	c := make(chan Event, subscriptionBuffer)
+	s := &Subscription{C: c, c: c, hub: h, userID: userID, email: strings.ToLower(email)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if lastID > 0 {
+		for _, e := range h.recent {
+			if e.ID > lastID && e.matches(s) {
+				select {
+				case c <- e:
+				default:
+				}
+			}
+		}
+	}
+	h.subs[s] = true
+	return s
+}
+
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if s.hub.subs[s] {
+		delete(s.hub.subs, s)
+		close(s.c)
+	}
+}
+
+func (h *Hub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	e.ID = h.nextID
+	e.CreatedAt = time.Now().UTC()
+
+	h.recent = append(h.recent, e)
+	if len(h.recent) > replaySize {
+		h.recent = h.recent[len(h.recent)-replaySize:]
+	}
+
+	for s := range h.subs {
+		if !e.matches(s) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+		}
+	}
+}
+
+// ToUser publishes an event for one member.
+func (h *Hub) ToUser(userID int, eventType string, data interface{}) {
+	h.publish(Event{Type: eventType, Data: data, userID: userID})
+}
+
+// ToEmail publishes an event for the member with this address, for
+// services that only know who they are mailing.
+func (h *Hub) ToEmail(email string, eventType string, data interface{}) {
+	h.publish(Event{Type: eventType, Data: data, email: strings.ToLower(email)})
+}
+
+// Broadcast publishes an event for every connected member.
+func (h *Hub) Broadcast(eventType string, data interface{}) {
+	h.publish(Event{Type: eventType, Data: data, all: true})
+}
+
+// Default is the hub the services publish into.
+var Default = NewHub()
+
+func Publish(userID int, eventType string, data interface{}) {
+	Default.ToUser(userID, eventType, data)
+}
+
+func PublishEmail(email string, eventType string, data interface{}) {
+	Default.ToEmail(email, eventType, data)
+}
+
+func Broadcast(eventType string, data interface{}) {
+	Default.Broadcast(eventType, data)
+}
@@ -0,0 +1,144 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, s *Subscription) Event {
+	t.Helper()
+	select {
+	case e := <-s.C:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return Event{}
+	}
+}
+
+func assertEmpty(t *testing.T, s *Subscription) {
+	t.Helper()
+	select {
+	case e := <-s.C:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestHubRoutesEvents(t *testing.T) {
+	hub := NewHub()
+	ada := hub.Subscribe(1, "Ada@example.com", 0)
+	bob := hub.Subscribe(2, "bob@example.com", 0)
+	defer ada.Close()
+	defer bob.Close()
+
+	hub.ToUser(1, DueSoon, "loans")
+	if e := receive(t, ada); e.Type != DueSoon || e.Data != "loans" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	assertEmpty(t, bob)
+
+	hub.ToEmail("ada@EXAMPLE.com", AdminMessage, "hello")
+	if e := receive(t, ada); e.Type != AdminMessage {
+		t.Errorf("unexpected event %+v", e)
+	}
+	assertEmpty(t, bob)
+
+	hub.Broadcast(Announcement, "news")
+	receive(t, ada)
+	receive(t, bob)
+}
+
+func TestHubReplaysMissedEvents(t *testing.T) {
+	hub := NewHub()
+	first := hub.Subscribe(1, "", 0)
+	hub.ToUser(1, ChatReply, "one")
+	seen := receive(t, first)
+	first.Close()
+
+	hub.ToUser(1, ChatReply, "two")
+	hub.ToUser(2, ChatReply, "not yours")
+
+	again := hub.Subscribe(1, "", seen.ID)
+	defer again.Close()
+	if e := receive(t, again); e.Data != "two" {
+		t.Errorf("replayed %+v, want the missed event", e)
+	}
+	assertEmpty(t, again)
+}
+
+func TestHubDoesNotBlockOnSlowSubscribers(t *testing.T) {
+	hub := NewHub()
+	slow := hub.Subscribe(1, "", 0)
+	defer slow.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < subscriptionBuffer*3; i++ {
+			hub.ToUser(1, DueSoon, i)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishing blocked on a full subscription")
+	}
+	if len(slow.C) != subscriptionBuffer {
+		t.Errorf("buffered %d events, want %d", len(slow.C), subscriptionBuffer)
+	}
+}
+
+func TestStreamWritesServerSentEvents(t *testing.T) {
+	hub := NewHub()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub.Stream(w, r, 7, "ada@example.com")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	readBlock := func() string {
+		var block strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return block.String()
+			}
+			block.WriteString(line)
+		}
+	}
+
+	if block := readBlock(); block != "retry: 5000\n" {
+		t.Fatalf("first block = %q", block)
+	}
+
+	hub.ToUser(7, HoldReady, map[string]string{"book": "Dune"})
+	block := readBlock()
+	for _, want := range []string{"id: 1\n", "event: hold_ready\n", `"book":"Dune"`} {
+		if !strings.Contains(block, want) {
+			t.Errorf("%q not found in %q", want, block)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Shows the notifications pushed over /events as dismissable alerts, keeps
+// the navbar's unread badge current, and re-dispatches each event on
+// document as "librabook:<type>" for pages that want to react to them.
+(function () {
+    if (!window.EventSource) {
+        return;
+    }
+
+    function describe(type, data) {
+        switch (type) {
+            case 'hold_ready':
+                return ['Hold ready', '"' + data.book + '" is ready for pickup.'];
+            case 'due_soon':
+                return ['Due soon', data.loans.map(loan => loan.title + ' (' + new Date(loan.due_at).toLocaleDateString() + ')').join(', ')];
+            case 'overdue':
+                return ['Overdue', data.loans.map(loan => loan.title).join(', ') + ' should have been returned.'];
+            case 'admin_message':
+                return ['Message from the library', data.text];
+            case 'announcement':
+                return ['Announcement', data.subject];
+            case 'chat_reply':
+                return ['Tech Support replied', data.body];
+            case 'account_updated':
+                return ['Account updated', data.message || (data.activated ? 'Your account was activated.' : 'Your account was deactivated.')];
+        }
+        return null;
+    }
+
+    function container() {
+        let box = document.getElementById('liveNotifications');
+        if (!box) {
+            box = document.createElement('div');
+            box.id = 'liveNotifications';
+            box.style.cssText = 'position: fixed; top: 20px; right: 20px; width: 320px; z-index: 2000;';
+            document.body.appendChild(box);
+        }
+        return box;
+    }
+
+    function show(title, text) {
+        const alert = document.createElement('div');
+        alert.className = 'alert alert-info shadow-sm';
+        alert.setAttribute('role', 'alert');
+
+        const close = document.createElement('button');
+        close.type = 'button';
+        close.className = 'close';
+        close.innerHTML = '&times;';
+        close.onclick = () => alert.remove();
+
+        const heading = document.createElement('strong');
+        heading.textContent = title;
+        const body = document.createElement('div');
+        body.textContent = text;
+
+        alert.appendChild(close);
+        alert.appendChild(heading);
+        alert.appendChild(body);
+        container().appendChild(alert);
+        setTimeout(() => alert.remove(), 10000);
+    }
+
+    // The navbar badge shows the unread count of the notification center.
+    function setUnread(count) {
+        const badge = document.getElementById('notificationBadge');
+        if (badge) {
+            badge.textContent = count > 0 ? count : '';
+        }
+    }
+
+    if (document.getElementById('notificationBadge')) {
+        fetch('/notifications/unread')
+            .then(response => response.ok ? response.json() : { unread: 0 })
+            .then(data => setUnread(data.unread))
+            .catch(error => console.error('Error:', error));
+    }
+
+    const source = new EventSource('/events');
+
+    // Notices also arrive as their own event type, which shows the alert;
+    // this one only keeps the badge current.
+    source.addEventListener('notification', e => {
+        const event = JSON.parse(e.data);
+        setUnread(event.data.unread);
+        document.dispatchEvent(new CustomEvent('librabook:notification', { detail: event.data }));
+    });
+
+    const types = ['hold_ready', 'due_soon', 'overdue', 'admin_message', 'announcement', 'chat_reply', 'account_updated'];
+
+    types.forEach(type => {
+        source.addEventListener(type, e => {
+            const event = JSON.parse(e.data);
+            document.dispatchEvent(new CustomEvent('librabook:' + type, { detail: event.data }));
+
+            const text = describe(type, event.data);
+            if (text) {
+                show(text[0], text[1]);
+            }
+        });
+    });
+})();
@@ -0,0 +1,243 @@
+package mail
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Bounce is one recipient of a delivery status notification (RFC 3464).
+type Bounce struct {
+	Recipient  string
+	Action     string // failed, delayed, delivered, relayed or expanded
+	Status     string // enhanced status code, e.g. 5.1.1
+	Diagnostic string
+	MessageID  string // of the message that bounced, when the DSN includes it
+}
+
+// Hard reports a permanent failure: the address should not be mailed again.
+func (b Bounce) Hard() bool {
+	return b.Action == "failed" && strings.HasPrefix(b.Status, "5")
+}
+
+// Soft reports a temporary failure the sending server is still retrying.
+func (b Bounce) Soft() bool {
+	return b.Action == "delayed" || (b.Action == "failed" && strings.HasPrefix(b.Status, "4"))
+}
+
+var errNotDSN = errors.New("not a delivery status notification")
+
+// ParseBounce reads a DSN and returns a Bounce per reported recipient.
+func ParseBounce(r io.Reader) ([]Bounce, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading bounce: %s", err)
+	}
+
+	var bounces []Bounce
+	var messageID string
+	err = walkParts(textproto.MIMEHeader(msg.Header), msg.Body, func(contentType string, body io.Reader) error {
+		switch contentType {
+		case "message/delivery-status":
+			found, err := parseDeliveryStatus(body)
+			bounces = append(bounces, found...)
+			return err
+		case "text/rfc822-headers", "message/rfc822":
+			header, err := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+			if header != nil && messageID == "" {
+				messageID = header.Get("Message-Id")
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading bounce: %s", err)
+	}
+	if len(bounces) == 0 {
+		return nil, errNotDSN
+	}
+
+	for i := range bounces {
+		bounces[i].MessageID = messageID
+	}
+	return bounces, nil
+}
+
+// walkParts calls visit for every leaf part of a MIME body, descending into
+// nested multiparts.
+func walkParts(header textproto.MIMEHeader, body io.Reader, visit func(contentType string, body io.Reader) error) error {
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		contentType = "text/plain"
+	}
+
+	if !strings.HasPrefix(contentType, "multipart/") {
+		return visit(contentType, body)
+	}
+
+	parts := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = walkParts(part.Header, part, visit)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseDeliveryStatus reads the per-message block and then one block per
+// recipient, each a set of header-style fields separated by blank lines.
+func parseDeliveryStatus(body io.Reader) ([]Bounce, error) {
+	reader := textproto.NewReader(bufio.NewReader(body))
+
+	var bounces []Bounce
+	for {
+		fields, err := reader.ReadMIMEHeader()
+		if recipient := dsnAddress(fields.Get("Final-Recipient")); recipient != "" {
+			bounces = append(bounces, Bounce{
+				Recipient:  recipient,
+				Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+				Status:     strings.TrimSpace(fields.Get("Status")),
+				Diagnostic: strings.TrimSpace(fields.Get("Diagnostic-Code")),
+			})
+		}
+		if err == io.EOF {
+			return bounces, nil
+		}
+		if err != nil {
+			return bounces, err
+		}
+	}
+}
+
+// dsnAddress strips the address type from a field like
+// "rfc822; reader@example.com".
+func dsnAddress(field string) string {
+	if i := strings.Index(field, ";"); i >= 0 {
+		field = field[i+1:]
+	}
+	return strings.ToLower(strings.Trim(strings.TrimSpace(field), "<>"))
+}
+
+// ProcessBounces reads new messages from the maildir at dir, logs each
+// reported recipient and suppresses hard bounces. Processed messages are
+// moved to cur/ and marked seen, whether or not they were DSNs.
+func ProcessBounces(db *sql.DB, dir string) (int, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return 0, fmt.Errorf("error reading bounce mailbox: %s", err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "cur"), 0700)
+	if err != nil {
+		return 0, fmt.Errorf("error reading bounce mailbox: %s", err)
+	}
+
+	processed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, "new", entry.Name())
+
+		file, err := os.Open(path)
+		if err != nil {
+			log.WithError(err).WithField("file", path).Error("Error opening bounce")
+			continue
+		}
+		bounces, err := ParseBounce(file)
+		file.Close()
+
+		if err != nil {
+			log.WithError(err).WithField("file", path).Warn("Skipping unreadable bounce")
+		}
+		for _, bounce := range bounces {
+			applyBounce(db, bounce)
+		}
+
+		err = os.Rename(path, filepath.Join(dir, "cur", entry.Name()+":2,S"))
+		if err != nil {
+			return processed, fmt.Errorf("error moving processed bounce: %s", err)
+		}
+		processed++
+	}
+
+	return processed, nil
+}
+
+func applyBounce(db *sql.DB, bounce Bounce) {
+	var status string
+	switch {
+	case bounce.Hard():
+		status = DeliveryBounced
+	case bounce.Soft():
+		status = DeliveryDeferred
+	default:
+		return
+	}
+
+	// Attribute the bounce to the outbox message or campaign it came from.
+	var outboxID, campaignID int
+	if bounce.MessageID != "" {
+		err := db.QueryRow("SELECT COALESCE(outbox_id, 0), COALESCE(campaign_id, 0) FROM mail_deliveries WHERE message_id = $1 ORDER BY id LIMIT 1",
+			bounce.MessageID).Scan(&outboxID, &campaignID)
+		if err != nil && err != sql.ErrNoRows {
+			log.WithError(err).Error("Error looking up bounced message")
+		}
+	}
+
+	detail := strings.TrimSpace(bounce.Status + " " + bounce.Diagnostic)
+	recordDelivery(db, bounce.MessageID, []string{bounce.Recipient}, status, detail, outboxID, campaignID)
+
+	if status != DeliveryBounced {
+		return
+	}
+	err := Suppress(db, bounce.Recipient, detail, bounce.MessageID)
+	if err != nil {
+		log.WithError(err).Error("Error suppressing bounced address")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"email":      bounce.Recipient,
+		"status":     bounce.Status,
+		"message_id": bounce.MessageID,
+	}).Info("Suppressed hard-bouncing address")
+}
+
+// RunBounces processes the bounce mailbox now and then every interval. It
+// is meant to run in its own goroutine for the server's lifetime.
+func RunBounces(db *sql.DB, dir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		processed, err := ProcessBounces(db, dir)
+		if err != nil {
+			log.WithError(err).Error("Error processing bounces")
+		} else if processed > 0 {
+			log.WithField("messages", processed).Info("Bounces processed")
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,99 @@
+package mail
+
+import (
+	"errors"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+)
+
+func parseBounceFile(t *testing.T, name string) []Bounce {
+	t.Helper()
+	file, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	bounces, err := ParseBounce(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bounces
+}
+
+func TestParseHardBounce(t *testing.T) {
+	bounces := parseBounceFile(t, "bounce-hard.eml")
+	if len(bounces) != 2 {
+		t.Fatalf("got %d bounces, want 2: %+v", len(bounces), bounces)
+	}
+
+	dead := bounces[0]
+	if dead.Recipient != "dead.reader@example.com" || dead.Status != "5.1.1" || dead.Action != "failed" {
+		t.Errorf("unexpected bounce %+v", dead)
+	}
+	if !dead.Hard() || dead.Soft() {
+		t.Error("5.1.1 should be a hard bounce")
+	}
+	if !strings.Contains(dead.Diagnostic, "User unknown") {
+		t.Errorf("folded diagnostic was not read: %q", dead.Diagnostic)
+	}
+	if dead.MessageID != "<4f2a9c@librabooks.local>" {
+		t.Errorf("message id = %q", dead.MessageID)
+	}
+
+	full := bounces[1]
+	if full.Hard() || !full.Soft() {
+		t.Errorf("4.2.2 should be a soft bounce: %+v", full)
+	}
+}
+
+func TestParseDelayedBounce(t *testing.T) {
+	bounces := parseBounceFile(t, "bounce-delayed.eml")
+	if len(bounces) != 1 {
+		t.Fatalf("got %d bounces, want 1", len(bounces))
+	}
+	if b := bounces[0]; b.Recipient != "slow@example.org" || !b.Soft() || b.MessageID != "<77b1e0@librabooks.local>" {
+		t.Errorf("unexpected bounce %+v", b)
+	}
+}
+
+func TestParseBounceRejectsOrdinaryMail(t *testing.T) {
+	_, err := ParseBounce(strings.NewReader("From: a@example.com\r\nSubject: hi\r\n\r\nJust a reply.\r\n"))
+	if err != errNotDSN {
+		t.Errorf("err = %v, want errNotDSN", err)
+	}
+}
+
+func TestIsHardRejection(t *testing.T) {
+	cases := map[error]bool{
+		&textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}:    true,
+		&textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full"}:    false,
+		&textproto.Error{Code: 535, Msg: "Authentication failed"}: false,
+		errors.New("connection reset"):                            false,
+	}
+	for err, want := range cases {
+		if got := isHardRejection(err); got != want {
+			t.Errorf("isHardRejection(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
+
+func TestComposeKeepsMessageID(t *testing.T) {
+	msg, id := withMessageID(Message{To: []string{"ada@example.com"}, Subject: "Hi", Text: "Hello"})
+	if _, again := withMessageID(msg); again != id {
+		t.Errorf("message id changed from %s to %s", id, again)
+	}
+
+	body, err := testComposer().Compose(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(body), "Message-Id:") + strings.Count(string(body), "Message-ID:"); n != 1 {
+		t.Errorf("found %d Message-ID headers", n)
+	}
+	if !strings.Contains(string(body), "Message-ID: "+id+"\r\n") {
+		t.Errorf("message id %s not used:\n%s", id, body)
+	}
+}
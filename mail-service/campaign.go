@@ -0,0 +1,581 @@
+package mail
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"main.go/audit"
+	"main.go/events"
+)
+
+const (
+	CampaignDraft     = "draft"
+	CampaignRunning   = "running"
+	CampaignPaused    = "paused"
+	CampaignCancelled = "cancelled"
+	CampaignCompleted = "completed"
+
+	recipientPending = "pending"
+	recipientSent    = "sent"
+	recipientFailed  = "failed"
+	recipientSkipped = "skipped"
+
+	campaignBatchSize = 100
+)
+
+// Segments maps audience names to the user_table condition that selects
+// them. Deleted users, members who opted out of announcements and
+// suppressed (hard-bouncing) addresses are always excluded.
+var Segments = map[string]string{
+	"all":           "TRUE",
+	"activated":     "u.isactivated = TRUE",
+	"not_activated": "u.isactivated = FALSE",
+	"admins":        "u.isadmin = TRUE",
+	"borrowers":     "EXISTS (SELECT 1 FROM borrowings b WHERE b.user_id = u.id AND b.returned_at IS NULL)",
+	"overdue":       "EXISTS (SELECT 1 FROM borrowings b WHERE b.user_id = u.id AND b.returned_at IS NULL AND b.due_at < CURRENT_TIMESTAMP)",
+}
+
+type Campaign struct {
+	ID         int
+	Subject    string
+	Text       string
+	HTML       string
+	Segment    string
+	Status     string
+	Total      int
+	Sent       int
+	Failed     int
+	CreatedAt  time.Time
+	StartedAt  sql.NullTime
+	FinishedAt sql.NullTime
+}
+
+// Progress is the share of recipients that have been handled, in percent.
+func (c Campaign) Progress() int {
+	if c.Total == 0 {
+		return 0
+	}
+	return (c.Sent + c.Failed) * 100 / c.Total
+}
+
+type CampaignFailure struct {
+	Email string
+	Error string
+}
+
+// CampaignService runs bulk email campaigns in the background. Each
+// recipient's outcome is stored, so a campaign that was running when the
+// server stopped continues where it left off after ResumeRunning.
+type CampaignService struct {
+	db          *sql.DB
+	mailer      Mailer
+	Audit       audit.Auditor
+	Concurrency int
+
+	mu      sync.Mutex
+	running map[int]*campaignRunner
+}
+
+// campaignRunner is the goroutine sending a campaign. A stopped runner stays
+// in the running map until it exits, so a campaign resumed straight after a
+// pause waits for it instead of sending the same recipients twice.
+type campaignRunner struct {
+	cancel  context.CancelFunc
+	stopped bool
+	done    chan struct{}
+}
+
+func NewCampaignService(db *sql.DB, mailer Mailer, auditor audit.Auditor) *CampaignService {
+	return &CampaignService{
+		db:          db,
+		mailer:      mailer,
+		Audit:       auditor,
+		Concurrency: 10,
+		running:     map[int]*campaignRunner{},
+	}
+}
+
+func (s *CampaignService) Create(r *http.Request, subject, text, html, segment string) (int, error) {
+	subject = strings.TrimSpace(subject)
+	if subject == "" {
+		return 0, errors.New("subject is required")
+	}
+	if strings.TrimSpace(text) == "" && strings.TrimSpace(html) == "" {
+		return 0, errors.New("message body is required")
+	}
+	if _, ok := Segments[segment]; !ok {
+		return 0, fmt.Errorf("unknown audience segment %q", segment)
+	}
+
+	var id int
+	err := s.db.QueryRow("INSERT INTO mail_campaigns (subject, text_body, html_body, segment, status, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		subject, text, html, segment, CampaignDraft, time.Now().UTC()).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error creating campaign: %s", err)
+	}
+
+	s.Audit.Record(r, "mail.campaign_create", fmt.Sprint(id), nil, map[string]string{"subject": subject, "segment": segment})
+
+	return id, nil
+}
+
+func (s *CampaignService) Get(id int) (Campaign, error) {
+	var c Campaign
+	err := s.db.QueryRow("SELECT id, subject, text_body, html_body, segment, status, total, sent, failed, created_at, started_at, finished_at FROM mail_campaigns WHERE id = $1", id).
+		Scan(&c.ID, &c.Subject, &c.Text, &c.HTML, &c.Segment, &c.Status, &c.Total, &c.Sent, &c.Failed, &c.CreatedAt, &c.StartedAt, &c.FinishedAt)
+	if err == sql.ErrNoRows {
+		return c, errors.New("campaign not found")
+	}
+	if err != nil {
+		return c, fmt.Errorf("error retrieving campaign: %s", err)
+	}
+	return c, nil
+}
+
+func (s *CampaignService) List() ([]Campaign, error) {
+	rows, err := s.db.Query("SELECT id, subject, text_body, html_body, segment, status, total, sent, failed, created_at, started_at, finished_at FROM mail_campaigns ORDER BY id DESC LIMIT 100")
+	if err != nil {
+		return nil, fmt.Errorf("error listing campaigns: %s", err)
+	}
+	defer rows.Close()
+
+	var campaigns []Campaign
+	for rows.Next() {
+		var c Campaign
+		err := rows.Scan(&c.ID, &c.Subject, &c.Text, &c.HTML, &c.Segment, &c.Status, &c.Total, &c.Sent, &c.Failed, &c.CreatedAt, &c.StartedAt, &c.FinishedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning campaign: %s", err)
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, rows.Err()
+}
+
+// Failures returns the recipients that could not be mailed.
+func (s *CampaignService) Failures(id int) ([]CampaignFailure, error) {
+	rows, err := s.db.Query("SELECT email, error FROM mail_campaign_recipients WHERE campaign_id = $1 AND status = $2 ORDER BY id LIMIT 500", id, recipientFailed)
+	if err != nil {
+		return nil, fmt.Errorf("error listing campaign failures: %s", err)
+	}
+	defer rows.Close()
+
+	var failures []CampaignFailure
+	for rows.Next() {
+		var f CampaignFailure
+		if err := rows.Scan(&f.Email, &f.Error); err != nil {
+			return nil, fmt.Errorf("error scanning campaign failure: %s", err)
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+// Start snapshots the audience of a draft campaign, or resumes a paused
+// one, and begins sending in the background.
+func (s *CampaignService) Start(r *http.Request, id int) error {
+	c, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+
+	switch c.Status {
+	case CampaignDraft:
+		err = s.snapshotAudience(c)
+		if err != nil {
+			return err
+		}
+	case CampaignPaused:
+		_, err = s.db.Exec("UPDATE mail_campaigns SET status = $1 WHERE id = $2", CampaignRunning, id)
+		if err != nil {
+			return fmt.Errorf("error resuming campaign: %s", err)
+		}
+	default:
+		return fmt.Errorf("campaign is %s", c.Status)
+	}
+
+	s.Audit.Record(r, "mail.campaign_start", fmt.Sprint(id), map[string]string{"status": c.Status}, map[string]string{"status": CampaignRunning})
+
+	s.launch(id)
+	return nil
+}
+
+func (s *CampaignService) snapshotAudience(c Campaign) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting campaign: %s", err)
+	}
+	defer tx.Rollback()
+
+	// Addresses are stored lowercased; accounts whose emails differ only in
+	// case get one message, the rest are dropped by the unique constraint.
+	_, err = tx.Exec(`INSERT INTO mail_campaign_recipients (campaign_id, email, status)
+		SELECT $1, LOWER(u.email), $2 FROM user_table u
+		WHERE u.deleted_at IS NULL AND u.email_announcements = TRUE
+		AND NOT EXISTS (SELECT 1 FROM mail_suppressions s WHERE s.email = LOWER(u.email))
+		AND `+Segments[c.Segment]+`
+		ON CONFLICT DO NOTHING`, c.ID, recipientPending)
+	if err != nil {
+		return fmt.Errorf("error selecting campaign audience: %s", err)
+	}
+
+	_, err = tx.Exec(`UPDATE mail_campaigns SET status = $1, started_at = $2,
+		total = (SELECT COUNT(*) FROM mail_campaign_recipients WHERE campaign_id = $3)
+		WHERE id = $3`, CampaignRunning, time.Now().UTC(), c.ID)
+	if err != nil {
+		return fmt.Errorf("error starting campaign: %s", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *CampaignService) Pause(r *http.Request, id int) error {
+	return s.stop(r, id, CampaignPaused, "mail.campaign_pause")
+}
+
+// Cancel stops a campaign for good; recipients not reached yet are marked
+// skipped.
+func (s *CampaignService) Cancel(r *http.Request, id int) error {
+	err := s.stop(r, id, CampaignCancelled, "mail.campaign_cancel")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("UPDATE mail_campaign_recipients SET status = $1 WHERE campaign_id = $2 AND status = $3", recipientSkipped, id, recipientPending)
+	if err != nil {
+		return fmt.Errorf("error skipping remaining recipients: %s", err)
+	}
+	return nil
+}
+
+func (s *CampaignService) stop(r *http.Request, id int, status, action string) error {
+	c, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if c.Status != CampaignRunning && !(status == CampaignCancelled && (c.Status == CampaignPaused || c.Status == CampaignDraft)) {
+		return fmt.Errorf("campaign is %s", c.Status)
+	}
+
+	// Update the row first: the runner re-reads the status between
+	// recipients, so it stops even if it isn't in the running map.
+	var finishedAt sql.NullTime
+	if status == CampaignCancelled {
+		finishedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	}
+	_, err = s.db.Exec("UPDATE mail_campaigns SET status = $1, finished_at = $2 WHERE id = $3", status, finishedAt, id)
+	if err != nil {
+		return fmt.Errorf("error updating campaign: %s", err)
+	}
+
+	s.mu.Lock()
+	if runner, ok := s.running[id]; ok {
+		runner.stopped = true
+		runner.cancel()
+	}
+	s.mu.Unlock()
+
+	s.Audit.Record(r, action, fmt.Sprint(id), map[string]string{"status": c.Status}, map[string]string{"status": status})
+
+	return nil
+}
+
+// ResumeRunning restarts the runners of campaigns that were sending when the
+// server last stopped.
+func (s *CampaignService) ResumeRunning() error {
+	rows, err := s.db.Query("SELECT id FROM mail_campaigns WHERE status = $1", CampaignRunning)
+	if err != nil {
+		return fmt.Errorf("error resuming campaigns: %s", err)
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("error resuming campaigns: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		s.launch(id)
+	}
+	return nil
+}
+
+func (s *CampaignService) launch(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.running[id]
+	if previous != nil && !previous.stopped {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runner := &campaignRunner{cancel: cancel, done: make(chan struct{})}
+	s.running[id] = runner
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			if s.running[id] == runner {
+				delete(s.running, id)
+			}
+			s.mu.Unlock()
+			cancel()
+			close(runner.done)
+		}()
+
+		if previous != nil {
+			<-previous.done
+		}
+
+		err := s.run(ctx, id)
+		if err != nil {
+			log.WithError(err).WithField("campaign_id", id).Error("Campaign stopped with an error")
+		}
+	}()
+}
+
+type campaignRecipient struct {
+	ID    int
+	Email string
+}
+
+func (s *CampaignService) run(ctx context.Context, id int) error {
+	c, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("campaign_id", id).Info("Campaign sending started")
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var status string
+		err := s.db.QueryRow("SELECT status FROM mail_campaigns WHERE id = $1", id).Scan(&status)
+		if err != nil {
+			return fmt.Errorf("error checking campaign status: %s", err)
+		}
+		if status != CampaignRunning {
+			return nil
+		}
+
+		err = s.skipOptedOut(id)
+		if err != nil {
+			return err
+		}
+
+		batch, err := s.pendingRecipients(id)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		s.sendBatch(ctx, c, batch)
+	}
+
+	_, err = s.db.Exec("UPDATE mail_campaigns SET status = $1, finished_at = $2 WHERE id = $3 AND status = $4",
+		CampaignCompleted, time.Now().UTC(), id, CampaignRunning)
+	if err != nil {
+		return fmt.Errorf("error completing campaign: %s", err)
+	}
+
+	log.WithField("campaign_id", id).Info("Campaign completed")
+	return nil
+}
+
+// skipOptedOut drops recipients who unsubscribed or started bouncing after
+// the campaign's audience was selected.
+func (s *CampaignService) skipOptedOut(id int) error {
+	_, err := s.db.Exec(`UPDATE mail_campaign_recipients SET status = $1, error = 'unsubscribed'
+		WHERE campaign_id = $2 AND status = $3
+		AND email IN (SELECT LOWER(email) FROM user_table WHERE email_announcements = FALSE)`,
+		recipientSkipped, id, recipientPending)
+	if err != nil {
+		return fmt.Errorf("error skipping unsubscribed recipients: %s", err)
+	}
+
+	_, err = s.db.Exec(`UPDATE mail_campaign_recipients SET status = $1, error = 'suppressed'
+		WHERE campaign_id = $2 AND status = $3
+		AND LOWER(email) IN (SELECT email FROM mail_suppressions)`,
+		recipientSkipped, id, recipientPending)
+	if err != nil {
+		return fmt.Errorf("error skipping suppressed recipients: %s", err)
+	}
+	return nil
+}
+
+func (s *CampaignService) pendingRecipients(id int) ([]campaignRecipient, error) {
+	rows, err := s.db.Query("SELECT id, email FROM mail_campaign_recipients WHERE campaign_id = $1 AND status = $2 ORDER BY id LIMIT $3",
+		id, recipientPending, campaignBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("error loading campaign recipients: %s", err)
+	}
+	defer rows.Close()
+
+	var batch []campaignRecipient
+	for rows.Next() {
+		var rcpt campaignRecipient
+		if err := rows.Scan(&rcpt.ID, &rcpt.Email); err != nil {
+			return nil, fmt.Errorf("error scanning campaign recipient: %s", err)
+		}
+		batch = append(batch, rcpt)
+	}
+	return batch, rows.Err()
+}
+
+// sendBatch mails a batch of recipients with at most Concurrency messages
+// in flight, recording each outcome as soon as it is known.
+func (s *CampaignService) sendBatch(ctx context.Context, c Campaign, batch []campaignRecipient) {
+	jobs := make(chan campaignRecipient)
+	var wg sync.WaitGroup
+
+	workers := s.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rcpt := range jobs {
+				s.sendOne(c, rcpt)
+			}
+		}()
+	}
+
+feed:
+	for _, rcpt := range batch {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- rcpt:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (s *CampaignService) sendOne(c Campaign, rcpt campaignRecipient) {
+	unsubscribe := UnsubscribeURL(rcpt.Email, CategoryAnnouncements)
+
+	msg := Message{
+		To:      []string{rcpt.Email},
+		Subject: c.Subject,
+		Text:    c.Text,
+		HTML:    c.HTML,
+	}
+	if msg.Text != "" {
+		msg.Text = strings.TrimRight(msg.Text, "\r\n") + "\n\n--\nUnsubscribe from announcements: " + unsubscribe + "\n"
+	}
+	if msg.HTML != "" {
+		footer := `<p style="font-size: 12px; color: #888;"><a href="` + template.HTMLEscapeString(unsubscribe) + `" style="color: #888;">Unsubscribe</a> from announcements.</p>`
+		if i := strings.LastIndex(strings.ToLower(msg.HTML), "</body>"); i >= 0 {
+			msg.HTML = msg.HTML[:i] + footer + msg.HTML[i:]
+		} else {
+			msg.HTML += footer
+		}
+	}
+
+	msg, messageID := withMessageID(WithUnsubscribe(msg, CategoryAnnouncements))
+	err := s.mailer.Send(msg)
+
+	if err != nil {
+		status := DeliveryFailed
+		if isHardRejection(err) {
+			status = DeliveryBounced
+			if err := Suppress(s.db, rcpt.Email, err.Error(), messageID); err != nil {
+				log.WithError(err).Error("Error suppressing rejected address")
+			}
+		}
+		recordDelivery(s.db, messageID, msg.To, status, err.Error(), 0, c.ID)
+
+		log.WithError(err).WithFields(logrus.Fields{
+			"campaign_id": c.ID,
+			"email":       rcpt.Email,
+		}).Warn("Campaign email failed")
+
+		_, dbErr := s.db.Exec("UPDATE mail_campaign_recipients SET status = $1, error = $2 WHERE id = $3", recipientFailed, err.Error(), rcpt.ID)
+		if dbErr == nil {
+			_, dbErr = s.db.Exec("UPDATE mail_campaigns SET failed = failed + 1 WHERE id = $1", c.ID)
+		}
+		if dbErr != nil {
+			log.WithError(dbErr).Error("Error recording campaign failure")
+		}
+		return
+	}
+
+	recordDelivery(s.db, messageID, msg.To, DeliverySent, "", 0, c.ID)
+	events.PublishEmail(rcpt.Email, events.Announcement, map[string]string{"subject": c.Subject})
+	_, dbErr := s.db.Exec("UPDATE mail_campaign_recipients SET status = $1, sent_at = $2 WHERE id = $3", recipientSent, time.Now().UTC(), rcpt.ID)
+	if dbErr == nil {
+		_, dbErr = s.db.Exec("UPDATE mail_campaigns SET sent = sent + 1 WHERE id = $1", c.ID)
+	}
+	if dbErr != nil {
+		log.WithError(dbErr).Error("Error recording campaign delivery")
+	}
+}
+
+// ShowCampaigns renders the campaign list and compose form.
+func (s *CampaignService) ShowCampaigns(w http.ResponseWriter) error {
+	campaigns, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.ParseFiles("campaigns.html")
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(w, struct {
+		Campaigns []Campaign
+		Segments  map[string]string
+	}{
+		Campaigns: campaigns,
+		Segments:  Segments,
+	})
+}
+
+// ShowCampaign renders a campaign's progress and failure report.
+func (s *CampaignService) ShowCampaign(w http.ResponseWriter, id int) error {
+	c, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+
+	failures, err := s.Failures(id)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.ParseFiles("campaign.html")
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(w, struct {
+		Campaign Campaign
+		Failures []CampaignFailure
+	}{
+		Campaign: c,
+		Failures: failures,
+	})
+}
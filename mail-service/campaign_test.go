@@ -0,0 +1,252 @@
+package mail
+
+import (
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/glebarez/go-sqlite"
+	"main.go/migrations"
+)
+
+// discardAudit is an audit.Auditor that drops every entry.
+type discardAudit struct{}
+
+func (discardAudit) Record(r *http.Request, action, target string, before, after interface{}) {}
+
+// recordingAudit keeps the actions it is asked to record.
+type recordingAudit struct {
+	actions []string
+}
+
+func (a *recordingAudit) Record(r *http.Request, action, target string, before, after interface{}) {
+	a.actions = append(a.actions, action)
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "library.db")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrations.Up(db, "sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSnapshotAudienceLowercasesAndDeduplicates(t *testing.T) {
+	db := openTestDB(t)
+	for _, email := range []string{"Ada@example.com", "ada@EXAMPLE.com", "bob@example.com", "gone@example.com"} {
+		_, err := db.Exec("INSERT INTO user_table (email, username) VALUES ($1, $1)", email)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Exec("UPDATE user_table SET email_announcements = FALSE WHERE email = 'gone@example.com'")
+
+	s := NewCampaignService(db, NewMemoryMailer("library@example.com"), discardAudit{})
+	c := Campaign{Subject: "News", Text: "Hello", Segment: "all"}
+	err := db.QueryRow("INSERT INTO mail_campaigns (subject, text_body, html_body, segment, status) VALUES ($1, $2, '', $3, $4) RETURNING id",
+		c.Subject, c.Text, c.Segment, CampaignDraft).Scan(&c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.snapshotAudience(c); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := s.pendingRecipients(c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 || batch[0].Email != "ada@example.com" || batch[1].Email != "bob@example.com" {
+		t.Errorf("recipients = %+v", batch)
+	}
+	c, _ = s.Get(c.ID)
+	if c.Status != CampaignRunning || c.Total != 2 {
+		t.Errorf("campaign = %+v", c)
+	}
+}
+
+// gatedMailer holds every message until release is closed, so a test can
+// act on a campaign while it is sending.
+type gatedMailer struct {
+	*MemoryMailer
+	started chan string
+	release chan struct{}
+}
+
+func newGatedMailer() *gatedMailer {
+	return &gatedMailer{
+		MemoryMailer: NewMemoryMailer("library@example.com"),
+		started:      make(chan string, 100),
+		release:      make(chan struct{}),
+	}
+}
+
+func (m *gatedMailer) Send(msg Message) error {
+	m.started <- msg.To[0]
+	<-m.release
+	return m.MemoryMailer.Send(msg)
+}
+
+// newTestCampaign creates a draft campaign for every member in emails.
+func newTestCampaign(t *testing.T, db *sql.DB, emails ...string) int {
+	t.Helper()
+	for _, email := range emails {
+		_, err := db.Exec("INSERT INTO user_table (email, username) VALUES ($1, $1)", email)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var id int
+	err := db.QueryRow("INSERT INTO mail_campaigns (subject, text_body, html_body, segment, status) VALUES ('News', 'Hello', '', 'all', $1) RETURNING id",
+		CampaignDraft).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func waitForStatus(t *testing.T, s *CampaignService, id int, status string) Campaign {
+	t.Helper()
+	var c Campaign
+	waitFor(t, func() bool {
+		c, _ = s.Get(id)
+		return c.Status == status
+	})
+	return c
+}
+
+func recipientStatuses(t *testing.T, db *sql.DB, id int) map[string]int {
+	t.Helper()
+	rows, err := db.Query("SELECT status FROM mail_campaign_recipients WHERE campaign_id = $1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	statuses := map[string]int{}
+	for rows.Next() {
+		var status string
+		if err := rows.Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		statuses[status]++
+	}
+	return statuses
+}
+
+func TestCampaignPauseAndResume(t *testing.T) {
+	db := openTestDB(t)
+	mailer := newGatedMailer()
+	auditor := &recordingAudit{}
+	s := NewCampaignService(db, mailer, auditor)
+	s.Concurrency = 1
+	id := newTestCampaign(t, db, "ada@example.com", "bob@example.com", "cy@example.com")
+
+	if err := s.Start(nil, id); err != nil {
+		t.Fatal(err)
+	}
+	<-mailer.started
+
+	// Resuming before the paused runner has finished its message must still
+	// leave a runner sending the rest.
+	if err := s.Pause(nil, id); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := s.Get(id); c.Status != CampaignPaused {
+		t.Fatalf("status after pause = %s", c.Status)
+	}
+	if err := s.Start(nil, id); err != nil {
+		t.Fatal(err)
+	}
+	close(mailer.release)
+
+	c := waitForStatus(t, s, id, CampaignCompleted)
+	if c.Sent != 3 || c.Failed != 0 {
+		t.Errorf("sent %d, failed %d; want 3, 0", c.Sent, c.Failed)
+	}
+
+	if got := strings.Join(auditor.actions, ","); got != "mail.campaign_start,mail.campaign_pause,mail.campaign_start" {
+		t.Errorf("audited actions = %s", got)
+	}
+
+	seen := map[string]int{}
+	for _, msg := range mailer.Messages() {
+		seen[msg.To[0]]++
+	}
+	for _, email := range []string{"ada@example.com", "bob@example.com", "cy@example.com"} {
+		if seen[email] != 1 {
+			t.Errorf("%s got %d messages, want 1", email, seen[email])
+		}
+	}
+}
+
+func TestCampaignCancelSkipsPendingRecipients(t *testing.T) {
+	db := openTestDB(t)
+	mailer := newGatedMailer()
+	s := NewCampaignService(db, mailer, discardAudit{})
+	s.Concurrency = 1
+	id := newTestCampaign(t, db, "ada@example.com", "bob@example.com", "cy@example.com")
+
+	if err := s.Start(nil, id); err != nil {
+		t.Fatal(err)
+	}
+	<-mailer.started
+
+	if err := s.Cancel(nil, id); err != nil {
+		t.Fatal(err)
+	}
+	close(mailer.release)
+
+	// The message already handed to the mailer is recorded as sent.
+	waitFor(t, func() bool { return recipientStatuses(t, db, id)[recipientPending] == 0 && len(mailer.Messages()) == 1 })
+	waitFor(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.running) == 0
+	})
+
+	statuses := recipientStatuses(t, db, id)
+	if statuses[recipientSent] != 1 || statuses[recipientSkipped] != 2 {
+		t.Errorf("recipient statuses = %v, want 1 sent and 2 skipped", statuses)
+	}
+	if c, _ := s.Get(id); c.Status != CampaignCancelled || !c.FinishedAt.Valid {
+		t.Errorf("campaign = %+v", c)
+	}
+	if err := s.Start(nil, id); err == nil {
+		t.Error("a cancelled campaign started again")
+	}
+}
+
+func TestCampaignResumeRunning(t *testing.T) {
+	db := openTestDB(t)
+	id := newTestCampaign(t, db, "ada@example.com", "bob@example.com")
+
+	// A campaign left running by a previous server process.
+	previous := NewCampaignService(db, NewMemoryMailer("library@example.com"), discardAudit{})
+	c, err := previous.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := previous.snapshotAudience(c); err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := NewMemoryMailer("library@example.com")
+	s := NewCampaignService(db, mailer, discardAudit{})
+	if err := s.ResumeRunning(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = waitForStatus(t, s, id, CampaignCompleted)
+	if c.Sent != 2 || len(mailer.Messages()) != 2 {
+		t.Errorf("sent %d, mailed %d; want 2", c.Sent, len(mailer.Messages()))
+	}
+}
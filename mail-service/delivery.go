@@ -0,0 +1,223 @@
+package mail
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"main.go/audit"
+)
+
+// Delivery log states. A message is logged once per state change, so its
+// history reads e.g. queued, deferred, sent, bounced.
+const (
+	DeliveryQueued   = "queued"
+	DeliverySent     = "sent"
+	DeliveryDeferred = "deferred"
+	DeliveryBounced  = "bounced"
+	DeliveryFailed   = "failed"
+)
+
+type Delivery struct {
+	ID         int       `json:"id"`
+	MessageID  string    `json:"message_id"`
+	Recipient  string    `json:"recipient"`
+	Status     string    `json:"status"`
+	Detail     string    `json:"detail,omitempty"`
+	OutboxID   int       `json:"outbox_id,omitempty"`
+	CampaignID int       `json:"campaign_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Suppression struct {
+	Email     string    `json:"email"`
+	Reason    string    `json:"reason"`
+	MessageID string    `json:"message_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewMessageID returns a Message-ID for a message we want to trace. It is
+// set before the message is queued so bounces can be matched back to it.
+func NewMessageID() string {
+	id, err := NewComposer("").random(16)
+	if err != nil {
+		id = fmt.Sprint(time.Now().UnixNano())
+	}
+	return "<" + id + "@" + messageHost(senderAddress()) + ">"
+}
+
+// withMessageID makes sure msg carries a Message-ID and returns it.
+func withMessageID(msg Message) (Message, string) {
+	if id := headerValue(msg.Headers, "Message-ID"); id != "" {
+		return msg, id
+	}
+
+	id := NewMessageID()
+	headers := map[string]string{"Message-ID": id}
+	for name, value := range msg.Headers {
+		headers[name] = value
+	}
+	msg.Headers = headers
+	return msg, id
+}
+
+// recordDelivery logs a state change for every recipient of a message.
+// Failing to log never fails the delivery itself.
+func recordDelivery(db *sql.DB, messageID string, recipients []string, status string, detail string, outboxID int, campaignID int) {
+	for _, recipient := range recipients {
+		_, err := db.Exec("INSERT INTO mail_deliveries (message_id, recipient, status, detail, outbox_id, campaign_id, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			messageID, strings.ToLower(recipient), status, detail, nullID(outboxID), nullID(campaignID), time.Now().UTC())
+		if err != nil {
+			log.WithError(err).WithField("message_id", messageID).Error("Error recording email delivery")
+		}
+	}
+}
+
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// isHardRejection reports whether the SMTP server refused a recipient
+// outright, which is as final as a bounce and not worth retrying.
+func isHardRejection(err error) bool {
+	var reply *textproto.Error
+	if !errors.As(err, &reply) {
+		return false
+	}
+	switch reply.Code {
+	case 550, 551, 553:
+		return true
+	}
+	return false
+}
+
+// Deliveries returns the most recent log entries, optionally for one
+// recipient.
+func Deliveries(db *sql.DB, email string, limit int) ([]Delivery, error) {
+	query := `SELECT id, message_id, recipient, status, detail, COALESCE(outbox_id, 0), COALESCE(campaign_id, 0), created_at
+		FROM mail_deliveries`
+	args := []interface{}{limit}
+	if email != "" {
+		query += " WHERE recipient = $2"
+		args = append(args, strings.ToLower(email))
+	}
+	query += " ORDER BY id DESC LIMIT $1"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading email deliveries: %s", err)
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		err := rows.Scan(&d.ID, &d.MessageID, &d.Recipient, &d.Status, &d.Detail, &d.OutboxID, &d.CampaignID, &d.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning email delivery: %s", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// ReceivedEmail is one message sent to a member, with the latest state of
+// its delivery.
+type ReceivedEmail struct {
+	MessageID string    `json:"message_id"`
+	Subject   string    `json:"subject"`
+	Date      time.Time `json:"date"`
+	Status    string    `json:"status"`
+}
+
+// DeliveryLog reads the delivery log for a member's data export.
+type DeliveryLog struct {
+	db *sql.DB
+}
+
+func NewDeliveryLog(db *sql.DB) *DeliveryLog {
+	return &DeliveryLog{db: db}
+}
+
+// Received returns every message logged for email, oldest first. The
+// subject comes from the outbox or campaign the message was sent through.
+func (l *DeliveryLog) Received(email string) ([]ReceivedEmail, error) {
+	rows, err := l.db.Query(`SELECT d.message_id, COALESCE(o.subject, c.subject, ''), d.status, d.created_at
+		FROM mail_deliveries d
+		LEFT JOIN mail_outbox o ON o.id = d.outbox_id
+		LEFT JOIN mail_campaigns c ON c.id = d.campaign_id
+		WHERE d.recipient = $1
+		ORDER BY d.id`, strings.ToLower(email))
+	if err != nil {
+		return nil, fmt.Errorf("error loading received emails: %s", err)
+	}
+	defer rows.Close()
+
+	// The log has a row per state change; keep one entry per message, dated
+	// when it was first logged and showing its latest state.
+	received := []ReceivedEmail{}
+	index := map[string]int{}
+	for rows.Next() {
+		var e ReceivedEmail
+		if err := rows.Scan(&e.MessageID, &e.Subject, &e.Status, &e.Date); err != nil {
+			return nil, fmt.Errorf("error scanning received email: %s", err)
+		}
+		if i, ok := index[e.MessageID]; ok {
+			received[i].Status = e.Status
+			continue
+		}
+		index[e.MessageID] = len(received)
+		received = append(received, e)
+	}
+	return received, rows.Err()
+}
+
+// Suppress stops campaigns from mailing email. It is called for hard
+// bounces; suppressing an address twice keeps the first reason.
+func Suppress(db *sql.DB, email string, reason string, messageID string) error {
+	_, err := db.Exec("INSERT INTO mail_suppressions (email, reason, message_id, created_at) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+		strings.ToLower(email), reason, messageID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error suppressing email address: %s", err)
+	}
+	return nil
+}
+
+// Unsuppress lets campaigns mail email again, e.g. after the member fixed
+// their mailbox.
+func Unsuppress(r *http.Request, db *sql.DB, auditor audit.Auditor, email string) error {
+	email = strings.ToLower(email)
+
+	result, err := db.Exec("DELETE FROM mail_suppressions WHERE email = $1", email)
+	if err != nil {
+		return fmt.Errorf("error removing email suppression: %s", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("%s is not suppressed", email)
+	}
+
+	auditor.Record(r, "mail.unsuppress", email, map[string]bool{"suppressed": true}, map[string]bool{"suppressed": false})
+	return nil
+}
+
+func Suppressions(db *sql.DB) ([]Suppression, error) {
+	rows, err := db.Query("SELECT email, reason, message_id, created_at FROM mail_suppressions ORDER BY created_at DESC")
+	if err != nil {
+		return nil, fmt.Errorf("error loading email suppressions: %s", err)
+	}
+	defer rows.Close()
+
+	suppressions := []Suppression{}
+	for rows.Next() {
+		var s Suppression
+		if err := rows.Scan(&s.Email, &s.Reason, &s.MessageID, &s.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning email suppression: %s", err)
+		}
+		suppressions = append(suppressions, s)
+	}
+	return suppressions, rows.Err()
+}
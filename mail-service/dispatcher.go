@@ -0,0 +1,391 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// SMTPPool is an SMTP Mailer that keeps authenticated connections open and
+// sends several messages over each one, instead of dialing, negotiating TLS
+// and authenticating for every message like smtp.SendMail does.
+type SMTPPool struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+
+	Size           int           // idle connections kept open
+	MaxPerConn     int           // messages sent before a connection is recycled
+	IdleTimeout    time.Duration // idle connections older than this are closed
+	ConnectTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []*pooledConn
+	closed bool
+}
+
+type pooledConn struct {
+	client   *smtp.Client
+	sent     int
+	lastUsed time.Time
+}
+
+func NewSMTPPool(addr string, auth smtp.Auth, from string, size int, maxPerConn int) *SMTPPool {
+	if size < 1 {
+		size = 4
+	}
+	if maxPerConn < 1 {
+		maxPerConn = 100
+	}
+	return &SMTPPool{
+		Addr:           addr,
+		Auth:           auth,
+		From:           from,
+		Size:           size,
+		MaxPerConn:     maxPerConn,
+		IdleTimeout:    30 * time.Second,
+		ConnectTimeout: 10 * time.Second,
+	}
+}
+
+func (p *SMTPPool) Send(msg Message) error {
+	body, err := msg.Bytes(p.From)
+	if err != nil {
+		return err
+	}
+
+	conn, reused, err := p.get()
+	if err != nil {
+		log.WithError(err).WithField("to", msg.To).Error("Error connecting to SMTP server")
+		return err
+	}
+
+	err = p.deliver(conn, msg.To, body)
+
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		// The server rejected this message but the connection is fine.
+		log.WithError(err).WithField("to", msg.To).Error("Error sending email")
+		if conn.client.Reset() == nil {
+			p.put(conn)
+		} else {
+			conn.client.Close()
+		}
+		return err
+	}
+
+	if err != nil && reused {
+		// The server may have dropped an idle connection; retry once on a
+		// fresh one before reporting the failure.
+		conn.client.Close()
+		conn, err = p.dial()
+		if err == nil {
+			err = p.deliver(conn, msg.To, body)
+		}
+	}
+	if err != nil {
+		if conn != nil {
+			conn.client.Close()
+		}
+		log.WithError(err).WithField("to", msg.To).Error("Error sending email")
+		return err
+	}
+
+	p.put(conn)
+	return nil
+}
+
+func (p *SMTPPool) deliver(conn *pooledConn, recipients []string, body []byte) error {
+	c := conn.client
+
+	err := c.Mail(p.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range recipients {
+		err = c.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	conn.sent++
+	conn.lastUsed = time.Now()
+	return nil
+}
+
+// get returns an idle connection if a usable one exists, otherwise dials a
+// new one. reused tells the caller whether the connection came from the pool.
+func (p *SMTPPool) get() (*pooledConn, bool, error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+
+		if time.Since(conn.lastUsed) > p.IdleTimeout {
+			go conn.client.Quit()
+			continue
+		}
+
+		p.mu.Unlock()
+		return conn, true, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := p.dial()
+	return conn, false, err
+}
+
+func (p *SMTPPool) put(conn *pooledConn) {
+	if conn.sent >= p.MaxPerConn {
+		conn.client.Quit()
+		return
+	}
+
+	p.mu.Lock()
+	if !p.closed && len(p.idle) < p.Size {
+		p.idle = append(p.idle, conn)
+		conn = nil
+	}
+	p.mu.Unlock()
+
+	if conn != nil {
+		conn.client.Quit()
+	}
+}
+
+func (p *SMTPPool) dial() (*pooledConn, error) {
+	host, _, err := net.SplitHostPort(p.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	netConn, err := net.DialTimeout("tcp", p.Addr, p.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(netConn, host)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if p.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			err = c.Auth(p.Auth)
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return &pooledConn{client: c, lastUsed: time.Now()}, nil
+}
+
+// Close ends every idle connection. Connections still sending are ended
+// when their message is done instead of going back to the pool.
+func (p *SMTPPool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.client.Quit()
+	}
+}
+
+// Dispatcher wraps a Mailer and keeps outgoing mail within the provider's
+// limits on messages in flight and messages per second. It also counts what
+// goes through it.
+type Dispatcher struct {
+	mailer  Mailer
+	slots   chan struct{}
+	limiter *rate.Limiter
+
+	started  time.Time
+	sent     int64
+	failed   int64
+	queued   int64
+	inFlight int64
+	waitNano int64
+	sendNano int64
+
+	mu      sync.Mutex
+	recent  []time.Time // send times within the last minute
+	closed  bool
+	pending sync.WaitGroup
+}
+
+var ErrDispatcherClosed = errors.New("mail dispatcher is closed")
+
+// DispatcherMetrics is a snapshot of a Dispatcher's counters.
+type DispatcherMetrics struct {
+	Sent          int64   `json:"sent"`
+	Failed        int64   `json:"failed"`
+	Queued        int64   `json:"queued"` // waiting for a free slot or the rate limit
+	InFlight      int64   `json:"in_flight"`
+	Concurrency   int     `json:"concurrency"`
+	RateLimit     float64 `json:"rate_limit_per_second"`
+	LastMinute    int     `json:"sent_last_minute"`
+	PerSecond     float64 `json:"per_second"`
+	AvgSendMillis float64 `json:"avg_send_ms"`
+	AvgWaitMillis float64 `json:"avg_wait_ms"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// NewDispatcher caps concurrency at concurrency messages and the outbound
+// rate at ratePerSecond; a rate of 0 means unlimited.
+func NewDispatcher(mailer Mailer, concurrency int, ratePerSecond float64) *Dispatcher {
+	if concurrency < 1 {
+		concurrency = 4
+	}
+
+	limit := rate.Inf
+	burst := concurrency
+	if ratePerSecond > 0 {
+		limit = rate.Limit(ratePerSecond)
+		if int(ratePerSecond) < burst {
+			burst = int(ratePerSecond)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+	}
+
+	return &Dispatcher{
+		mailer:  mailer,
+		slots:   make(chan struct{}, concurrency),
+		limiter: rate.NewLimiter(limit, burst),
+		started: time.Now(),
+	}
+}
+
+func (d *Dispatcher) Send(msg Message) error {
+	if len(msg.To) == 0 {
+		return errors.New("message has no recipients")
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrDispatcherClosed
+	}
+	d.pending.Add(1)
+	d.mu.Unlock()
+	defer d.pending.Done()
+
+	start := time.Now()
+	atomic.AddInt64(&d.queued, 1)
+	d.slots <- struct{}{}
+	defer func() { <-d.slots }()
+
+	err := d.limiter.Wait(context.Background())
+	atomic.AddInt64(&d.queued, -1)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&d.waitNano, int64(time.Since(start)))
+
+	atomic.AddInt64(&d.inFlight, 1)
+	sendStart := time.Now()
+	err = d.mailer.Send(msg)
+	atomic.AddInt64(&d.sendNano, int64(time.Since(sendStart)))
+	atomic.AddInt64(&d.inFlight, -1)
+
+	if err != nil {
+		atomic.AddInt64(&d.failed, 1)
+		return err
+	}
+
+	atomic.AddInt64(&d.sent, 1)
+	d.mu.Lock()
+	d.recent = append(pruneBefore(d.recent, time.Now().Add(-time.Minute)), time.Now())
+	d.mu.Unlock()
+
+	return nil
+}
+
+// Close stops accepting mail, waits for every message already handed to
+// Send, queued ones included, and then closes the mailer if it keeps
+// connections open.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	d.pending.Wait()
+
+	if closer, ok := d.mailer.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
+func (d *Dispatcher) Metrics() DispatcherMetrics {
+	sent := atomic.LoadInt64(&d.sent)
+	failed := atomic.LoadInt64(&d.failed)
+
+	d.mu.Lock()
+	d.recent = pruneBefore(d.recent, time.Now().Add(-time.Minute))
+	lastMinute := len(d.recent)
+	d.mu.Unlock()
+
+	metrics := DispatcherMetrics{
+		Sent:          sent,
+		Failed:        failed,
+		Queued:        atomic.LoadInt64(&d.queued),
+		InFlight:      atomic.LoadInt64(&d.inFlight),
+		Concurrency:   cap(d.slots),
+		LastMinute:    lastMinute,
+		PerSecond:     float64(lastMinute) / 60,
+		UptimeSeconds: time.Since(d.started).Seconds(),
+	}
+	if d.limiter.Limit() != rate.Inf {
+		metrics.RateLimit = float64(d.limiter.Limit())
+	}
+	if attempts := sent + failed; attempts > 0 {
+		metrics.AvgSendMillis = float64(atomic.LoadInt64(&d.sendNano)) / float64(attempts) / float64(time.Millisecond)
+		metrics.AvgWaitMillis = float64(atomic.LoadInt64(&d.waitNano)) / float64(attempts) / float64(time.Millisecond)
+	}
+	return metrics
+}
+
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
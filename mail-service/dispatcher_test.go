@@ -0,0 +1,219 @@
+package mail
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an in-process SMTP server that accepts everything net/smtp
+// sends and records the messages.
+type fakeSMTP struct {
+	listener net.Listener
+
+	// dropAfter closes a connection, as servers do with idle sessions,
+	// once it has carried that many messages. Zero keeps it open.
+	dropAfter int
+	// hold, when set, delays the reply to each message until it is closed.
+	hold chan struct{}
+
+	mu       sync.Mutex
+	conns    int
+	quits    int
+	messages []string
+	arrived  chan struct{}
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{listener: l, arrived: make(chan struct{}, 100)}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.session(conn)
+	}
+}
+
+func (s *fakeSMTP) session(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake ESMTP")
+
+	delivered := 0
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			text.PrintfLine("250-fake")
+			text.PrintfLine("250 8BITMIME")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			body, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(body))
+			s.mu.Unlock()
+			s.arrived <- struct{}{}
+			if s.hold != nil {
+				<-s.hold
+			}
+			text.PrintfLine("250 queued")
+
+			delivered++
+			if s.dropAfter > 0 && delivered == s.dropAfter {
+				return
+			}
+		case "QUIT":
+			s.mu.Lock()
+			s.quits++
+			s.mu.Unlock()
+			text.PrintfLine("221 bye")
+			return
+		default:
+			// MAIL, RCPT, RSET and NOOP
+			text.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (s *fakeSMTP) counts() (conns int, quits int, messages int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, s.quits, len(s.messages)
+}
+
+func testMessage(subject string) Message {
+	return Message{To: []string{"ada@example.com"}, Subject: subject, Text: "Hello"}
+}
+
+func TestSMTPPoolReusesConnections(t *testing.T) {
+	server := newFakeSMTP(t)
+	pool := NewSMTPPool(server.listener.Addr().String(), nil, "library@example.com", 2, 3)
+
+	for i := 0; i < 5; i++ {
+		if err := pool.Send(testMessage("Reminder")); err != nil {
+			t.Fatalf("send %d: %s", i+1, err)
+		}
+	}
+	pool.Close()
+
+	// Three messages fit on the first connection before it is recycled.
+	waitFor(t, func() bool {
+		conns, quits, messages := server.counts()
+		return conns == 2 && quits == 2 && messages == 5
+	})
+}
+
+func TestSMTPPoolReconnectsAfterServerClose(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.dropAfter = 2
+	pool := NewSMTPPool(server.listener.Addr().String(), nil, "library@example.com", 2, 100)
+
+	for i := 0; i < 5; i++ {
+		if err := pool.Send(testMessage("Reminder")); err != nil {
+			t.Fatalf("send %d after the server hung up: %s", i+1, err)
+		}
+	}
+	pool.Close()
+
+	conns, _, messages := server.counts()
+	if messages != 5 || conns != 3 {
+		t.Errorf("server saw %d messages on %d connections, want 5 on 3", messages, conns)
+	}
+}
+
+func TestDispatcherCloseDrainsQueuedMail(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.hold = make(chan struct{})
+	pool := NewSMTPPool(server.listener.Addr().String(), nil, "library@example.com", 4, 100)
+	d := NewDispatcher(pool, 2, 0)
+
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() { errs <- d.Send(testMessage("Newsletter")) }()
+	}
+
+	// Two messages reach the server and two wait for a slot.
+	<-server.arrived
+	<-server.arrived
+	waitFor(t, func() bool {
+		m := d.Metrics()
+		return m.InFlight == 2 && m.Queued == 2
+	})
+
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	waitFor(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.closed
+	})
+	if err := d.Send(testMessage("Too late")); err != ErrDispatcherClosed {
+		t.Errorf("Send after Close = %v, want ErrDispatcherClosed", err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("Close returned with mail still queued")
+	default:
+	}
+
+	close(server.hold)
+	<-closed
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("queued send failed: %s", err)
+		}
+	}
+
+	// Every connection is ended once the queue is drained.
+	waitFor(t, func() bool {
+		conns, quits, messages := server.counts()
+		return messages == 4 && quits == conns
+	})
+	pool.mu.Lock()
+	idle := len(pool.idle)
+	pool.mu.Unlock()
+	if idle != 0 {
+		t.Errorf("%d connections left in the closed pool", idle)
+	}
+}
+
+// waitFor polls until done reports true, failing the test after a few
+// seconds.
+func waitFor(t *testing.T, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,284 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDKIMHeaders are the headers signed when none are configured. The
+// List-Unsubscribe pair must be signed for one-click unsubscribe to be
+// honoured by the big mailbox providers.
+var DefaultDKIMHeaders = []string{
+	"From",
+	"To",
+	"Subject",
+	"Date",
+	"Message-ID",
+	"MIME-Version",
+	"Content-Type",
+	"List-Unsubscribe",
+	"List-Unsubscribe-Post",
+}
+
+// DKIMSigner adds a DKIM-Signature (RFC 6376) to composed messages, using
+// relaxed canonicalization for both header and body. Key is an RSA or
+// Ed25519 (RFC 8463) private key.
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+	Headers  []string
+}
+
+func NewDKIMSigner(domain, selector string, key crypto.Signer, headers []string) (*DKIMSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("DKIM needs both a domain and a selector")
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+	if len(headers) == 0 {
+		headers = DefaultDKIMHeaders
+	}
+	return &DKIMSigner{Domain: domain, Selector: selector, Key: key, Headers: headers}, nil
+}
+
+var activeDKIM *DKIMSigner
+
+// ConfigureDKIM loads the signing key named in config and signs every
+// message composed from then on. Signing stays off when no key is set.
+func ConfigureDKIM(config Config) error {
+	var signer *DKIMSigner
+	if config.DKIMKeyFile != "" {
+		key, err := LoadDKIMKey(config.DKIMKeyFile)
+		if err != nil {
+			return err
+		}
+		domain := config.DKIMDomain
+		if domain == "" {
+			domain = messageHost(config.From)
+		}
+		signer, err = NewDKIMSigner(domain, config.DKIMSelector, key, config.DKIMHeaders)
+		if err != nil {
+			return err
+		}
+	}
+
+	settingsMu.Lock()
+	activeDKIM = signer
+	settingsMu.Unlock()
+	return nil
+}
+
+func dkimSigner() *DKIMSigner {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return activeDKIM
+}
+
+// LoadDKIMKey reads a PEM private key: PKCS#8 (RSA or Ed25519) or PKCS#1
+// RSA.
+func LoadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading DKIM key: %s", err)
+	}
+	return parseDKIMKey(data)
+}
+
+func parseDKIMKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("DKIM key is not PEM encoded")
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing DKIM key: %s", err)
+		}
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DKIM key: %s", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+	return signer, nil
+}
+
+func (s *DKIMSigner) algorithm() string {
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// DNSRecord is the TXT record to publish at SELECTOR._domainkey.DOMAIN.
+func (s *DKIMSigner) DNSRecord() (string, error) {
+	keyType := "rsa"
+	var public []byte
+	switch key := s.Key.(type) {
+	case ed25519.PrivateKey:
+		keyType = "ed25519"
+		public = key.Public().(ed25519.PublicKey)
+	default:
+		der, err := x509.MarshalPKIXPublicKey(s.Key.Public())
+		if err != nil {
+			return "", err
+		}
+		public = der
+	}
+	return "v=DKIM1; k=" + keyType + "; p=" + base64.StdEncoding.EncodeToString(public), nil
+}
+
+// Sign returns message with a DKIM-Signature header prepended.
+func (s *DKIMSigner) Sign(message []byte, now time.Time) ([]byte, error) {
+	header, body := splitMessage(message)
+	fields := parseHeaderFields(header)
+
+	bodyHash := sha256.Sum256(canonicalBody(body))
+
+	// Sign each listed header that is present, taking repeated headers
+	// from the bottom up as verifiers will.
+	var names []string
+	var signed bytes.Buffer
+	used := map[int]bool{}
+	for _, name := range s.Headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fields[i].name, name) {
+				continue
+			}
+			used[i] = true
+			names = append(names, strings.ToLower(name))
+			signed.WriteString(canonicalHeader(fields[i].raw))
+			break
+		}
+	}
+
+	value := "v=1; a=" + s.algorithm() + "; c=relaxed/relaxed; d=" + s.Domain + "; s=" + s.Selector +
+		";\r\n\tt=" + strconv.FormatInt(now.Unix(), 10) + "; h=" + strings.Join(names, ":") +
+		";\r\n\tbh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) +
+		";\r\n\tb="
+	signature := "DKIM-Signature: " + value
+
+	// The signature header is hashed last, with an empty b= and without
+	// its trailing CRLF.
+	signed.WriteString(strings.TrimSuffix(canonicalHeader(signature), "\r\n"))
+	hash := sha256.Sum256(signed.Bytes())
+
+	var sig []byte
+	var err error
+	switch key := s.Key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, hash[:])
+	default:
+		sig, err = s.Key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing email: %s", err)
+	}
+
+	var out bytes.Buffer
+	out.WriteString(signature)
+	out.WriteString(base64.StdEncoding.EncodeToString(sig))
+	out.WriteString("\r\n")
+	out.Write(message)
+	return out.Bytes(), nil
+}
+
+type headerField struct {
+	name string
+	raw  string // the whole field, folding included, ending in CRLF
+}
+
+// splitMessage separates the header block, including its final CRLF, from
+// the body.
+func splitMessage(message []byte) ([]byte, []byte) {
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+		return message[:i+2], message[i+4:]
+	}
+	return message, nil
+}
+
+func parseHeaderFields(header []byte) []headerField {
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name := line
+		if colon := strings.Index(line, ":"); colon >= 0 {
+			name = line[:colon]
+		}
+		fields = append(fields, headerField{name: strings.TrimSpace(name), raw: line})
+	}
+	return fields
+}
+
+// canonicalHeader applies the "relaxed" header canonicalization: lowercase
+// name, unfolded value with whitespace runs collapsed and trimmed.
+func canonicalHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(collapseWhitespace(value)) + "\r\n"
+}
+
+// canonicalBody applies the "relaxed" body canonicalization: whitespace
+// runs collapsed, trailing whitespace and trailing empty lines removed.
+func canonicalBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseWhitespace(line), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func collapseWhitespace(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
@@ -0,0 +1,239 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The example from RFC 6376 section 3.4.5.
+func TestDKIMRelaxedCanonicalization(t *testing.T) {
+	message := "A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"
+	header, body := splitMessage([]byte(message))
+
+	var got string
+	for _, field := range parseHeaderFields(header) {
+		got += canonicalHeader(field.raw)
+	}
+	if got != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("header = %q", got)
+	}
+	if got := string(canonicalBody(body)); got != " C\r\nD E\r\n" {
+		t.Errorf("body = %q", got)
+	}
+	if got := canonicalBody([]byte("\r\n\r\n")); len(got) != 0 {
+		t.Errorf("empty body = %q", got)
+	}
+}
+
+func testSigners(t *testing.T) map[string]*DKIMSigner {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signers := map[string]*DKIMSigner{}
+	for name, key := range map[string]crypto.Signer{"rsa": rsaKey, "ed25519": edKey} {
+		signer, err := NewDKIMSigner("example.com", "mail2024", key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[name] = signer
+	}
+	return signers
+}
+
+func signedTestMessage(t *testing.T, signer *DKIMSigner) []byte {
+	t.Helper()
+	composer := testComposer()
+	composer.DKIM = signer
+
+	msg := WithUnsubscribe(Message{
+		To:      []string{"ada@example.com"},
+		Subject: "Your loans  are due soon",
+		Text:    "Hello Ada,\n\nDune is due on Friday.   \n\n\n",
+		HTML:    "<p>Hello Ada,</p><p>Dune is due on Friday.</p>",
+	}, CategoryReminders)
+
+	body, err := composer.Compose(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestDKIMSignatureVerifies(t *testing.T) {
+	Configure(Config{BaseURL: "https://library.example.com", UnsubscribeSecret: "test-secret"})
+
+	for name, signer := range testSigners(t) {
+		t.Run(name, func(t *testing.T) {
+			message := signedTestMessage(t, signer)
+			if !bytes.HasPrefix(message, []byte("DKIM-Signature: v=1; a="+name+"-sha256; c=relaxed/relaxed; d=example.com; s=mail2024;")) {
+				t.Fatalf("unexpected signature header:\n%s", message[:200])
+			}
+			assertCRLF(t, message)
+
+			record, err := signer.DNSRecord()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = verifyDKIM(message, record)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tags := dkimTags(string(message[:bytes.Index(message, []byte("\r\n\r\n"))]))
+			for _, header := range []string{"from", "to", "subject", "date", "message-id", "list-unsubscribe", "list-unsubscribe-post"} {
+				if !strings.Contains(":"+tags["h"]+":", ":"+header+":") {
+					t.Errorf("%s is not signed: h=%s", header, tags["h"])
+				}
+			}
+		})
+	}
+}
+
+func TestDKIMDetectsTampering(t *testing.T) {
+	signer := testSigners(t)["ed25519"]
+	record, _ := signer.DNSRecord()
+	message := string(signedTestMessage(t, signer))
+
+	tampered := map[string]string{
+		"subject": strings.Replace(message, "Subject: Your loans", "Subject: Our loans", 1),
+		"body":    strings.Replace(message, "Friday", "Monday", 1),
+		"header":  strings.Replace(message, "To: ", "To: eve@example.com, ", 1),
+	}
+	for name, changed := range tampered {
+		if changed == message {
+			t.Fatalf("%s: fixture did not change", name)
+		}
+		if verifyDKIM([]byte(changed), record) == nil {
+			t.Errorf("%s: tampered message still verifies", name)
+		}
+	}
+
+	// Refolding and trailing blank lines are what relaxed canonicalization
+	// is meant to tolerate.
+	refolded := strings.Replace(message, "Subject: Your loans  are", "Subject: Your loans\r\n are", 1) + "\r\n\r\n"
+	if err := verifyDKIM([]byte(refolded), record); err != nil {
+		t.Errorf("refolded message failed: %s", err)
+	}
+}
+
+func TestParseDKIMKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(edKey)
+
+	keys := map[string][]byte{
+		"pkcs1":   pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+		"ed25519": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+	}
+	for name, data := range keys {
+		key, err := parseDKIMKey(data)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if _, err := NewDKIMSigner("example.com", "s1", key, nil); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if _, err := parseDKIMKey([]byte("not a key")); err == nil {
+		t.Error("expected an error for a non-PEM key")
+	}
+}
+
+func dkimTags(header string) map[string]string {
+	tags := map[string]string{}
+	for _, field := range parseHeaderFields([]byte(header + "\r\n")) {
+		if !strings.EqualFold(field.name, "DKIM-Signature") {
+			continue
+		}
+		_, value, _ := strings.Cut(field.raw, ":")
+		for _, tag := range strings.Split(value, ";") {
+			name, value, _ := strings.Cut(tag, "=")
+			tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+		}
+		break
+	}
+	return tags
+}
+
+var signatureValue = regexp.MustCompile(`([;:]\s*b=)[^;]*`)
+
+// verifyDKIM checks a relaxed/relaxed signature the way a receiving server
+// would, with the public key taken from the DNS record.
+func verifyDKIM(message []byte, record string) error {
+	header, body := splitMessage(message)
+	fields := parseHeaderFields(header)
+	if len(fields) == 0 || !strings.EqualFold(fields[0].name, "DKIM-Signature") {
+		return errors.New("no DKIM-Signature header")
+	}
+	tags := dkimTags(string(header))
+
+	bodyHash := sha256.Sum256(canonicalBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		return errors.New("body hash mismatch")
+	}
+
+	var signed bytes.Buffer
+	used := map[int]bool{0: true}
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				signed.WriteString(canonicalHeader(fields[i].raw))
+				break
+			}
+		}
+	}
+	signed.WriteString(strings.TrimSuffix(canonicalHeader(signatureValue.ReplaceAllString(fields[0].raw, "$1")), "\r\n"))
+	hash := sha256.Sum256(signed.Bytes())
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	recordTags := map[string]string{}
+	for _, tag := range strings.Split(record, ";") {
+		name, value, _ := strings.Cut(tag, "=")
+		recordTags[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	public, err := base64.StdEncoding.DecodeString(recordTags["p"])
+	if err != nil {
+		return err
+	}
+
+	switch recordTags["k"] {
+	case "ed25519":
+		if !ed25519.Verify(ed25519.PublicKey(public), hash[:], sig) {
+			return errors.New("ed25519 signature mismatch")
+		}
+		return nil
+	case "rsa":
+		key, err := x509.ParsePKIXPublicKey(public)
+		if err != nil {
+			return err
+		}
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], sig)
+	}
+	return fmt.Errorf("unknown key type %q", recordTags["k"])
+}
@@ -1,298 +1,55 @@
 package mail
 
 import (
-	"bytes"
-	"database/sql"
 	"fmt"
-	"net/smtp"
+	"net/http"
 	"os"
-	"sync"
-	"text/template"
-	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
+	"main.go/events"
 )
 
 var log = logrus.New()
 
-func goDotEnvVariable(key string) string {
-
-	// load .env file
-	err := godotenv.Load(".env")
-
+// SendEmailAll starts a campaign that sends the welcome email to every
+// member. Progress and failures are reported on the campaign page.
+func SendEmailAll(r *http.Request, campaigns *CampaignService) (int, error) {
+	msg, err := RenderTemplate("welcome", "", TemplateData{Name: "reader"})
 	if err != nil {
-		log.Fatal("Error loading .env file", err)
-
+		return 0, err
 	}
 
-	return os.Getenv(key)
-}
-
-func SendEmailAll(db *sql.DB, numGoroutines int) error {
-	startTime := time.Now()
-
-	//меняй лимит
-	rows, err := db.Query("SELECT email FROM user_table LIMIT 1000")
+	id, err := campaigns.Create(r, msg.Subject, msg.Text, msg.HTML, "all")
 	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	var emails []string
-	for rows.Next() {
-		var email string
-		if err := rows.Scan(&email); err != nil {
-			return err
-		}
-		emails = append(emails, email)
+		return 0, err
 	}
-	if err := rows.Err(); err != nil {
-		return err
-	}
-
-	var wg sync.WaitGroup
-	segmentSize := len(emails) / numGoroutines
-
-	for i := 0; i < numGoroutines; i++ {
-		start := i * segmentSize
-		end := start + segmentSize
-		if i == numGoroutines-1 {
-			end = len(emails)
-		}
-
-		wg.Add(1)
-		go func(start, end int) {
-			defer wg.Done()
-			for j := start; j < end; j++ {
-				SendConfirmationEmail(emails[j])
-			}
-		}(start, end)
-	}
-
-	wg.Wait()
-
-	duration := time.Since(startTime)
-	fmt.Printf("Emails sent in %v\n", duration)
 
-	return nil
+	return id, campaigns.Start(r, id)
 }
 
-func SendConfirmationEmail(email string) error {
-	from := goDotEnvVariable("FROM_MAIL")
-	password := goDotEnvVariable("PASSWORD_MAIL")
-
-	smtpHost := goDotEnvVariable("SMTP_HOST")
-	smtpPort := goDotEnvVariable("SMTP_PORT")
-
-	// Authentication.
-	auth := smtp.PlainAuth("", from, password, smtpHost)
-
-	// Receiver email address.
-	to := []string{email}
-
-	t, _ := template.ParseFiles("mail-template.html")
-
-	var body bytes.Buffer
-
-	mimeHeaders := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
-	body.Write([]byte(fmt.Sprintf("Subject: LibraBook \n%s\n\n", mimeHeaders)))
-
-	t.Execute(&body, struct {
-		Message string
-	}{
-		Message: "Hello",
-	})
-
-	// Sending email.
-	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, to, body.Bytes())
-	if err != nil {
-		return err
-	}
-	fmt.Println("Email Sent to:", email)
-	return nil
+func SendConfirmationEmail(mailer Mailer, email string, name string, link string) error {
+	return SendTemplate(mailer, "activation", email, TemplateData{Name: name, Link: link})
 }
 
-// func SendConfirmationEmail(email string, link string) error {
-// 	// Sender data.
-// 	from := goDotEnvVariable("FROM_MAIL")
-// 	password := goDotEnvVariable("PASSWORD_MAIL")
-
-// 	smtpHost := goDotEnvVariable("SMTP_HOST")
-// 	smtpPort := goDotEnvVariable("SMTP_PORT")
-
-// 	//message := []byte("This is a test email message.")
-
-// 	// Authentication.
-// 	auth := smtp.PlainAuth("", from, password, smtpHost)
-
-// 	// Receiver email address.
-// 	to := []string{email}
-// 	fmt.Println(to)
-
-// 	t, _ := template.ParseFiles("mail-template.html")
-
-// 	var body bytes.Buffer
-
-// 	mimeHeaders := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
-// 	body.Write([]byte(fmt.Sprintf("Subject: LibraBook \n%s\n\n", mimeHeaders)))
-
-// 	t.Execute(&body, struct {
-// 		Link string
-// 	}{
-// 		Link: link,
-// 	})
-
-// 	// Sending email.
-// 	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, to, body.Bytes())
-// 	if err != nil {
-// 		fmt.Println(err)
-// 		return err
-// 	}
-// 	fmt.Println("Email Sent!")
-// 	return nil
-// }
-
-// func SendEmailAll(db *sql.DB, numGoroutines int) error {
-// 	// Measure start time
-// 	startTime := time.Now()
-
-// 	// Query emails from the database
-// 	rows, err := db.Query("SELECT email, link FROM users_table LIMIT 5")
-// 	if err != nil {
-// 		return err
-// 	}
-// 	defer rows.Close()
-
-// 	// Store emails and links
-// 	var emails []string
-// 	var links []string
-// 	for rows.Next() {
-// 		var email, link string
-// 		if err := rows.Scan(&email, &link); err != nil {
-// 			return err
-// 		}
-// 		emails = append(emails, email)
-// 		links = append(links, link)
-// 	}
-// 	if err := rows.Err(); err != nil {
-// 		return err
-// 	}
-
-// 	var wg sync.WaitGroup
-// 	segmentSize := len(emails) / numGoroutines
-
-// 	for i := 0; i < numGoroutines; i++ {
-// 		start := i * segmentSize
-// 		end := start + segmentSize
-// 		if i == numGoroutines-1 {
-// 			end = len(emails)
-// 		}
-
-// 		wg.Add(1)
-// 		go func(start, end int) {
-// 			defer wg.Done()
-// 			for j := start; j < end; j++ {
-// 				SendConfirmationEmail(emails[j], links[j])
-// 			}
-// 		}(start, end)
-// 	}
-
-// 	wg.Wait()
-
-// 	// Measure end time and calculate duration
-// 	duration := time.Since(startTime)
-// 	fmt.Printf("Emails sent in %v\n", duration)
-
-// 	return nil
-// }
-
-func SendEmail(email, text string) error {
-	from := goDotEnvVariable("FROM_MAIL")
-	password := goDotEnvVariable("PASSWORD_MAIL")
-
-	smtpHost := goDotEnvVariable("SMTP_HOST")
-	smtpPort := goDotEnvVariable("SMTP_PORT")
-
-	auth := smtp.PlainAuth("", from, password, smtpHost)
-
-	to := []string{email}
-
-	body := "To: " + email + "\r\n" +
-		"Subject: LibraBook\r\n" +
-		"\r\n" +
-		text
+func SendOTPEmail(mailer Mailer, email string, otp string) error {
+	return SendTemplate(mailer, "otp", email, TemplateData{Code: otp})
+}
 
-	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, to, []byte(body))
+func SendEmail(mailer Mailer, email, text string) error {
+	err := mailer.Send(Message{
+		To:      []string{email},
+		Subject: "LibraBook",
+		Text:    text,
+	})
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
+	events.PublishEmail(email, events.AdminMessage, map[string]string{"text": text})
 	fmt.Println("Email Sent!")
 	return nil
 }
 
-// func SendEmailAll(db *sql.DB, numGoroutines int) error {
-// 	startTime := time.Now()
-
-// 	// Fetch all user emails from the database
-// 	rows, err := db.Query("SELECT id, email FROM user_table LIMIT 5")
-// 	if err != nil {
-// 		return err
-// 	}
-// 	defer rows.Close()
-
-// 	// Channel to communicate errors from goroutines
-// 	errCh := make(chan error)
-
-// 	// Channel to signal completion of all goroutines
-// 	doneCh := make(chan struct{})
-
-// 	// Start goroutines
-// 	for i := 0; i < numGoroutines; i++ {
-// 		go func() {
-// 			for rows.Next() {
-// 				var id int
-// 				var email string
-// 				if err := rows.Scan(&id, &email); err != nil {
-// 					errCh <- err
-// 					return
-// 				}
-// 				// Send email in a separate goroutine
-// 				go func(email string) {
-// 					if err := SendEmail(email, "Your email content here"); err != nil {
-// 						errCh <- err
-// 						return
-// 					}
-// 					fmt.Println("Email sent to:", email)
-// 				}(email)
-// 			}
-// 		}()
-// 	}
-
-// 	// Wait for all goroutines to finish
-// 	go func() {
-// 		for i := 0; i < numGoroutines; i++ {
-// 			<-doneCh
-// 		}
-// 		close(errCh)
-// 	}()
-
-// 	// Wait for errors or completion
-// 	for err := range errCh {
-// 		if err != nil {
-// 			// Handle or log the error
-// 			log.Error("Error sending email:", err)
-// 			return err
-// 		}
-// 	}
-
-// 	duration := time.Since(startTime)
-// 	fmt.Println("All emails sent. Time taken:", duration)
-
-// 	return nil
-// }
-
 func init() {
 	// Create or open the log file
 	file, err := os.OpenFile("logfile.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
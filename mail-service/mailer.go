@@ -0,0 +1,205 @@
+package mail
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Message is an outgoing email. HTML is optional; when set it is sent
+// alongside Text as multipart/alternative.
+type Message struct {
+	To          []string
+	Subject     string
+	Text        string
+	HTML        string
+	Headers     map[string]string // extra headers, e.g. List-Unsubscribe
+	Attachments []Attachment
+}
+
+// Mailer delivers messages. Services receive one at startup instead of
+// talking to SMTP directly, so tests and development can swap it out.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Config selects and configures a Mailer backend. The env tags name the
+// variables the config package reads it from.
+type Config struct {
+	Backend  string `env:"MAIL_BACKEND"` // "smtp", "file" or "memory"
+	From     string `env:"FROM_MAIL"`
+	Host     string `env:"SMTP_HOST"`
+	Port     string `env:"SMTP_PORT"`
+	Username string `env:"SMTP_USERNAME"`
+	Password string `env:"PASSWORD_MAIL"`
+	Dir      string `env:"MAIL_DIR"` // maildir root for the file backend
+
+	BounceDir string `env:"BOUNCE_MAILDIR"` // maildir that bounces are delivered to, empty to disable
+
+	DKIMDomain   string   `env:"DKIM_DOMAIN"` // signing domain, defaults to the From domain
+	DKIMSelector string   `env:"DKIM_SELECTOR"`
+	DKIMKeyFile  string   `env:"DKIM_PRIVATE_KEY"` // PEM private key, empty to send unsigned
+	DKIMHeaders  []string `env:"DKIM_HEADERS"`     // headers to sign, defaults to DefaultDKIMHeaders
+
+	BaseURL           string `env:"API_URL"` // site URL used in links
+	UnsubscribeSecret string `env:"UNSUBSCRIBE_SECRET"`
+
+	Workers     int `env:"MAIL_WORKERS"`      // outbox delivery workers
+	MaxAttempts int `env:"MAIL_MAX_ATTEMPTS"` // deliveries tried before a message is marked failed
+
+	PoolSize      int     `env:"SMTP_POOL_SIZE"`               // idle SMTP connections kept open
+	PerConnection int     `env:"SMTP_MESSAGES_PER_CONNECTION"` // messages sent over one SMTP connection
+	Concurrency   int     `env:"MAIL_CONCURRENCY"`             // messages in flight at once
+	RatePerSecond float64 `env:"MAIL_RATE_PER_SECOND"`         // outbound rate cap, 0 for unlimited
+}
+
+// WithDefaults fills in the settings that fall back to others.
+func (config Config) WithDefaults() Config {
+	if config.Backend == "" {
+		config.Backend = "smtp"
+	}
+	if config.Username == "" {
+		config.Username = config.From
+	}
+	if config.Dir == "" {
+		config.Dir = "maildir"
+	}
+	if config.Concurrency < 1 {
+		config.Concurrency = config.PoolSize
+	}
+	return config
+}
+
+// Validate reports settings the configured backend cannot work without.
+func (config Config) Validate() error {
+	switch config.Backend {
+	case "smtp":
+		if config.Host == "" || config.Port == "" {
+			return errors.New("SMTP_HOST and SMTP_PORT are required for the smtp mail backend")
+		}
+	case "file", "memory":
+	default:
+		return fmt.Errorf("MAIL_BACKEND must be smtp, file or memory, got %q", config.Backend)
+	}
+	return nil
+}
+
+// NewMailer builds the backend named by config.Backend.
+func NewMailer(config Config) (Mailer, error) {
+	switch config.Backend {
+	case "smtp":
+		if config.Host == "" || config.Port == "" {
+			return nil, errors.New("SMTP_HOST and SMTP_PORT are required for the smtp mail backend")
+		}
+		auth := smtp.PlainAuth("", config.Username, config.Password, config.Host)
+		return NewSMTPPool(config.Host+":"+config.Port, auth, config.From, config.PoolSize, config.PerConnection), nil
+	case "file":
+		return NewFileMailer(config.Dir, config.From)
+	case "memory":
+		return NewMemoryMailer(config.From), nil
+	default:
+		return nil, fmt.Errorf("unknown mail backend %q", config.Backend)
+	}
+}
+
+// SMTPMailer sends each message through its own SMTP connection. NewMailer
+// uses SMTPPool instead; this stays for servers that dislike reused sessions.
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	body, err := msg.Bytes(m.From)
+	if err != nil {
+		return err
+	}
+
+	err = smtp.SendMail(m.Addr, m.Auth, m.From, msg.To, body)
+	if err != nil {
+		log.WithError(err).WithField("to", msg.To).Error("Error sending email")
+		return err
+	}
+	return nil
+}
+
+// FileMailer writes every message into the new/ folder of a maildir, which
+// any mail client can open. Meant for development.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func NewFileMailer(dir string, from string) (*FileMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			return nil, fmt.Errorf("error creating maildir: %s", err)
+		}
+	}
+	return &FileMailer{Dir: dir, From: from}, nil
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+
+	// Write to tmp/ then rename, as the maildir format requires, so readers
+	// never see a half-written message.
+	name := fmt.Sprintf("%d.%s.librabooks", time.Now().UnixNano(), hex.EncodeToString(suffix))
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+
+	body, err := msg.Bytes(m.From)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(tmpPath, body, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing message: %s", err)
+	}
+
+	return os.Rename(tmpPath, filepath.Join(m.Dir, "new", name))
+}
+
+// MemoryMailer keeps sent messages in memory for tests.
+type MemoryMailer struct {
+	From string
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryMailer(from string) *MemoryMailer {
+	return &MemoryMailer{From: from}
+}
+
+func (m *MemoryMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns a copy of everything sent so far.
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
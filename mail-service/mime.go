@@ -0,0 +1,356 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Attachment is a file sent along with a message, such as a library card
+// or a receipt.
+type Attachment struct {
+	Filename    string
+	ContentType string // detected from Filename when empty
+	Data        []byte
+}
+
+// Composer renders Messages as RFC 5322 / MIME documents. Now and Rand are
+// only replaced by tests, to make Date, Message-ID and boundaries stable.
+type Composer struct {
+	From     string
+	Hostname string // right-hand side of Message-ID
+	Now      func() time.Time
+	Rand     io.Reader
+	DKIM     *DKIMSigner // signs each message when set
+}
+
+func NewComposer(from string) *Composer {
+	return &Composer{
+		From:     from,
+		Hostname: messageHost(from),
+		Now:      time.Now,
+		Rand:     rand.Reader,
+		DKIM:     dkimSigner(),
+	}
+}
+
+// messageHost is the domain Message-IDs are generated under: the sender's
+// domain, or the machine's hostname when the sender has none.
+func messageHost(from string) string {
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		return strings.Trim(from[at+1:], "> ")
+	}
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "librabooks.local"
+}
+
+// Bytes renders the message with a default Composer.
+func (msg Message) Bytes(from string) ([]byte, error) {
+	return NewComposer(from).Compose(msg)
+}
+
+// Compose renders the message. A message with HTML is sent as
+// multipart/alternative with a plain-text part, derived from the HTML when
+// Text is empty; attachments wrap the body in multipart/mixed. A
+// Message-ID in Headers is kept so deliveries can be traced; otherwise one
+// is generated.
+func (c *Composer) Compose(msg Message) ([]byte, error) {
+	if len(msg.To) == 0 {
+		return nil, fmt.Errorf("message has no recipients")
+	}
+
+	messageID := headerValue(msg.Headers, "Message-ID")
+	if messageID == "" {
+		id, err := c.random(16)
+		if err != nil {
+			return nil, err
+		}
+		messageID = "<" + id + "@" + c.Hostname + ">"
+	}
+
+	header := [][2]string{
+		{"From", formatAddresses([]string{c.From})},
+		{"To", formatAddresses(msg.To)},
+		{"Subject", encodeHeader(msg.Subject)},
+		{"Date", c.Now().Format(time.RFC1123Z)},
+		{"Message-ID", messageID},
+		{"MIME-Version", "1.0"},
+	}
+
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		if textproto.CanonicalMIMEHeaderKey(name) != "Message-Id" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header = append(header, [2]string{textproto.CanonicalMIMEHeaderKey(name), encodeHeader(msg.Headers[name])})
+	}
+
+	text := msg.Text
+	if text == "" && msg.HTML != "" {
+		text = htmlToText(msg.HTML)
+	}
+
+	bodyHeader, body, err := c.body(text, msg.HTML)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	if len(msg.Attachments) == 0 {
+		for _, name := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			if value := bodyHeader.Get(name); value != "" {
+				header = append(header, [2]string{name, value})
+			}
+		}
+		writeHeader(&buf, header)
+		buf.Write(body)
+		return c.sign(buf.Bytes())
+	}
+
+	var parts bytes.Buffer
+	mixed := multipart.NewWriter(&parts)
+	err = c.setBoundary(mixed)
+	if err != nil {
+		return nil, err
+	}
+
+	part, err := mixed.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, err
+	}
+	_, err = part.Write(body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range msg.Attachments {
+		err = writeAttachment(mixed, attachment)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = mixed.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	header = append(header, [2]string{"Content-Type", "multipart/mixed; boundary=" + mixed.Boundary()})
+	writeHeader(&buf, header)
+	buf.Write(parts.Bytes())
+	return c.sign(buf.Bytes())
+}
+
+func (c *Composer) sign(message []byte) ([]byte, error) {
+	if c.DKIM == nil {
+		return message, nil
+	}
+	return c.DKIM.Sign(message, c.Now())
+}
+
+// headerValue looks name up in headers regardless of its capitalisation.
+func headerValue(headers map[string]string, name string) string {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	for key, value := range headers {
+		if textproto.CanonicalMIMEHeaderKey(key) == name {
+			return value
+		}
+	}
+	return ""
+}
+
+// body renders the message text as a single text/plain part, or as
+// multipart/alternative when there is an HTML version.
+func (c *Composer) body(text, htmlBody string) (textproto.MIMEHeader, []byte, error) {
+	var buf bytes.Buffer
+
+	if htmlBody == "" {
+		err := writeQuotedPrintable(&buf, text)
+		return textproto.MIMEHeader{
+			"Content-Type":              {`text/plain; charset="utf-8"`},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		}, buf.Bytes(), err
+	}
+
+	alternative := multipart.NewWriter(&buf)
+	err := c.setBoundary(alternative)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, body := range []struct{ contentType, content string }{
+		{`text/plain; charset="utf-8"`, text},
+		{`text/html; charset="utf-8"`, htmlBody},
+	} {
+		part, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		err = writeQuotedPrintable(part, body.content)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = alternative.Close()
+	return textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	}, buf.Bytes(), err
+}
+
+func writeAttachment(mixed *multipart.Writer, attachment Attachment) error {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(strings.ToLower(fileExtension(attachment.Filename)))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	filename := mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})
+	if filename == "" {
+		return fmt.Errorf("invalid attachment filename %q", attachment.Filename)
+	}
+
+	part, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {filename},
+	})
+	if err != nil {
+		return err
+	}
+
+	// RFC 2045 limits encoded lines to 76 characters.
+	encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+	for len(encoded) > 76 {
+		_, err = io.WriteString(part, encoded[:76]+"\r\n")
+		if err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(part, encoded+"\r\n")
+	return err
+}
+
+func (c *Composer) setBoundary(w *multipart.Writer) error {
+	boundary, err := c.random(15)
+	if err != nil {
+		return err
+	}
+	return w.SetBoundary(boundary)
+}
+
+func (c *Composer) random(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(c.Rand, b)
+	if err != nil {
+		return "", fmt.Errorf("error generating message id: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeHeader(w *bytes.Buffer, header [][2]string) {
+	for _, field := range header {
+		w.WriteString(field[0] + ": " + field[1] + "\r\n")
+	}
+	w.WriteString("\r\n")
+}
+
+// writeQuotedPrintable normalises line endings to CRLF and encodes the
+// body so long lines and non-ASCII text survive any relay.
+func writeQuotedPrintable(w io.Writer, body string) error {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+
+	qp := quotedprintable.NewWriter(w)
+	_, err := io.WriteString(qp, body)
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// encodeHeader strips line breaks, which would let a value inject headers,
+// and RFC 2047-encodes non-ASCII text.
+func encodeHeader(value string) string {
+	value = strings.NewReplacer("\r", "", "\n", " ").Replace(value)
+	for _, r := range value {
+		if r > 127 {
+			return mime.QEncoding.Encode("utf-8", value)
+		}
+	}
+	return value
+}
+
+// formatAddresses re-renders each address through net/mail so display
+// names are encoded; anything unparseable is passed through sanitised.
+func formatAddresses(addresses []string) string {
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		parsed, err := netmail.ParseAddress(address)
+		if err != nil {
+			formatted[i] = strings.NewReplacer("\r", "", "\n", "").Replace(address)
+			continue
+		}
+		if parsed.Name == "" {
+			formatted[i] = parsed.Address
+		} else {
+			formatted[i] = parsed.String()
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func fileExtension(filename string) string {
+	dot := strings.LastIndex(filename, ".")
+	if dot < 0 {
+		return ""
+	}
+	return filename[dot:]
+}
+
+var (
+	blockTagPattern = regexp.MustCompile(`(?i)<\s*(br|/p|/div|/h[1-6]|/li|/tr)\s*/?>`)
+	tagPattern      = regexp.MustCompile(`<[^>]*>`)
+	blankLines      = regexp.MustCompile(`\n{3,}`)
+	styleBlocks     = regexp.MustCompile(`(?is)<(style|script|head)[^>]*>.*?</(style|script|head)>`)
+)
+
+// htmlToText gives HTML-only messages a readable plain-text alternative.
+func htmlToText(body string) string {
+	text := styleBlocks.ReplaceAllString(body, "")
+	text = blockTagPattern.ReplaceAllString(text, "\n")
+	text = tagPattern.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	text = blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
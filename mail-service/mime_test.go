@@ -0,0 +1,198 @@
+package mail
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// counterReader makes Message-ID and boundaries deterministic while still
+// giving nested multiparts distinct boundaries.
+type counterReader struct{ n byte }
+
+func (r *counterReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.n
+	}
+	r.n++
+	return len(p), nil
+}
+
+func testComposer() *Composer {
+	return &Composer{
+		From:     "LibraBook <library@example.com>",
+		Hostname: "example.com",
+		Now:      func() time.Time { return time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC) },
+		Rand:     &counterReader{},
+	}
+}
+
+func TestComposeGolden(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{
+			name: "plain",
+			msg: Message{
+				To:      []string{"reader@example.com"},
+				Subject: "Your loan is due",
+				Text:    "Hello,\nplease return \"Dune\" by Friday.\n",
+			},
+		},
+		{
+			name: "alternative",
+			msg: Message{
+				To:      []string{"reader@example.com", "Zoë Ünal <zoe@example.com>"},
+				Subject: "Bienvenue à la bibliothèque",
+				HTML:    "<html><head><style>p { color: red; }</style></head><body><h1>Welcome</h1><p>Café &amp; books — enjoy!</p></body></html>",
+				Headers: map[string]string{"List-Unsubscribe": "<https://example.com/unsubscribe>"},
+			},
+		},
+		{
+			name: "attachment",
+			msg: Message{
+				To:      []string{"reader@example.com"},
+				Subject: "Your receipt",
+				Text:    "Your receipt is attached. This line is long enough that quoted-printable has to wrap it with a soft line break somewhere.",
+				HTML:    "<p>Your receipt is attached.</p>",
+				Attachments: []Attachment{
+					{Filename: "receipt.txt", Data: []byte("Dune, returned 2024-05-01\n")},
+					{Filename: "library card.png", ContentType: "image/png", Data: bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 30)},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testComposer().Compose(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				err = os.WriteFile(golden, got, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s (run with -update to accept):\n%s", golden, got)
+			}
+
+			assertCRLF(t, got)
+			assertParses(t, got, tt.msg)
+		})
+	}
+}
+
+func assertCRLF(t *testing.T, raw []byte) {
+	t.Helper()
+	for i, b := range raw {
+		if b == '\n' && (i == 0 || raw[i-1] != '\r') {
+			t.Fatalf("bare LF at byte %d", i)
+		}
+	}
+}
+
+// assertParses reads the message back with the standard library to check
+// it is well formed, not just equal to a golden file.
+func assertParses(t *testing.T, raw []byte, msg Message) {
+	t.Helper()
+
+	parsed, err := netmail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != msg.Subject {
+		t.Errorf("subject = %q, want %q", subject, msg.Subject)
+	}
+
+	to, err := parsed.Header.AddressList("To")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(to) != len(msg.To) {
+		t.Errorf("got %d recipients, want %d", len(to), len(msg.To))
+	}
+
+	for _, name := range []string{"Date", "Message-Id", "Mime-Version", "From"} {
+		if parsed.Header.Get(name) == "" {
+			t.Errorf("missing %s header", name)
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return
+	}
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	parts := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filename := part.FileName(); filename != "" {
+			found := false
+			for _, attachment := range msg.Attachments {
+				found = found || attachment.Filename == filename
+			}
+			if !found {
+				t.Errorf("unexpected attachment %q", filename)
+			}
+		}
+		parts++
+	}
+
+	want := 2
+	if len(msg.Attachments) > 0 {
+		want = 1 + len(msg.Attachments)
+	}
+	if parts != want {
+		t.Errorf("got %d parts, want %d", parts, want)
+	}
+}
+
+func TestEncodeHeaderStripsLineBreaks(t *testing.T) {
+	got := encodeHeader("Hello\r\nBcc: victim@example.com")
+	if strings.ContainsAny(got, "\r\n") {
+		t.Errorf("header value still contains a line break: %q", got)
+	}
+}
+
+func TestComposeRequiresRecipients(t *testing.T) {
+	_, err := testComposer().Compose(Message{Subject: "x", Text: "y"})
+	if err == nil {
+		t.Error("expected an error for a message without recipients")
+	}
+}
@@ -0,0 +1,282 @@
+package mail
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	statusQueued  = "queued"
+	statusSending = "sending"
+	statusSent    = "sent"
+	statusFailed  = "failed"
+
+	// A message left in "sending" longer than this belongs to a worker that
+	// died mid-delivery and is handed out again.
+	staleLockAfter = 10 * time.Minute
+	maxRetryDelay  = time.Hour
+	pollInterval   = 5 * time.Second
+)
+
+// Outbox is a Mailer that persists messages and delivers them from a pool of
+// background workers. Failed deliveries are retried with exponential backoff
+// until MaxAttempts is reached, and pending messages survive restarts.
+type Outbox struct {
+	db          *sql.DB
+	mailer      Mailer
+	Workers     int
+	MaxAttempts int
+	BaseDelay   time.Duration
+	// SkipLocked lets concurrent workers pass over messages another worker
+	// is claiming. SQLite has no row locks and runs one writer at a time, so
+	// it is turned off there.
+	SkipLocked bool
+
+	wake chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewOutbox(db *sql.DB, mailer Mailer, workers int, maxAttempts int) *Outbox {
+	if workers < 1 {
+		workers = 4
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 8
+	}
+	return &Outbox{
+		db:          db,
+		mailer:      mailer,
+		Workers:     workers,
+		MaxAttempts: maxAttempts,
+		BaseDelay:   30 * time.Second,
+		SkipLocked:  true,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Send queues the message; it returns once the message is stored, not
+// once it is delivered.
+func (o *Outbox) Send(msg Message) error {
+	_, err := o.Enqueue(msg)
+	return err
+}
+
+func (o *Outbox) Enqueue(msg Message) (int, error) {
+	if len(msg.To) == 0 {
+		return 0, errors.New("message has no recipients")
+	}
+
+	msg, messageID := withMessageID(msg)
+	headers, attachments, err := encodeExtras(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = o.db.QueryRow("INSERT INTO mail_outbox (recipients, subject, text_body, html_body, headers, attachments, status, next_attempt_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8) RETURNING id",
+		strings.Join(msg.To, ","), msg.Subject, msg.Text, msg.HTML, headers, attachments, statusQueued, time.Now().UTC()).Scan(&id)
+	if err != nil {
+		log.WithError(err).Error("Error queueing email")
+		return 0, fmt.Errorf("error queueing email: %s", err)
+	}
+	recordDelivery(o.db, messageID, msg.To, DeliveryQueued, "", id, 0)
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return id, nil
+}
+
+// Start launches the workers. They stop when ctx is cancelled; Wait blocks
+// until they have finished their current message.
+func (o *Outbox) Start(ctx context.Context) {
+	for i := 0; i < o.Workers; i++ {
+		o.wg.Add(1)
+		go o.work(ctx)
+	}
+}
+
+func (o *Outbox) Wait() {
+	o.wg.Wait()
+}
+
+func (o *Outbox) work(ctx context.Context) {
+	defer o.wg.Done()
+
+	for {
+		delivered, err := o.deliverNext()
+		if err != nil {
+			log.WithError(err).Error("Error processing mail outbox")
+		}
+		if delivered {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+type outboxMessage struct {
+	ID       int
+	Attempts int
+	Message
+}
+
+// claim locks the oldest due message for this worker. Messages stuck in
+// "sending" past staleLockAfter are reclaimed, which is how a restart picks
+// up deliveries that were in flight when the server went down.
+func (o *Outbox) claim() (*outboxMessage, error) {
+	now := time.Now().UTC()
+
+	lock := ""
+	if o.SkipLocked {
+		lock = "FOR UPDATE SKIP LOCKED"
+	}
+
+	var m outboxMessage
+	var recipients, headers, attachments string
+	err := o.db.QueryRow(`UPDATE mail_outbox SET status = $1, locked_at = $2
+		WHERE id = (
+			SELECT id FROM mail_outbox
+			WHERE (status = $3 AND next_attempt_at <= $2) OR (status = $1 AND locked_at < $4)
+			ORDER BY next_attempt_at, id
+			LIMIT 1
+			`+lock+`
+		)
+		RETURNING id, attempts, recipients, subject, text_body, html_body, headers, attachments`,
+		statusSending, now, statusQueued, now.Add(-staleLockAfter)).
+		Scan(&m.ID, &m.Attempts, &recipients, &m.Subject, &m.Text, &m.HTML, &headers, &attachments)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error claiming email: %s", err)
+	}
+
+	m.To = strings.Split(recipients, ",")
+	err = decodeExtras(&m.Message, headers, attachments)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding email %d: %s", m.ID, err)
+	}
+	return &m, nil
+}
+
+// encodeExtras stores headers and attachments as JSON; empty ones are
+// stored as empty strings to keep plain messages readable in the table.
+func encodeExtras(msg Message) (string, string, error) {
+	var headers, attachments string
+
+	if len(msg.Headers) > 0 {
+		b, err := json.Marshal(msg.Headers)
+		if err != nil {
+			return "", "", fmt.Errorf("error encoding email headers: %s", err)
+		}
+		headers = string(b)
+	}
+	if len(msg.Attachments) > 0 {
+		b, err := json.Marshal(msg.Attachments)
+		if err != nil {
+			return "", "", fmt.Errorf("error encoding email attachments: %s", err)
+		}
+		attachments = string(b)
+	}
+
+	return headers, attachments, nil
+}
+
+func decodeExtras(msg *Message, headers, attachments string) error {
+	if headers != "" {
+		err := json.Unmarshal([]byte(headers), &msg.Headers)
+		if err != nil {
+			return err
+		}
+	}
+	if attachments != "" {
+		err := json.Unmarshal([]byte(attachments), &msg.Attachments)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverNext sends one due message and reports whether there was one.
+func (o *Outbox) deliverNext() (bool, error) {
+	m, err := o.claim()
+	if err != nil || m == nil {
+		return false, err
+	}
+
+	msg, messageID := withMessageID(m.Message)
+	sendErr := o.mailer.Send(msg)
+	now := time.Now().UTC()
+	attempts := m.Attempts + 1
+
+	if sendErr == nil {
+		recordDelivery(o.db, messageID, msg.To, DeliverySent, "", m.ID, 0)
+		_, err = o.db.Exec("UPDATE mail_outbox SET status = $1, attempts = $2, sent_at = $3, locked_at = NULL, last_error = '' WHERE id = $4",
+			statusSent, attempts, now, m.ID)
+		return true, err
+	}
+
+	fields := logrus.Fields{"outbox_id": m.ID, "attempt": attempts}
+
+	if isHardRejection(sendErr) {
+		// Retrying won't change the server's mind about the mailbox.
+		log.WithError(sendErr).WithFields(fields).Error("Email rejected by server")
+		recordDelivery(o.db, messageID, msg.To, DeliveryBounced, sendErr.Error(), m.ID, 0)
+		for _, to := range msg.To {
+			if err := Suppress(o.db, to, sendErr.Error(), messageID); err != nil {
+				log.WithError(err).Error("Error suppressing rejected address")
+			}
+		}
+		_, err = o.db.Exec("UPDATE mail_outbox SET status = $1, attempts = $2, locked_at = NULL, last_error = $3 WHERE id = $4",
+			statusFailed, attempts, sendErr.Error(), m.ID)
+		return true, err
+	}
+
+	if attempts >= o.MaxAttempts {
+		log.WithError(sendErr).WithFields(fields).Error("Email delivery failed permanently")
+		recordDelivery(o.db, messageID, msg.To, DeliveryFailed, sendErr.Error(), m.ID, 0)
+		_, err = o.db.Exec("UPDATE mail_outbox SET status = $1, attempts = $2, locked_at = NULL, last_error = $3 WHERE id = $4",
+			statusFailed, attempts, sendErr.Error(), m.ID)
+		return true, err
+	}
+
+	next := now.Add(o.retryDelay(attempts))
+	log.WithError(sendErr).WithFields(fields).WithField("retry_at", next).Warn("Email delivery failed, will retry")
+	recordDelivery(o.db, messageID, msg.To, DeliveryDeferred, sendErr.Error(), m.ID, 0)
+	_, err = o.db.Exec("UPDATE mail_outbox SET status = $1, attempts = $2, next_attempt_at = $3, locked_at = NULL, last_error = $4 WHERE id = $5",
+		statusQueued, attempts, next, sendErr.Error(), m.ID)
+	return true, err
+}
+
+// retryDelay doubles BaseDelay for every failed attempt, capped at
+// maxRetryDelay, with up to 10% jitter so retries from a burst of failures
+// don't all land at once.
+func (o *Outbox) retryDelay(attempts int) time.Duration {
+	delay := o.BaseDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/10+1))
+}
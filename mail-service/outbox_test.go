@@ -0,0 +1,180 @@
+package mail
+
+import (
+	"database/sql"
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// failingMailer refuses every message with err.
+type failingMailer struct {
+	err   error
+	calls int
+}
+
+func (m *failingMailer) Send(msg Message) error {
+	m.calls++
+	return m.err
+}
+
+type outboxRow struct {
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+func readOutboxRow(t *testing.T, db *sql.DB, id int) outboxRow {
+	t.Helper()
+	var row outboxRow
+	err := db.QueryRow("SELECT status, attempts, next_attempt_at, last_error FROM mail_outbox WHERE id = $1", id).
+		Scan(&row.Status, &row.Attempts, &row.NextAttemptAt, &row.LastError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return row
+}
+
+func newTestOutbox(t *testing.T, mailer Mailer, maxAttempts int) (*Outbox, *sql.DB) {
+	t.Helper()
+	db := openTestDB(t)
+	o := NewOutbox(db, mailer, 1, maxAttempts)
+	o.SkipLocked = false
+	o.BaseDelay = time.Minute
+	return o, db
+}
+
+func deliverOnce(t *testing.T, o *Outbox) bool {
+	t.Helper()
+	delivered, err := o.deliverNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return delivered
+}
+
+func TestOutboxRetriesWithBackoff(t *testing.T) {
+	mailer := &failingMailer{err: errors.New("connection refused")}
+	o, db := newTestOutbox(t, mailer, 5)
+
+	id, err := o.Enqueue(Message{To: []string{"ada@example.com"}, Subject: "Due soon", Text: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt, delay := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		before := time.Now().UTC()
+		if !deliverOnce(t, o) {
+			t.Fatalf("attempt %d: nothing was due", attempt+1)
+		}
+
+		row := readOutboxRow(t, db, id)
+		if row.Status != statusQueued || row.Attempts != attempt+1 || row.LastError != "connection refused" {
+			t.Fatalf("attempt %d: row = %+v", attempt+1, row)
+		}
+		// The delay doubles each time, plus up to 10% jitter.
+		wait := row.NextAttemptAt.Sub(before)
+		if wait < delay || wait > delay+delay/10+time.Second {
+			t.Errorf("attempt %d: retry in %s, want %s plus jitter", attempt+1, wait, delay)
+		}
+
+		if deliverOnce(t, o) {
+			t.Fatalf("attempt %d: retried before the backoff ran out", attempt+1)
+		}
+		_, err := db.Exec("UPDATE mail_outbox SET next_attempt_at = $1 WHERE id = $2", time.Now().UTC().Add(-time.Second), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliveries, err := Deliveries(db, "ada@example.com", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 4 || deliveries[0].Status != DeliveryDeferred || deliveries[3].Status != DeliveryQueued {
+		t.Errorf("delivery log = %+v", deliveries)
+	}
+}
+
+func TestOutboxGivesUpAfterMaxAttempts(t *testing.T) {
+	mailer := &failingMailer{err: errors.New("connection refused")}
+	o, db := newTestOutbox(t, mailer, 3)
+	o.BaseDelay = 0
+
+	id, err := o.Enqueue(Message{To: []string{"ada@example.com"}, Subject: "Due soon", Text: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for deliverOnce(t, o) {
+	}
+	if mailer.calls != 3 {
+		t.Errorf("mailer called %d times, want 3", mailer.calls)
+	}
+	if row := readOutboxRow(t, db, id); row.Status != statusFailed || row.Attempts != 3 || row.LastError != "connection refused" {
+		t.Errorf("row = %+v", row)
+	}
+
+	deliveries, err := Deliveries(db, "ada@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != DeliveryFailed {
+		t.Errorf("last delivery = %+v", deliveries)
+	}
+}
+
+func TestOutboxDoesNotRetryHardRejections(t *testing.T) {
+	mailer := &failingMailer{err: &textproto.Error{Code: 550, Msg: "no such mailbox"}}
+	o, db := newTestOutbox(t, mailer, 5)
+
+	id, err := o.Enqueue(Message{To: []string{"Gone@example.com"}, Subject: "Due soon", Text: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for deliverOnce(t, o) {
+	}
+	if row := readOutboxRow(t, db, id); mailer.calls != 1 || row.Status != statusFailed {
+		t.Errorf("after %d sends, row = %+v", mailer.calls, row)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM mail_suppressions WHERE email = 'gone@example.com'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Error("rejected address was not suppressed")
+	}
+}
+
+func TestOutboxReclaimsStaleLock(t *testing.T) {
+	mailer := NewMemoryMailer("library@example.com")
+	o, db := newTestOutbox(t, mailer, 5)
+
+	id, err := o.Enqueue(Message{To: []string{"ada@example.com"}, Subject: "Due soon", Text: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A worker claims the message and dies before sending it.
+	if m, err := o.claim(); err != nil || m == nil || m.ID != id {
+		t.Fatalf("claim = %+v, %v", m, err)
+	}
+	if deliverOnce(t, o) {
+		t.Fatal("a message locked by a live worker was handed out again")
+	}
+
+	_, err = db.Exec("UPDATE mail_outbox SET locked_at = $1 WHERE id = $2", time.Now().UTC().Add(-staleLockAfter-time.Minute), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deliverOnce(t, o) {
+		t.Fatal("stale lock was not reclaimed")
+	}
+	if row := readOutboxRow(t, db, id); row.Status != statusSent || row.Attempts != 1 || len(mailer.Messages()) != 1 {
+		t.Errorf("row = %+v, %d messages sent", row, len(mailer.Messages()))
+	}
+}
@@ -0,0 +1,181 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"main.go/events"
+)
+
+//go:embed templates
+var templateFiles embed.FS
+
+// TemplateNames lists every transactional email. Each has a NAME.txt
+// defining "subject" and "text", and a NAME.html defining "content" that is
+// rendered inside the shared layout.
+var TemplateNames = []string{
+	"welcome",
+	"activation",
+	"otp",
+	"reset",
+	"email-change",
+	"due-soon",
+	"overdue",
+	"hold-ready",
+}
+
+// TemplateData holds the per-recipient variables. Templates only use the
+// fields that apply to them.
+type TemplateData struct {
+	Name     string // how to greet the recipient
+	Link     string
+	Code     string
+	Loans    []LoanNotice
+	Book     string
+	PickupBy time.Time
+	AppURL   string // filled from the configured site URL when empty
+
+	UnsubscribeURL string // set by RenderTemplate for opt-out categories
+}
+
+type LoanNotice struct {
+	Title  string    `json:"title"`
+	Author string    `json:"author"`
+	DueAt  time.Time `json:"due_at"`
+}
+
+func (l LoanNotice) Due() string {
+	return l.DueAt.Format("Mon, 2 Jan 2006")
+}
+
+// templateEvents are the templates that also notify a member who is
+// online.
+var templateEvents = map[string]string{
+	"hold-ready": events.HoldReady,
+}
+
+// templateCategories says which preference governs each template. Templates
+// not listed are account emails that can't be opted out of.
+var templateCategories = map[string]string{
+	"due-soon":   CategoryReminders,
+	"overdue":    CategoryReminders,
+	"hold-ready": CategoryHolds,
+}
+
+// TemplateCategory returns the preference category of the named template,
+// or "" for account emails.
+func TemplateCategory(name string) string {
+	return templateCategories[name]
+}
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var emailTemplates = mustParseTemplates()
+
+func mustParseTemplates() map[string]emailTemplate {
+	parsed := map[string]emailTemplate{}
+	for _, name := range TemplateNames {
+		text, err := texttemplate.ParseFS(templateFiles, "templates/layout.txt", "templates/"+name+".txt")
+		if err != nil {
+			panic(fmt.Sprintf("error parsing email template %s: %s", name, err))
+		}
+		html, err := htmltemplate.ParseFS(templateFiles, "templates/layout.html", "templates/"+name+".html", "templates/"+name+".txt")
+		if err != nil {
+			panic(fmt.Sprintf("error parsing email template %s: %s", name, err))
+		}
+		parsed[name] = emailTemplate{text: text, html: html}
+	}
+	return parsed
+}
+
+// RenderTemplate builds the message for the named template.
+func RenderTemplate(name string, to string, data TemplateData) (Message, error) {
+	tmpl, ok := emailTemplates[name]
+	if !ok {
+		return Message{}, fmt.Errorf("unknown email template %q", name)
+	}
+
+	if data.AppURL == "" {
+		data.AppURL = siteURL()
+	}
+	category := templateCategories[name]
+	if category != "" && to != "" {
+		data.UnsubscribeURL = UnsubscribeURL(to, category)
+	}
+	if data.Name == "" {
+		data.Name = to
+		if at := strings.Index(to, "@"); at > 0 {
+			data.Name = to[:at]
+		}
+	}
+
+	var subject, text, html bytes.Buffer
+
+	err := tmpl.text.ExecuteTemplate(&subject, "subject", data)
+	if err != nil {
+		return Message{}, fmt.Errorf("error rendering %s subject: %s", name, err)
+	}
+	err = tmpl.text.ExecuteTemplate(&text, "layout", data)
+	if err != nil {
+		return Message{}, fmt.Errorf("error rendering %s text: %s", name, err)
+	}
+	err = tmpl.html.ExecuteTemplate(&html, "layout.html", data)
+	if err != nil {
+		return Message{}, fmt.Errorf("error rendering %s html: %s", name, err)
+	}
+
+	msg := Message{
+		To:      []string{to},
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}
+	if data.UnsubscribeURL != "" {
+		msg = WithUnsubscribe(msg, category)
+	}
+	return msg, nil
+}
+
+// SendTemplate renders the named template for one recipient and sends it.
+func SendTemplate(mailer Mailer, name string, to string, data TemplateData) error {
+	msg, err := RenderTemplate(name, to, data)
+	if err != nil {
+		log.WithError(err).Error("Error rendering email")
+		return err
+	}
+
+	err = mailer.Send(msg)
+	if err != nil {
+		log.WithError(err).WithField("template", name).Error("Error sending email")
+		return err
+	}
+
+	if event, ok := templateEvents[name]; ok {
+		events.PublishEmail(to, event, map[string]interface{}{"book": data.Book, "pickup_by": data.PickupBy})
+	}
+	return nil
+}
+
+// SampleData is what the admin preview renders each template with.
+func SampleData() TemplateData {
+	now := time.Now()
+	return TemplateData{
+		Name: "Ada",
+		Link: "https://example.com/activate/0f8fad5b-d9cb-469f-a165-70867728950e",
+		Code: "0f8fad5b-d9cb-469f-a165-70867728950e",
+		Loans: []LoanNotice{
+			{Title: "Dune", Author: "Frank Herbert", DueAt: now.AddDate(0, 0, 2)},
+			{Title: "Emma", Author: "Jane Austen", DueAt: now.AddDate(0, 0, 3)},
+		},
+		Book:     "The Left Hand of Darkness",
+		PickupBy: now.AddDate(0, 0, 7),
+	}
+}
@@ -0,0 +1,96 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderEveryTemplate(t *testing.T) {
+	data := SampleData()
+	data.AppURL = "https://library.example.com"
+
+	for _, name := range TemplateNames {
+		t.Run(name, func(t *testing.T) {
+			msg, err := RenderTemplate(name, "ada@example.com", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.Subject == "" || strings.Contains(msg.Subject, "\n") {
+				t.Errorf("bad subject %q", msg.Subject)
+			}
+			if len(msg.To) != 1 || msg.To[0] != "ada@example.com" {
+				t.Errorf("recipients = %v", msg.To)
+			}
+
+			for format, body := range map[string]string{"text": msg.Text, "html": msg.HTML} {
+				if !strings.Contains(body, "Hello Ada,") {
+					t.Errorf("%s body is not personalised:\n%s", format, body)
+				}
+				if !strings.Contains(body, data.AppURL) {
+					t.Errorf("%s body is missing the footer link", format)
+				}
+				if strings.Contains(body, "<no value>") {
+					t.Errorf("%s body uses a missing variable:\n%s", format, body)
+				}
+			}
+
+			if !strings.HasPrefix(msg.HTML, "<!DOCTYPE html>") {
+				t.Errorf("html body does not use the layout")
+			}
+
+			_, err = testComposer().Compose(msg)
+			if err != nil {
+				t.Errorf("compose: %s", err)
+			}
+		})
+	}
+}
+
+func TestRenderTemplateVariables(t *testing.T) {
+	data := SampleData()
+	data.AppURL = "https://library.example.com"
+
+	checks := map[string][]string{
+		"activation":   {data.Link},
+		"otp":          {data.Code},
+		"reset":        {data.Link},
+		"email-change": {data.Link},
+		"due-soon":     {"Dune", "Emma", "2 books are due soon"},
+		"overdue":      {"Frank Herbert", "2 books are overdue"},
+		"hold-ready":   {data.Book},
+	}
+
+	for name, wants := range checks {
+		msg, err := RenderTemplate(name, "ada@example.com", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range wants {
+			if !strings.Contains(msg.Subject+msg.Text, want) {
+				t.Errorf("%s: %q not found in subject or text", name, want)
+			}
+		}
+	}
+}
+
+func TestRenderTemplateEscapesHTML(t *testing.T) {
+	data := SampleData()
+	data.AppURL = "https://library.example.com"
+	data.Name = "<script>alert(1)</script>"
+
+	msg, err := RenderTemplate("welcome", "ada@example.com", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg.HTML, "<script>") {
+		t.Error("recipient name was not escaped in the html body")
+	}
+}
+
+func TestRenderUnknownTemplate(t *testing.T) {
+	_, err := RenderTemplate("missing", "ada@example.com", TemplateData{AppURL: "x"})
+	if err == nil {
+		t.Error("expected an error for an unknown template")
+	}
+}
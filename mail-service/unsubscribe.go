@@ -0,0 +1,118 @@
+package mail
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Email categories members can opt out of. Account emails (activation,
+// OTP, password reset) are always sent.
+const (
+	CategoryAnnouncements = "announcements"
+	CategoryReminders     = "reminders"
+	CategoryHolds         = "holds"
+)
+
+// Categories maps each category to the user_table column that records
+// whether the member wants it.
+var Categories = map[string]string{
+	CategoryAnnouncements: "email_announcements",
+	CategoryReminders:     "email_reminders",
+	CategoryHolds:         "email_holds",
+}
+
+var (
+	settingsMu        sync.RWMutex
+	baseURL           string
+	sender            string
+	unsubscribeSecret []byte
+)
+
+// Configure sets the site URL used in links and the key unsubscribe links
+// are signed with. Without a secret a random key is used, which works but
+// invalidates links sent before the next restart.
+func Configure(config Config) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	baseURL = strings.TrimRight(config.BaseURL, "/")
+	sender = config.From
+	unsubscribeSecret = []byte(config.UnsubscribeSecret)
+	if len(unsubscribeSecret) == 0 {
+		log.Warn("UNSUBSCRIBE_SECRET is not set, unsubscribe links will stop working after a restart")
+		unsubscribeSecret = make([]byte, 32)
+		rand.Read(unsubscribeSecret)
+	}
+}
+
+func siteURL() string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return baseURL
+}
+
+func senderAddress() string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return sender
+}
+
+func secret() []byte {
+	settingsMu.RLock()
+	key := unsubscribeSecret
+	settingsMu.RUnlock()
+
+	if key == nil {
+		Configure(Config{BaseURL: siteURL()})
+		return secret()
+	}
+	return key
+}
+
+func unsubscribeSignature(email, category string) string {
+	mac := hmac.New(sha256.New, secret())
+	mac.Write([]byte(strings.ToLower(email) + "\x00" + category))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// UnsubscribeURL is a link that opts email out of category without logging
+// in. It is signed so it can't be forged for another address.
+func UnsubscribeURL(email, category string) string {
+	query := url.Values{
+		"email":    {email},
+		"category": {category},
+		"sig":      {unsubscribeSignature(email, category)},
+	}
+	return siteURL() + "/unsubscribe?" + query.Encode()
+}
+
+// VerifyUnsubscribe checks a signature produced by UnsubscribeURL.
+func VerifyUnsubscribe(email, category, signature string) bool {
+	if _, ok := Categories[category]; !ok {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(unsubscribeSignature(email, category)))
+}
+
+// WithUnsubscribe adds the List-Unsubscribe headers (RFC 2369 and the
+// one-click variant from RFC 8058) for the message's first recipient.
+func WithUnsubscribe(msg Message, category string) Message {
+	if len(msg.To) == 0 {
+		return msg
+	}
+
+	headers := map[string]string{}
+	for name, value := range msg.Headers {
+		headers[name] = value
+	}
+	headers["List-Unsubscribe"] = "<" + UnsubscribeURL(msg.To[0], category) + ">"
+	headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+	msg.Headers = headers
+
+	return msg
+}
@@ -0,0 +1,73 @@
+package mail
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUnsubscribeLinks(t *testing.T) {
+	Configure(Config{BaseURL: "https://library.example.com/", UnsubscribeSecret: "test-secret"})
+
+	link := UnsubscribeURL("Ada@Example.com", CategoryReminders)
+	if !strings.HasPrefix(link, "https://library.example.com/unsubscribe?") {
+		t.Fatalf("unexpected link %q", link)
+	}
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	sig := query.Get("sig")
+
+	if !VerifyUnsubscribe(query.Get("email"), query.Get("category"), sig) {
+		t.Error("valid link was rejected")
+	}
+	if !VerifyUnsubscribe("ada@example.com", CategoryReminders, sig) {
+		t.Error("signature should not depend on email case")
+	}
+	if VerifyUnsubscribe("eve@example.com", CategoryReminders, sig) {
+		t.Error("signature accepted for another address")
+	}
+	if VerifyUnsubscribe("ada@example.com", CategoryAnnouncements, sig) {
+		t.Error("signature accepted for another category")
+	}
+	if VerifyUnsubscribe("ada@example.com", "everything", sig) {
+		t.Error("unknown category accepted")
+	}
+
+	Configure(Config{BaseURL: "https://library.example.com", UnsubscribeSecret: "rotated"})
+	if VerifyUnsubscribe("ada@example.com", CategoryReminders, sig) {
+		t.Error("signature accepted after the secret changed")
+	}
+}
+
+func TestOptOutTemplatesCarryUnsubscribeHeaders(t *testing.T) {
+	Configure(Config{BaseURL: "https://library.example.com", UnsubscribeSecret: "test-secret"})
+
+	for _, name := range TemplateNames {
+		msg, err := RenderTemplate(name, "ada@example.com", SampleData())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := msg.Headers["List-Unsubscribe"]
+		if TemplateCategory(name) == "" {
+			if header != "" {
+				t.Errorf("%s is an account email but has List-Unsubscribe", name)
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(header, "<https://library.example.com/unsubscribe?") {
+			t.Errorf("%s: List-Unsubscribe = %q", name, header)
+		}
+		if msg.Headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+			t.Errorf("%s: missing one-click header", name)
+		}
+		if !strings.Contains(msg.Text, "Unsubscribe") || !strings.Contains(msg.HTML, "Unsubscribe") {
+			t.Errorf("%s: body has no unsubscribe link", name)
+		}
+	}
+}
@@ -1,202 +1,1084 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	_ "github.com/glebarez/go-sqlite"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
+	"main.go/audit"
 	"main.go/books"
+	"main.go/chat"
+	"main.go/config"
+	"main.go/events"
 	"main.go/mail-service"
+	"main.go/migrations"
+	"main.go/notifications"
+	"main.go/store"
 	"main.go/token"
 	"main.go/users"
 )
 
-func goDotEnvVariable(key string) string {
+type ResponseData struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type registerPage struct {
+	Email    string
+	Username string
+	Errors   users.ValidationErrors
+}
+
+type EmailData struct {
+	Email   string `json:"email"`
+	Content string `json:"content"`
+}
+
+var db *sql.DB
+var mailer mail.Mailer
+var campaigns *mail.CampaignService
+var dispatcher *mail.Dispatcher
+var chats *chat.Service
+var auditLog audit.Auditor
+var inbox notifications.Notifier
+var limiter = rate.NewLimiter(rate.Limit(100)/3, 100)
+var log = logrus.New()
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.WithError(err).Fatal("Error loading configuration")
+	}
+	users.Configure(cfg.Users)
+	books.Configure(cfg.Books)
+	audit.Configure(cfg.Audit)
+
+	connStr := cfg.ConnStr
+	if cfg.DriverName == "sqlite" {
+		connStr = sqliteConnStr(connStr)
+	}
+	db, err = sql.Open(cfg.DriverName, connStr)
+	if err != nil {
+		fmt.Println("Error opening database:", err)
+		return
+	}
+	defer db.Close()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err = runMigrate(cfg.DriverName, os.Args[2:])
+		if err != nil {
+			log.WithError(err).Error("Migration failed")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	applied, err := migrations.Up(db, cfg.DriverName)
+	if err != nil {
+		log.WithError(err).Fatal("Error migrating database schema")
+	}
+	for _, m := range applied {
+		log.WithField("version", m.Version).Info("Applied migration ", m.Name)
+	}
+
+	mailConfig := cfg.Mail
+	mail.Configure(mailConfig)
+	err = mail.ConfigureDKIM(mailConfig)
+	if err != nil {
+		log.WithError(err).Fatal("Error configuring DKIM")
+	}
+	transport, err := mail.NewMailer(mailConfig)
+	if err != nil {
+		log.WithError(err).Fatal("Error configuring mail")
+	}
+
+	// The dispatcher keeps every sender within the provider's concurrency
+	// and rate limits.
+	dispatcher = mail.NewDispatcher(transport, mailConfig.Concurrency, mailConfig.RatePerSecond)
+
+	// Everything goes through the outbox so a failed delivery is retried
+	// instead of lost.
+	outbox := mail.NewOutbox(db, dispatcher, mailConfig.Workers, mailConfig.MaxAttempts)
+	outbox.SkipLocked = cfg.DriverName != "sqlite"
+	outbox.Start(context.Background())
+	mailer = outbox
+
+	repos := store.NewSQL(db)
+	users.DefaultUserService.Mailer = mailer
+	users.DefaultUserService.Users = repos
+	users.DefaultUserService.Borrowings = repos
+	books.DefaultBookService.Mailer = mailer
+	books.DefaultBookService.Books = repos
+	books.DefaultBookService.Borrowings = repos
+	books.DefaultBookService.Users = repos
+
+	notices := notifications.NewInbox(db)
+	auditLog, inbox = audit.NewLog(db), notices
+	users.DefaultUserService.Audit = auditLog
+	users.DefaultUserService.Notifications = notices
+	users.DefaultUserService.Emails = mail.NewDeliveryLog(db)
+	books.DefaultBookService.Audit = auditLog
+	books.DefaultBookService.Notifications = inbox
+
+	// Campaigns record each recipient's outcome themselves, so they use the
+	// dispatcher directly rather than the outbox.
+	campaigns = mail.NewCampaignService(db, dispatcher, auditLog)
+	err = campaigns.ResumeRunning()
+	if err != nil {
+		log.WithError(err).Error("Error resuming campaigns")
+	}
+
+	chats = chat.NewService(db)
+	users.DefaultUserService.Chats = chats
+
+	go purgeDeletedAccounts(time.Hour)
+	go books.DefaultBookService.RunReminders(24 * time.Hour)
+	if mailConfig.BounceDir != "" {
+		go mail.RunBounces(db, mailConfig.BounceDir, 5*time.Minute)
+	}
+
+	router := newRouter()
+
+	log.Info("Server listening on port", cfg.Port)
+	fmt.Println("Server listening on port", cfg.Port)
+	http.ListenAndServe(cfg.Port, router)
+}
+
+// sqliteConnStr adds the pragmas the server relies on unless CONN_STR sets
+// its own: writers wait for each other instead of failing with "database is
+// locked", WAL lets pages be read while mail is being written, and foreign
+// keys are enforced as they are on Postgres.
+func sqliteConnStr(connStr string) string {
+	if strings.Contains(connStr, "_pragma=") {
+		return connStr
+	}
+	separator := "?"
+	if strings.Contains(connStr, "?") {
+		separator = "&"
+	}
+	return connStr + separator + "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+}
+
+// newRouter registers every page and endpoint. The services and package
+// variables it relies on are set up by main.
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/", getRegisterPage)
+	router.HandleFunc("/login_form", rateLimitedHandler(getLoginPage))
+	router.HandleFunc("/checkmail", rateLimitedHandler(getCheckMailPage))
+	router.HandleFunc("/activate/{link}", activate)
+	router.HandleFunc("/register", rateLimitedHandler(registerUser))
+	router.HandleFunc("/login", rateLimitedHandler(loginUser))
+	router.HandleFunc("/sendotp", rateLimitedHandler(handleOTP))
+	router.HandleFunc("/otp", rateLimitedHandler(getOTP))
+
+	router.HandleFunc("/userList", rateLimitedHandler(getUserList))
+	router.HandleFunc("/sendemail", rateLimitedHandler(adminOnly(handleSendEmail)))
+	router.HandleFunc("/sendemailall", rateLimitedHandler(adminOnly(handleSendEmailAll)))
+
+	router.HandleFunc("/library", rateLimitedHandler(getLibrary))
+	router.HandleFunc("/profile", rateLimitedHandler(getProfile))
+	router.HandleFunc("/profile/update", rateLimitedHandler(handleUpdateProfile))
+	router.HandleFunc("/profile/email", rateLimitedHandler(handleChangeEmail))
+	router.HandleFunc("/profile/avatar", rateLimitedHandler(handleUploadAvatar))
+	router.HandleFunc("/profile/preferences", rateLimitedHandler(handleUpdatePreferences))
+	router.HandleFunc("/unsubscribe", rateLimitedHandler(handleUnsubscribe))
+	router.HandleFunc("/confirm-email/{link}", confirmEmail)
+	router.HandleFunc("/account/export", rateLimitedHandler(handleExportData))
+	router.HandleFunc("/account/delete", rateLimitedHandler(handleDeleteAccount))
+	router.HandleFunc("/account/delete/cancel", rateLimitedHandler(handleCancelDeletion))
+
+	router.HandleFunc("/reset/{code}", rateLimitedHandler(handlePasswordReset))
+	router.HandleFunc("/changepsswd", rateLimitedHandler(getPsswd))
+	router.HandleFunc("/change", rateLimitedHandler(changePassword))
+
+	router.HandleFunc("/events", rateLimitedHandler(streamEvents))
+	router.HandleFunc("/notifications", rateLimitedHandler(getNotifications))
+	router.HandleFunc("/notifications/unread", rateLimitedHandler(getUnreadNotifications))
+	router.HandleFunc("/notifications/read-all", rateLimitedHandler(handleMarkAllNotificationsRead))
+	router.HandleFunc("/notifications/{id:[0-9]+}/read", rateLimitedHandler(handleMarkNotificationRead))
+	router.HandleFunc("/chat/ws", rateLimitedHandler(serveChat))
+	router.HandleFunc("/chat/conversation", rateLimitedHandler(getChatConversation))
+	router.HandleFunc("/admin/chat", rateLimitedHandler(adminOnly(getAdminChat)))
+	router.HandleFunc("/admin/chat/conversations", rateLimitedHandler(adminOnly(getChatInbox)))
+	router.HandleFunc("/admin/chat/conversations/{id:[0-9]+}", rateLimitedHandler(adminOnly(getChatMessages)))
+
+	router.HandleFunc("/borrow", rateLimitedHandler(handleBorrowBook))
+	router.HandleFunc("/return", rateLimitedHandler(handleReturnBook))
+	router.HandleFunc("/deleteuser", rateLimitedHandler(adminOnly(handleDeleteUser)))
+	router.HandleFunc("/restoreuser", rateLimitedHandler(adminOnly(handleRestoreUser)))
+	router.HandleFunc("/admin/trash", rateLimitedHandler(adminOnly(getTrash)))
+	router.HandleFunc("/admin/audit", rateLimitedHandler(adminOnly(getAuditLog)))
+	router.HandleFunc("/admin/audit/export", rateLimitedHandler(adminOnly(exportAuditLog)))
+	router.HandleFunc("/admin/mail/templates", rateLimitedHandler(adminOnly(getMailTemplates)))
+	router.HandleFunc("/admin/mail/templates/{name}", rateLimitedHandler(adminOnly(previewMailTemplate)))
+	router.HandleFunc("/admin/mail/metrics", rateLimitedHandler(adminOnly(getMailMetrics)))
+	router.HandleFunc("/admin/mail/deliveries", rateLimitedHandler(adminOnly(getMailDeliveries)))
+	router.HandleFunc("/admin/mail/suppressions", rateLimitedHandler(adminOnly(handleMailSuppressions)))
+	router.HandleFunc("/admin/campaigns", rateLimitedHandler(adminOnly(handleCampaigns)))
+	router.HandleFunc("/admin/campaigns/{id:[0-9]+}", rateLimitedHandler(adminOnly(getCampaign)))
+	router.HandleFunc("/admin/campaigns/{id:[0-9]+}/progress", rateLimitedHandler(adminOnly(getCampaignProgress)))
+	router.HandleFunc("/admin/campaigns/{id:[0-9]+}/{action:start|pause|cancel}", rateLimitedHandler(adminOnly(handleCampaignAction)))
+	router.HandleFunc("/admin/users/{id:[0-9]+}", rateLimitedHandler(adminOnly(handleAdminUser)))
+	router.HandleFunc("/admin/users/{id:[0-9]+}/activation", rateLimitedHandler(adminOnly(handleToggleActivation)))
+	router.HandleFunc("/admin/users/{id:[0-9]+}/reset-password", rateLimitedHandler(adminOnly(handleResetPassword)))
+
+	// Serving static files
+	router.PathPrefix("/book-covers/").Handler(http.StripPrefix("/book-covers/", http.FileServer(http.Dir("book-covers"))))
+	router.PathPrefix("/styles/").Handler(http.StripPrefix("/styles/", http.FileServer(http.Dir("styles"))))
+	router.PathPrefix("/js/").Handler(http.StripPrefix("/js/", http.FileServer(http.Dir("js"))))
+	router.PathPrefix("/avatars/").Handler(http.StripPrefix("/avatars/", http.FileServer(http.Dir(users.AvatarDir()))))
+
+	return router
+}
+
+func rateLimitedHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.Allow() {
+			log.Warn("Rate limit exceeded")
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// adminOnly rejects requests that don't come from a logged-in admin.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		isAdmin, err := users.DefaultUserService.IsAdmin(r)
+		if err != nil || !isAdmin {
+			log.Warn("Non-admin request to admin endpoint")
+			http.Error(w, "Access denied", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// streamEvents pushes notifications to the logged-in member as
+// Server-Sent Events.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	profile, err := users.DefaultUserService.GetProfile(userID)
+	if err != nil {
+		log.WithError(err).Error("Error loading profile for events")
+		http.Error(w, "Error loading profile", http.StatusInternalServerError)
+		return
+	}
+
+	events.Default.Stream(w, r, userID, profile.Email)
+}
+
+// getNotifications shows the member's notification center, or with
+// ?format=json returns it for scripts.
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	list, err := notifications.List(db, userID, 100)
+	var unread int
+	if err == nil {
+		unread, err = notifications.UnreadCount(db, userID)
+	}
+	if err != nil {
+		log.WithError(err).Error("Error loading notifications")
+		http.Error(w, "Error loading notifications", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Notifications []notifications.Notification `json:"notifications"`
+		Unread        int                          `json:"unread"`
+	}{list, unread}
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+	templating(w, "notifications.html", data)
+}
+
+func getUnreadNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	unread, err := notifications.UnreadCount(db, userID)
+	if err != nil {
+		log.WithError(err).Error("Error counting notifications")
+		http.Error(w, "Error counting notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+}
+
+func handleMarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	err = notifications.MarkRead(db, userID, id)
+	if err == notifications.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("Error marking notification read")
+		http.Error(w, "Error marking notification read", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleMarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = notifications.MarkAllRead(db, userID)
+	if err != nil {
+		log.WithError(err).Error("Error marking notifications read")
+		http.Error(w, "Error marking notifications read", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveChat upgrades to the chat WebSocket. Members talk in their own
+// conversation; admins can answer any of them.
+func serveChat(w http.ResponseWriter, r *http.Request) {
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	isAdmin, _ := users.DefaultUserService.IsAdmin(r)
+
+	chats.ServeWS(w, r, userID, isAdmin)
+}
+
+// getChatConversation returns the member's conversation and its history,
+// and marks the admins' replies as read.
+func getChatConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conversation, err := chats.Open(userID)
+	if err == nil {
+		err = chats.MarkRead(conversation.ID, false)
+	}
+	var messages []chat.Message
+	if err == nil {
+		messages, err = chats.Messages(conversation.ID)
+	}
+	if err != nil {
+		log.WithError(err).Error("Error loading chat conversation")
+		http.Error(w, "Error loading chat", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation": conversation,
+		"messages":     messages,
+	})
+}
+
+func getAdminChat(w http.ResponseWriter, r *http.Request) {
+	templating(w, "admin-2.html", nil)
+}
+
+func getChatInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conversations, err := chats.Inbox()
+	if err != nil {
+		log.WithError(err).Error("Error loading chat inbox")
+		http.Error(w, "Error loading chat inbox", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversations)
+}
+
+// getChatMessages returns a conversation's history for an admin and marks
+// it read.
+func getChatMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	messages, err := chats.Messages(id)
+	if err == nil {
+		err = chats.MarkRead(id, true)
+	}
+	if err == chat.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("Error loading chat messages")
+		http.Error(w, "Error loading chat messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+func getCheckMailPage(w http.ResponseWriter, r *http.Request) {
+	templating(w, "checkemail.html", nil)
+}
+
+func getOTP(w http.ResponseWriter, r *http.Request) {
+	templating(w, "otp-page.html", nil)
+}
+
+func getProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := books.DefaultBookService.ShowBorrowedBooks(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func handleUpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	preferences := users.Preferences{
+		Announcements: r.FormValue("announcements") == "on",
+		Reminders:     r.FormValue("reminders") == "on",
+		Holds:         r.FormValue("holds") == "on",
+	}
+
+	err = users.DefaultUserService.UpdatePreferences(r, userID, preferences)
+	if err != nil {
+		log.WithError(err).Error("Error updating email preferences")
+		http.Error(w, "Error updating email preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUnsubscribe serves the links in emails. GET only asks for
+// confirmation, so link scanners can't unsubscribe anyone; POST, including
+// the RFC 8058 one-click POST mail clients send, performs it.
+func handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Email     string
+		Category  string
+		Signature string
+		Done      bool
+		Error     string
+	}{
+		Email:     r.FormValue("email"),
+		Category:  r.FormValue("category"),
+		Signature: r.FormValue("sig"),
+	}
+
+	if !mail.VerifyUnsubscribe(page.Email, page.Category, page.Signature) {
+		w.WriteHeader(http.StatusBadRequest)
+		page.Error = "This unsubscribe link is invalid."
+		templating(w, "unsubscribe.html", page)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		err := users.DefaultUserService.Unsubscribe(r, page.Email, page.Category)
+		if err != nil {
+			log.WithError(err).Warn("Unsubscribe failed")
+			w.WriteHeader(http.StatusNotFound)
+			page.Error = "We couldn't find this subscription."
+		} else {
+			page.Done = true
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	templating(w, "unsubscribe.html", page)
+}
+
+func handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = users.DefaultUserService.UpdateProfile(userID, r.FormValue("username"), r.FormValue("display_name"))
+	if err != nil {
+		writeProfileError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = users.DefaultUserService.RequestEmailChange(r, userID, r.FormValue("email"), r.FormValue("password"))
+	if err != nil {
+		writeProfileError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func handleUploadAvatar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, users.MaxAvatarUploadSize+1<<20)
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		http.Error(w, "Avatar image is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	err = users.DefaultUserService.UpdateAvatar(userID, file)
+	if err != nil {
+		writeProfileError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func confirmEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := users.DefaultUserService.ConfirmEmailChange(r, mux.Vars(r)["link"])
+	if err != nil {
+		log.WithError(err).Warn("Email change confirmation failed")
+		http.Error(w, "Error confirming email", http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func handleExportData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	export, err := users.DefaultUserService.ExportData(userID)
+	if err != nil {
+		log.WithError(err).Error("Error exporting user data")
+		http.Error(w, "Error exporting data", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="librabooks-data.json"`)
+		json.NewEncoder(w).Encode(export)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="librabooks-data.zip"`)
+	err = users.WriteExportArchive(w, export)
+	if err != nil {
+		log.WithError(err).Error("Error writing export archive")
+	}
+}
+
+func handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = users.DefaultUserService.RequestDeletion(r, userID, r.FormValue("password"))
+	if err != nil {
+		writeProfileError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func handleCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := users.CurrentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = users.DefaultUserService.CancelDeletion(r, userID)
+	if err != nil {
+		writeProfileError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
 
-	// load .env file
-	err := godotenv.Load(".env")
+// purgeDeletedAccounts removes accounts whose deletion grace period or
+// trash retention period is over.
+func purgeDeletedAccounts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := users.DefaultUserService.PurgeDeletionRequests()
+		if err != nil {
+			log.WithError(err).Error("Error purging deleted accounts")
+		} else if purged > 0 {
+			log.WithField("count", purged).Info("Deleted accounts purged")
+		}
 
-	if err != nil {
-		log.Fatal("Error loading .env file", err)
+		purged, err = users.DefaultUserService.PurgeDeletedUsers()
+		if err != nil {
+			log.WithError(err).Error("Error purging trashed users")
+		} else if purged > 0 {
+			log.WithField("count", purged).Info("Trashed users purged")
+		}
 
+		<-ticker.C
 	}
-
-	return os.Getenv(key)
 }
 
-var (
-	port        = goDotEnvVariable("PORT")
-	connStr     = goDotEnvVariable("CONN_STR")
-	driverName  = goDotEnvVariable("DRIVERNAME")
-	tableName   = goDotEnvVariable("TABLENAME")
-	createTable = `
-		CREATE TABLE IF NOT EXISTS user_table (
-			id SERIAL PRIMARY KEY,
-			email VARCHAR(255),
-			username VARCHAR(255),
-			password VARCHAR(255),
-			isActivated BOOLEAN DEFAULT FALSE
-		);
-	`
-)
+// writeProfileError reports validation problems to the user and hides
+// everything else behind a generic message.
+func writeProfileError(w http.ResponseWriter, err error) {
+	var validationErrors users.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		fields := make([]string, 0, len(validationErrors))
+		for field := range validationErrors {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
 
-type ResponseData struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
+		messages := make([]string, 0, len(fields))
+		for _, field := range fields {
+			messages = append(messages, validationErrors[field])
+		}
+		http.Error(w, strings.Join(messages, "\n"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	log.WithError(err).Error("Error updating profile")
+	http.Error(w, "Error updating profile", http.StatusInternalServerError)
 }
 
-type EmailData struct {
-	Email   string `json:"email"`
-	Content string `json:"content"`
+func getPsswd(w http.ResponseWriter, r *http.Request) {
+	templating(w, "change-password.html", nil)
 }
 
-var db *sql.DB
-var limiter = rate.NewLimiter(rate.Limit(100)/3, 100)
-var log = logrus.New()
+func getLibrary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-func main() {
-	var err error
-	db, err = sql.Open(driverName, connStr)
+	err := books.DefaultBookService.ShowBooks(w, r)
 	if err != nil {
-		fmt.Println("Error opening database:", err)
+		http.Error(w, "Error showing library", http.StatusInternalServerError)
+	}
+}
+
+func handleSendEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	defer db.Close()
 
-	router := mux.NewRouter()
+	var emailData EmailData
+	err := json.NewDecoder(r.Body).Decode(&emailData)
+	if err != nil {
+		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
+		return
+	}
 
-	router.HandleFunc("/", getRegisterPage)
-	router.HandleFunc("/login_form", rateLimitedHandler(getLoginPage))
-	router.HandleFunc("/checkmail", rateLimitedHandler(getCheckMailPage))
-	router.HandleFunc("/activate/{link}", activate)
-	router.HandleFunc("/register", rateLimitedHandler(registerUser))
-	router.HandleFunc("/login", rateLimitedHandler(loginUser))
-	router.HandleFunc("/sendotp", rateLimitedHandler(handleOTP))
-	router.HandleFunc("/otp", rateLimitedHandler(getOTP))
+	email := emailData.Email
+	content := emailData.Content
 
-	router.HandleFunc("/userList", rateLimitedHandler(getUserList))
-	router.HandleFunc("/sendemail", rateLimitedHandler(handleSendEmail))
-	router.HandleFunc("/sendemailall", rateLimitedHandler(handleSendEmailAll))
+	fmt.Println("Email:", email)
+	fmt.Println("Content:", content)
 
-	router.HandleFunc("/library", rateLimitedHandler(getLibrary))
-	router.HandleFunc("/profile", rateLimitedHandler(getProfile))
+	err = mail.SendEmail(mailer, email, content)
+	if err != nil {
+		http.Error(w, "Error sending email", http.StatusInternalServerError)
+		return
+	}
 
-	router.HandleFunc("/changepsswd", rateLimitedHandler(getPsswd))
-	router.HandleFunc("/change", rateLimitedHandler(changePassword))
+	auditLog.Record(r, "mail.send", email, nil, map[string]string{"content": content})
+	inbox.CreateForEmail(email, notifications.AdminMessage, "Message from the library", content, "")
 
-	router.HandleFunc("/borrow", rateLimitedHandler(handleBorrowBook))
-	router.HandleFunc("/return", rateLimitedHandler(handleReturnBook))
-	router.HandleFunc("/deleteuser", rateLimitedHandler(handleDeleteUser))
+	w.WriteHeader(http.StatusOK)
+}
 
-	// Serving static files
-	router.PathPrefix("/book-covers/").Handler(http.StripPrefix("/book-covers/", http.FileServer(http.Dir("book-covers"))))
-	router.PathPrefix("/styles/").Handler(http.StripPrefix("/styles/", http.FileServer(http.Dir("styles"))))
+func handleSendEmailAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := mail.SendEmailAll(r, campaigns)
+	if err != nil {
+		log.WithError(err).Error("Error starting campaign")
+		http.Error(w, "Error sending email", http.StatusInternalServerError)
+		return
+	}
 
-	log.Info("Server listening on port", port)
-	fmt.Println("Server listening on port", port)
-	http.ListenAndServe(port, router)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"campaign": fmt.Sprintf("/admin/campaigns/%d", id)})
 }
 
-func rateLimitedHandler(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if !limiter.Allow() {
-			log.Warn("Rate limit exceeded")
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-			return
-		}
-		next.ServeHTTP(w, r)
+func getMailMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dispatcher.Metrics())
 }
 
-func getCheckMailPage(w http.ResponseWriter, r *http.Request) {
-	templating(w, "checkemail.html", nil)
+// getMailDeliveries returns the delivery log, newest first, optionally for
+// one ?email= address.
+func getMailDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 || limit > 1000 {
+		limit = 200
+	}
+
+	deliveries, err := mail.Deliveries(db, r.URL.Query().Get("email"), limit)
+	if err != nil {
+		log.WithError(err).Error("Error loading email deliveries")
+		http.Error(w, "Error loading email deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
 }
 
-func getOTP(w http.ResponseWriter, r *http.Request) {
-	templating(w, "otp-page.html", nil)
+// handleMailSuppressions lists suppressed addresses, or with DELETE and
+// ?email= lets campaigns mail that address again.
+func handleMailSuppressions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		suppressions, err := mail.Suppressions(db)
+		if err != nil {
+			log.WithError(err).Error("Error loading email suppressions")
+			http.Error(w, "Error loading email suppressions", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(suppressions)
+
+	case http.MethodDelete:
+		err := mail.Unsuppress(r, db, auditLog, r.URL.Query().Get("email"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
 }
 
-func getProfile(w http.ResponseWriter, r *http.Request) {
+func getMailTemplates(w http.ResponseWriter, r *http.Request) {
+	templating(w, "mailTemplates.html", mail.TemplateNames)
+}
+
+// previewMailTemplate renders a template with sample data, as HTML or with
+// ?format=text as the plain-text alternative.
+func previewMailTemplate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	err := books.DefaultBookService.ShowBorrowedBooks(w, r, db)
+	msg, err := mail.RenderTemplate(mux.Vars(r)["name"], "ada@example.com", mail.SampleData())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Subject: %s\n\n%s", msg.Subject, msg.Text)
 		return
 	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, msg.HTML)
 }
 
-func getPsswd(w http.ResponseWriter, r *http.Request) {
-	templating(w, "change-password.html", nil)
+func handleCampaigns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		err := campaigns.ShowCampaigns(w)
+		if err != nil {
+			log.WithError(err).Error("Error showing campaigns")
+			http.Error(w, "Error showing campaigns", http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		text := r.FormValue("body")
+		html := ""
+		if r.FormValue("format") == "html" {
+			text, html = "", text
+		}
+
+		id, err := campaigns.Create(r, r.FormValue("subject"), text, html, r.FormValue("segment"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if r.FormValue("start") == "true" {
+			err = campaigns.Start(r, id)
+			if err != nil {
+				log.WithError(err).Error("Error starting campaign")
+				http.Error(w, "Error starting campaign", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/admin/campaigns/%d", id), http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
 }
 
-func getLibrary(w http.ResponseWriter, r *http.Request) {
+func getCampaign(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	err := books.DefaultBookService.ShowBooks(w, r, db)
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	err := campaigns.ShowCampaign(w, id)
 	if err != nil {
-		http.Error(w, "Error showing library", http.StatusInternalServerError)
+		log.WithError(err).Error("Error showing campaign")
+		http.Error(w, "Error showing campaign", http.StatusNotFound)
 	}
 }
 
-func handleSendEmail(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+func getCampaignProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var emailData EmailData
-	err := json.NewDecoder(r.Body).Decode(&emailData)
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	c, err := campaigns.Get(id)
 	if err != nil {
-		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	email := emailData.Email
-	content := emailData.Content
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   c.Status,
+		"total":    c.Total,
+		"sent":     c.Sent,
+		"failed":   c.Failed,
+		"progress": c.Progress(),
+	})
+}
 
-	fmt.Println("Email:", email)
-	fmt.Println("Content:", content)
+func handleCampaignAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	err = mail.SendEmail(email, content)
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	var err error
+	switch vars["action"] {
+	case "start":
+		err = campaigns.Start(r, id)
+	case "pause":
+		err = campaigns.Pause(r, id)
+	case "cancel":
+		err = campaigns.Cancel(r, id)
+	}
 	if err != nil {
-		http.Error(w, "Error sending email", http.StatusInternalServerError)
+		log.WithError(err).Warn("Campaign action failed")
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func handleSendEmailAll(w http.ResponseWriter, r *http.Request) {
+func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	err := mail.SendEmailAll(db, 10000)
+	err := r.ParseForm()
 	if err != nil {
-		http.Error(w, "Error sending email", http.StatusInternalServerError)
+		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+	userID := r.Form.Get("user_id")
+
+	err = users.DefaultUserService.DeleteUser(r, userID)
+	if err != nil {
+		http.Error(w, "Error deleting user", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+func handleRestoreUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -209,22 +1091,133 @@ func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	}
 	userID := r.Form.Get("user_id")
 
-	err = users.DefaultUserService.DeleteUser(db, userID)
+	err = users.DefaultUserService.RestoreUser(r, userID)
 	if err != nil {
-		http.Error(w, "Error deleting user", http.StatusInternalServerError)
+		log.WithError(err).Error("Error restoring user")
+		http.Error(w, "Error restoring user", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleAdminUser(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	switch r.Method {
+	case http.MethodGet:
+		err := users.DefaultUserService.ShowAdminUser(w, userID)
+		if err != nil {
+			log.WithError(err).Error("Error showing user")
+			http.Error(w, "Error showing user", http.StatusNotFound)
+		}
+	case http.MethodPost:
+		update := users.AdminUserUpdate{
+			Email:       r.FormValue("email"),
+			Username:    r.FormValue("username"),
+			DisplayName: r.FormValue("display_name"),
+			IsAdmin:     r.FormValue("isadmin") == "true",
+		}
+
+		err := users.DefaultUserService.AdminUpdateUser(r, userID, update)
+		if err != nil {
+			writeProfileError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleToggleActivation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	_, err := users.DefaultUserService.ToggleActivation(r, userID)
+	if err != nil {
+		log.WithError(err).Error("Error toggling activation")
+		http.Error(w, "Error changing activation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	err := users.DefaultUserService.ResetPassword(r, userID)
+	if err != nil {
+		log.WithError(err).Error("Error resetting password")
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := audit.ShowAuditLog(w, r, db)
+	if err != nil {
+		log.WithError(err).Error("Error showing audit log")
+		http.Error(w, "Error showing audit log", http.StatusInternalServerError)
+	}
+}
+
+func exportAuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-log.csv"`)
+
+	err := audit.ExportCSV(w, db, audit.ParseQuery(r.URL.Query()))
+	if err != nil {
+		log.WithError(err).Error("Error exporting audit log")
+		http.Error(w, "Error exporting audit log", http.StatusInternalServerError)
+	}
+}
+
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := users.DefaultUserService.ShowTrash(w, r)
+	if err != nil {
+		log.WithError(err).Error("Error showing trash")
+		http.Error(w, "Error showing deleted users", http.StatusInternalServerError)
+	}
+}
+
 func handleBorrowBook(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	err := books.DefaultBookService.BorrowBook(w, r, db)
+	err := books.DefaultBookService.BorrowBook(w, r)
+	if errors.Is(err, store.ErrUnavailable) {
+		http.Error(w, "Book is already borrowed", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error showing library", http.StatusInternalServerError)
 	}
@@ -236,7 +1229,7 @@ func handleReturnBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := books.DefaultBookService.ReturnBook(w, r, db)
+	err := books.DefaultBookService.ReturnBook(w, r)
 	if err != nil {
 		http.Error(w, "Error returning book", http.StatusInternalServerError)
 	}
@@ -256,7 +1249,7 @@ func handleOTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := users.DefaultUserService.OTPservice(db, email)
+	err := users.DefaultUserService.OTPservice(email)
 	if err != nil {
 		log.WithError(err).Warn("Authentication failed")
 		http.Error(w, "error otp", http.StatusUnauthorized)
@@ -273,7 +1266,7 @@ func activate(w http.ResponseWriter, r *http.Request) {
 	}
 	link := mux.Vars(r)["link"]
 	fmt.Println(link)
-	err := users.DefaultUserService.Activate(db, link)
+	err := users.DefaultUserService.Activate(link)
 	if err != nil {
 		http.Error(w, "Error activating account", http.StatusInternalServerError)
 	}
@@ -281,6 +1274,57 @@ func activate(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login_form", http.StatusSeeOther)
 }
 
+// handlePasswordReset shows the form behind a reset link and saves the
+// password chosen with it.
+func handlePasswordReset(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+	page := struct {
+		Expired bool
+		Error   string
+	}{}
+
+	switch r.Method {
+	case http.MethodGet:
+		err := users.DefaultUserService.CheckResetLink(code)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			page.Expired = true
+		}
+	case http.MethodPost:
+		password := r.FormValue("password")
+		if password != r.FormValue("passwordConfirm") {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			page.Error = "Passwords do not match"
+			break
+		}
+
+		err := users.DefaultUserService.CompletePasswordReset(r, code, password)
+		if errors.Is(err, users.ErrResetLinkInvalid) {
+			w.WriteHeader(http.StatusNotFound)
+			page.Expired = true
+			break
+		}
+		var validationErrors users.ValidationErrors
+		if errors.As(err, &validationErrors) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			page.Error = validationErrors["password"]
+			break
+		}
+		if err != nil {
+			log.WithError(err).Error("Error completing password reset")
+			http.Error(w, "Error resetting password", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/login_form", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	templating(w, "reset-password.html", page)
+}
+
 func changePassword(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -295,7 +1339,7 @@ func changePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := users.DefaultUserService.ChangePassword(db, email, password, newpassword)
+	err := users.DefaultUserService.ChangePassword(r, email, password, newpassword)
 	if err != nil {
 		log.WithError(err).Warn("Password changing failed")
 		http.Error(w, "Invalid password", http.StatusUnauthorized)
@@ -312,7 +1356,7 @@ func getUserList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := users.DefaultUserService.ShowUserList(w, r, db)
+	err := users.DefaultUserService.ShowUserList(w, r)
 	if err != nil {
 		log.WithError(err).Error("Error showing user list")
 		http.Error(w, "Error showing user list", http.StatusInternalServerError)
@@ -340,17 +1384,31 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		Value: token,
 	})
 
-	err = users.DefaultUserService.CreateUser(db, newUser, token)
+	err = users.DefaultUserService.CreateUser(newUser, token)
 	if err != nil {
-		fileName := "register.html"
-		t, _ := template.ParseFiles(fileName)
-		t.ExecuteTemplate(w, fileName, "Email is already registered")
+		page := registerPage{
+			Email:    newUser.Email,
+			Username: newUser.Username,
+		}
+
+		var validationErrors users.ValidationErrors
+		if errors.As(err, &validationErrors) {
+			page.Errors = validationErrors
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		} else {
+			log.WithError(err).Error("Error creating user")
+			page.Errors = users.ValidationErrors{"form": "Registration failed, please try again later"}
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		templating(w, "register.html", page)
 		return
 	}
 
 	log.WithFields(logrus.Fields{
-		"action": "register",
-		"user":   newUser,
+		"action":   "register",
+		"email":    newUser.Email,
+		"username": newUser.Username,
 	}).Info("User registered successfully")
 
 	http.Redirect(w, r, "/checkmail", http.StatusSeeOther)
@@ -384,7 +1442,7 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		Value: token,
 	})
 
-	err = users.DefaultUserService.AuthenticateUser(db, username, password, token)
+	err = users.DefaultUserService.AuthenticateUser(r, username, password, token)
 	if err != nil {
 		log.WithError(err).Warn("Authentication failed")
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
@@ -398,16 +1456,18 @@ func getUser(r *http.Request) users.User {
 	email := r.FormValue("email")
 	username := r.FormValue("username")
 	password := r.FormValue("password")
+	passwordConfirm := r.FormValue("passwordConfirm")
 
 	return users.User{
-		Email:    email,
-		Username: username,
-		Password: password,
+		Email:           email,
+		Username:        username,
+		Password:        password,
+		PasswordConfirm: passwordConfirm,
 	}
 }
 
 func getRegisterPage(w http.ResponseWriter, r *http.Request) {
-	templating(w, "register.html", nil)
+	templating(w, "register.html", registerPage{})
 }
 
 func getLoginPage(w http.ResponseWriter, r *http.Request) {
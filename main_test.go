@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"main.go/audit"
+	"main.go/books"
+	"main.go/chat"
+	mail "main.go/mail-service"
+	"main.go/migrations"
+	"main.go/notifications"
+	"main.go/store"
+	"main.go/users"
+)
+
+// testApp is the router from main wired to a fresh SQLite database and a
+// mailer that keeps what it sends.
+type testApp struct {
+	server *httptest.Server
+	db     *sql.DB
+	repos  *store.SQL
+	mailer *mail.MemoryMailer
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	userConfig := users.DefaultConfig()
+	userConfig.APIURL = "http://library.test"
+	userConfig.StorageDir = t.TempDir()
+	userConfig.PasswordHash = "bcrypt"
+	userConfig.BcryptCost = 4 // the minimum; hashing is not what is under test
+	users.Configure(userConfig)
+	books.Configure(books.DefaultConfig())
+
+	previousUsers, previousBooks := users.DefaultUserService, books.DefaultBookService
+	previousDB, previousChats, previousLimiter := db, chats, limiter
+	previousAudit, previousInbox := auditLog, inbox
+	t.Cleanup(func() {
+		users.Configure(users.DefaultConfig())
+		users.DefaultUserService, books.DefaultBookService = previousUsers, previousBooks
+		db, chats, limiter = previousDB, previousChats, previousLimiter
+		auditLog, inbox = previousAudit, previousInbox
+	})
+
+	testDB, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "library.db")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	if _, err := migrations.Up(testDB, "sqlite"); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &testApp{db: testDB, repos: store.NewSQL(testDB), mailer: mail.NewMemoryMailer("library@example.com")}
+	users.DefaultUserService.Mailer = app.mailer
+	users.DefaultUserService.Users = app.repos
+	users.DefaultUserService.Borrowings = app.repos
+	books.DefaultBookService.Mailer = app.mailer
+	books.DefaultBookService.Books = app.repos
+	books.DefaultBookService.Borrowings = app.repos
+	books.DefaultBookService.Users = app.repos
+	notices := notifications.NewInbox(testDB)
+	auditLog, inbox = audit.NewLog(testDB), notices
+	users.DefaultUserService.Audit = auditLog
+	users.DefaultUserService.Notifications = notices
+	users.DefaultUserService.Emails = mail.NewDeliveryLog(testDB)
+	books.DefaultBookService.Audit = auditLog
+	books.DefaultBookService.Notifications = notices
+	db = testDB
+	chats = chat.NewService(testDB)
+	users.DefaultUserService.Chats = chats
+	limiter = rate.NewLimiter(rate.Inf, 0)
+
+	app.server = httptest.NewServer(newRouter())
+	t.Cleanup(app.server.Close)
+	return app
+}
+
+// browser is one visitor with their own cookies. Redirects are returned
+// rather than followed so tests can check where they point.
+type browser struct {
+	t      *testing.T
+	app    *testApp
+	client *http.Client
+}
+
+func (app *testApp) browser(t *testing.T) *browser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &browser{t: t, app: app, client: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+func (b *browser) do(method string, path string, form url.Values) (int, http.Header, string) {
+	b.t.Helper()
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, b.app.server.URL+path, body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, string(content)
+}
+
+func (b *browser) get(path string) (int, string) {
+	b.t.Helper()
+	status, _, body := b.do(http.MethodGet, path, nil)
+	return status, body
+}
+
+func (b *browser) post(path string, form url.Values) (int, string) {
+	b.t.Helper()
+	status, _, body := b.do(http.MethodPost, path, form)
+	return status, body
+}
+
+// expectRedirect posts the form and checks the response redirects to want.
+func (b *browser) expectRedirect(path string, form url.Values, want string) {
+	b.t.Helper()
+	status, header, body := b.do(http.MethodPost, path, form)
+	if status != http.StatusSeeOther || header.Get("Location") != want {
+		b.t.Fatalf("POST %s = %d to %q, want %d to %q: %s", path, status, header.Get("Location"), http.StatusSeeOther, want, body)
+	}
+}
+
+var activationLink = regexp.MustCompile(`/activate/[0-9a-f-]+`)
+
+// signUp registers a member, follows the link in their activation email and
+// logs them in.
+func (app *testApp) signUp(t *testing.T, email string, username string, password string) *browser {
+	t.Helper()
+	b := app.browser(t)
+
+	b.expectRedirect("/register", url.Values{
+		"email":           {email},
+		"username":        {username},
+		"password":        {password},
+		"passwordConfirm": {password},
+	}, "/checkmail")
+
+	messages := app.mailer.Messages()
+	if len(messages) == 0 || messages[len(messages)-1].To[0] != email {
+		t.Fatalf("no activation email sent to %s", email)
+	}
+	link := activationLink.FindString(messages[len(messages)-1].Text)
+	if link == "" {
+		t.Fatalf("activation email has no link: %s", messages[len(messages)-1].Text)
+	}
+
+	status, _, _ := b.do(http.MethodGet, link, nil)
+	if status != http.StatusSeeOther {
+		t.Fatalf("GET %s = %d", link, status)
+	}
+	u, err := app.repos.UserByEmail(email)
+	if err != nil || !u.IsActivated {
+		t.Fatalf("user after activation = %+v, %v", u, err)
+	}
+
+	b.expectRedirect("/login", url.Values{"email": {email}, "password": {password}}, "/library")
+	return b
+}
+
+func (app *testApp) addBook(t *testing.T, name string, author string) store.Book {
+	t.Helper()
+	book := store.Book{Name: name, Author: author, Genre: "Novel", Date: "1900-01-01"}
+	if err := app.repos.CreateBook(&book); err != nil {
+		t.Fatal(err)
+	}
+	return book
+}
+
+func TestMemberJourney(t *testing.T) {
+	app := newTestApp(t)
+	book := app.addBook(t, "Middlemarch", "George Eliot")
+	ada := app.signUp(t, "ada@example.com", "ada", "Correct-horse-7")
+
+	status, body := ada.get("/library")
+	if status != http.StatusOK || !strings.Contains(body, "Middlemarch") {
+		t.Fatalf("GET /library = %d, missing the book: %s", status, body)
+	}
+
+	status, body = ada.post("/borrow", url.Values{"book_id": {strconv.Itoa(book.ID)}})
+	if status != http.StatusOK || !strings.Contains(body, "borrowed successfully") {
+		t.Fatalf("POST /borrow = %d: %s", status, body)
+	}
+	status, _ = ada.post("/borrow", url.Values{"book_id": {strconv.Itoa(book.ID)}})
+	if status != http.StatusConflict {
+		t.Errorf("borrowing a borrowed book = %d, want %d", status, http.StatusConflict)
+	}
+
+	status, body = ada.get("/profile")
+	if status != http.StatusOK || !strings.Contains(body, "Middlemarch") {
+		t.Errorf("GET /profile = %d, missing the loan: %s", status, body)
+	}
+	member, _ := app.repos.UserByEmail("ada@example.com")
+	notices, err := notifications.List(app.db, member.ID, 10)
+	if err != nil || len(notices) != 1 || notices[0].Type != notifications.Borrowed {
+		t.Errorf("notifications after borrowing = %+v, %v", notices, err)
+	}
+
+	status, body = ada.post("/return", url.Values{"book_name": {"Middlemarch"}})
+	if status != http.StatusOK || !strings.Contains(body, "returned successfully") {
+		t.Fatalf("POST /return = %d: %s", status, body)
+	}
+	if b, _ := app.repos.Book(book.ID); b.Borrowed {
+		t.Error("book is still marked borrowed after return")
+	}
+	status, _ = ada.post("/return", url.Values{"book_name": {"Middlemarch"}})
+	if status != http.StatusInternalServerError {
+		t.Errorf("returning a book twice = %d, want %d", status, http.StatusInternalServerError)
+	}
+
+	status, _ = ada.post("/change", url.Values{
+		"email":       {"ada@example.com"},
+		"password":    {"wrong password"},
+		"newpassword": {"Another-passphrase-8"},
+	})
+	if status != http.StatusUnauthorized {
+		t.Errorf("password change with the wrong password = %d, want %d", status, http.StatusUnauthorized)
+	}
+	ada.expectRedirect("/change", url.Values{
+		"email":       {"ada@example.com"},
+		"password":    {"Correct-horse-7"},
+		"newpassword": {"Another-passphrase-8"},
+	}, "/profile")
+
+	again := app.browser(t)
+	status, _ = again.post("/login", url.Values{"email": {"ada@example.com"}, "password": {"Correct-horse-7"}})
+	if status != http.StatusUnauthorized {
+		t.Errorf("login with the old password = %d, want %d", status, http.StatusUnauthorized)
+	}
+	again.expectRedirect("/login", url.Values{"email": {"ada@example.com"}, "password": {"Another-passphrase-8"}}, "/library")
+
+	entries := app.auditActions(t, "ada@example.com")
+	for _, want := range []string{"book.borrow", "book.return", "user.password_change_failed", "user.password_change"} {
+		if !entries[want] {
+			t.Errorf("audit log is missing %s: %v", want, entries)
+		}
+	}
+}
+
+// auditActions returns the actions recorded for an actor.
+func (app *testApp) auditActions(t *testing.T, actor string) map[string]bool {
+	t.Helper()
+	rows, err := app.db.Query("SELECT action FROM audit_log WHERE actor = $1", actor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	actions := map[string]bool{}
+	for rows.Next() {
+		var action string
+		if err := rows.Scan(&action); err != nil {
+			t.Fatal(err)
+		}
+		actions[action] = true
+	}
+	return actions
+}
+
+func TestRegistrationRejectsDuplicateEmail(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(t, "ada@example.com", "ada", "Correct-horse-7")
+
+	status, body := app.browser(t).post("/register", url.Values{
+		"email":           {"ADA@example.com"},
+		"username":        {"ada2"},
+		"password":        {"Correct-horse-7"},
+		"passwordConfirm": {"Correct-horse-7"},
+	})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body, "Email is already registered") {
+		t.Errorf("POST /register = %d: %s", status, body)
+	}
+}
+
+func TestAdminListsAndDeletesUsers(t *testing.T) {
+	app := newTestApp(t)
+	admin := app.signUp(t, "admin@example.com", "admin", "Correct-horse-7")
+	bob := app.signUp(t, "bob@example.com", "bob", "Correct-horse-7")
+
+	u, _ := app.repos.UserByEmail("admin@example.com")
+	u.IsAdmin = true
+	if err := app.repos.UpdateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	target, _ := app.repos.UserByEmail("bob@example.com")
+
+	status, body := bob.get("/userList")
+	if status != http.StatusUnauthorized {
+		t.Errorf("GET /userList as a member = %d, want %d", status, http.StatusUnauthorized)
+	}
+	status, _ = bob.post("/deleteuser", url.Values{"user_id": {strconv.Itoa(u.ID)}})
+	if status != http.StatusUnauthorized {
+		t.Errorf("POST /deleteuser as a member = %d, want %d", status, http.StatusUnauthorized)
+	}
+	for _, visitor := range []*browser{bob, app.browser(t)} {
+		if status, _ := visitor.get("/admin/trash"); status != http.StatusUnauthorized {
+			t.Errorf("GET /admin/trash as a non-admin = %d, want %d", status, http.StatusUnauthorized)
+		}
+	}
+
+	status, body = admin.get("/userList")
+	if status != http.StatusOK || !strings.Contains(body, "bob@example.com") {
+		t.Fatalf("GET /userList = %d, missing bob: %s", status, body)
+	}
+	status, body = admin.get("/userList?q=admin")
+	if status != http.StatusOK || strings.Contains(body, "bob@example.com") {
+		t.Errorf("GET /userList?q=admin = %d, should not list bob: %s", status, body)
+	}
+
+	status, _ = admin.post("/deleteuser", url.Values{"user_id": {strconv.Itoa(target.ID)}})
+	if status != http.StatusOK {
+		t.Fatalf("POST /deleteuser = %d", status)
+	}
+	if !app.auditActions(t, "admin@example.com")["user.delete"] {
+		t.Error("audit log is missing the delete")
+	}
+	status, body = admin.get("/userList")
+	if status != http.StatusOK || strings.Contains(body, "bob@example.com") {
+		t.Errorf("GET /userList after delete = %d, still lists bob: %s", status, body)
+	}
+
+	// A trashed member is logged out and can't log back in.
+	status, _ = bob.get("/profile")
+	if status != http.StatusInternalServerError {
+		t.Errorf("GET /profile as a deleted member = %d, want %d", status, http.StatusInternalServerError)
+	}
+	status, _ = app.browser(t).post("/login", url.Values{"email": {"bob@example.com"}, "password": {"Correct-horse-7"}})
+	if status != http.StatusUnauthorized {
+		t.Errorf("login as a deleted member = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRateLimiting(t *testing.T) {
+	app := newTestApp(t)
+	limiter = rate.NewLimiter(rate.Every(time.Hour), 3)
+	b := app.browser(t)
+
+	for i := 0; i < 3; i++ {
+		if status, _ := b.get("/login_form"); status != http.StatusOK {
+			t.Fatalf("request %d = %d, want %d", i+1, status, http.StatusOK)
+		}
+	}
+	status, body := b.get("/login_form")
+	if status != http.StatusTooManyRequests || !strings.Contains(body, "Rate limit exceeded") {
+		t.Errorf("request over the limit = %d: %s", status, body)
+	}
+
+	// Pages outside the limiter are still served.
+	if status, _ := b.get("/"); status != http.StatusOK {
+		t.Errorf("GET / = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestSQLiteConnStr(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"librabooks.db", "librabooks.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"},
+		{"file:librabooks.db?mode=rwc", "file:librabooks.db?mode=rwc&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"},
+		{"librabooks.db?_pragma=foreign_keys(0)", "librabooks.db?_pragma=foreign_keys(0)"},
+	} {
+		if got := sqliteConnStr(tc.in); got != tc.want {
+			t.Errorf("sqliteConnStr(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+var resetLink = regexp.MustCompile(`/reset/[A-Za-z0-9_=.-]+`)
+
+func TestAdminPasswordReset(t *testing.T) {
+	app := newTestApp(t)
+	admin := app.signUp(t, "admin@example.com", "admin", "Correct-horse-7")
+	bob := app.signUp(t, "bob@example.com", "bob", "Correct-horse-7")
+
+	u, _ := app.repos.UserByEmail("admin@example.com")
+	u.IsAdmin = true
+	if err := app.repos.UpdateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	target, _ := app.repos.UserByEmail("bob@example.com")
+
+	status, _ := admin.post("/admin/users/"+strconv.Itoa(target.ID)+"/reset-password", url.Values{})
+	if status != http.StatusOK {
+		t.Fatalf("POST reset-password = %d", status)
+	}
+
+	messages := app.mailer.Messages()
+	email := messages[len(messages)-1]
+	link := resetLink.FindString(email.Text)
+	if email.To[0] != "bob@example.com" || link == "" {
+		t.Fatalf("reset email to %v has no link: %s", email.To, email.Text)
+	}
+	if strings.Contains(strings.ToLower(email.Text), "password:") {
+		t.Errorf("reset email contains a password: %s", email.Text)
+	}
+
+	// Bob is logged out and his old password no longer works.
+	if status, _ := bob.get("/profile"); status == http.StatusOK {
+		t.Error("session survived the reset")
+	}
+	status, _ = app.browser(t).post("/login", url.Values{"email": {"bob@example.com"}, "password": {"Correct-horse-7"}})
+	if status != http.StatusUnauthorized {
+		t.Errorf("login with the old password = %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// The pending reset is kept apart from the session, so a new session
+	// being saved in the meantime doesn't invalidate the link.
+	stored, _ := app.repos.UserByEmail("bob@example.com")
+	if stored.Token != "" || stored.ResetToken == "" || stored.ResetExpiresAt == nil {
+		t.Errorf("after reset Token = %q, ResetToken = %q, ResetExpiresAt = %v", stored.Token, stored.ResetToken, stored.ResetExpiresAt)
+	}
+	stored.Token = "another-session"
+	if err := app.repos.UpdateUser(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	visitor := app.browser(t)
+	if status, _ := visitor.get(link); status != http.StatusOK {
+		t.Fatalf("GET %s = %d", link, status)
+	}
+	status, body := visitor.post(link, url.Values{"password": {"short"}, "passwordConfirm": {"short"}})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body, "at least") {
+		t.Errorf("weak password = %d: %s", status, body)
+	}
+	visitor.expectRedirect(link, url.Values{"password": {"Another-passphrase-8"}, "passwordConfirm": {"Another-passphrase-8"}}, "/login_form")
+
+	if status, _ := visitor.post(link, url.Values{"password": {"Third-passphrase-9"}, "passwordConfirm": {"Third-passphrase-9"}}); status != http.StatusNotFound {
+		t.Errorf("reusing the reset link = %d, want %d", status, http.StatusNotFound)
+	}
+	visitor.expectRedirect("/login", url.Values{"email": {"bob@example.com"}, "password": {"Another-passphrase-8"}}, "/library")
+}
+
+func TestExportIncludesNotificationsChatAndEmails(t *testing.T) {
+	app := newTestApp(t)
+	book := app.addBook(t, "Middlemarch", "George Eliot")
+	ada := app.signUp(t, "ada@example.com", "ada", "Correct-horse-7")
+	member, _ := app.repos.UserByEmail("ada@example.com")
+
+	if status, body := ada.post("/borrow", url.Values{"book_id": {strconv.Itoa(book.ID)}}); status != http.StatusOK {
+		t.Fatalf("POST /borrow = %d: %s", status, body)
+	}
+	conversation, err := chats.Open(member.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chats.Post(conversation.ID, member.ID, false, "Is Emma back yet?"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An email delivered through the outbox shows up in the delivery log.
+	outbox := mail.NewOutbox(app.db, app.mailer, 1, 3)
+	outbox.SkipLocked = false
+	if _, err := outbox.Enqueue(mail.Message{To: []string{"Ada@example.com"}, Subject: "Your library card", Text: "Welcome"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	outbox.Start(ctx)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		deliveries, err := mail.Deliveries(app.db, "ada@example.com", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) == 1 && deliveries[0].Status == mail.DeliverySent {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("outbox did not deliver: %+v", deliveries)
+		}
+	}
+	stop()
+	outbox.Wait()
+
+	status, body := ada.get("/account/export?format=json")
+	if status != http.StatusOK {
+		t.Fatalf("GET /account/export = %d: %s", status, body)
+	}
+	var export users.DataExport
+	if err := json.Unmarshal([]byte(body), &export); err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Loans) != 1 || len(export.Notifications) != 1 || export.Notifications[0].Type != notifications.Borrowed {
+		t.Errorf("exported loans and notifications = %+v, %+v", export.Loans, export.Notifications)
+	}
+	if len(export.Chat) != 1 || export.Chat[0].Body != "Is Emma back yet?" {
+		t.Errorf("exported chat = %+v", export.Chat)
+	}
+	if len(export.Emails) != 1 || export.Emails[0].Subject != "Your library card" || export.Emails[0].Status != mail.DeliverySent || export.Emails[0].Date.IsZero() {
+		t.Errorf("exported emails = %+v", export.Emails)
+	}
+}
@@ -0,0 +1,203 @@
+// Package migrations holds the versioned database schema. Each version is a
+// pair of NNNN_name.up.sql and NNNN_name.down.sql files embedded in the
+// binary; applied versions are recorded in schema_migrations.
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// dialects maps a DRIVERNAME to the directory holding its migrations.
+var dialects = map[string]string{
+	"postgres": "postgres",
+	"sqlite":   "sqlite",
+}
+
+type Migration struct {
+	Version   int
+	Name      string
+	Up        string
+	Down      string
+	AppliedAt *time.Time
+}
+
+const createTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`
+
+// Load returns the migrations for a driver in version order.
+func Load(driver string) ([]Migration, error) {
+	dir, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("no migrations for database driver %q", driver)
+	}
+
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %s", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		prefix, rest, found := strings.Cut(strings.TrimSuffix(name, "."+direction+".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !found || err != nil {
+			return nil, fmt.Errorf("migration %s is not named NNNN_name.%s.sql", name, direction)
+		}
+
+		body, err := files.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %s", name, err)
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: rest}
+			byVersion[version] = m
+		}
+		if m.Name != rest {
+			return nil, fmt.Errorf("migration %04d has two names, %s and %s", version, m.Name, rest)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Status returns every migration with the time it was applied, if it was.
+func Status(db *sql.DB, driver string) ([]Migration, error) {
+	migrations, err := Load(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createTable)
+	if err != nil {
+		return nil, fmt.Errorf("error creating schema_migrations: %s", err)
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %s", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error scanning schema_migrations: %s", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %s", err)
+	}
+
+	for i := range migrations {
+		if at, ok := applied[migrations[i].Version]; ok {
+			migrations[i].AppliedAt = &at
+		}
+	}
+	return migrations, nil
+}
+
+// Up applies every pending migration in order, each in its own
+// transaction, and returns the ones it applied.
+func Up(db *sql.DB, driver string) ([]Migration, error) {
+	migrations, err := Status(db, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range migrations {
+		if m.AppliedAt != nil {
+			continue
+		}
+		err := run(db, m, m.Up, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)", m.Version, m.Name, time.Now().UTC())
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// Down rolls back the last steps applied migrations, newest first, and
+// returns the ones it rolled back.
+func Down(db *sql.DB, driver string, steps int) ([]Migration, error) {
+	migrations, err := Status(db, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []Migration
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		m := migrations[i]
+		if m.AppliedAt == nil {
+			continue
+		}
+		err := run(db, m, m.Down, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+		if err != nil {
+			return reverted, err
+		}
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+func run(db *sql.DB, m Migration, script string, record string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting migration %04d_%s: %s", m.Version, m.Name, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(script)
+	if err != nil {
+		return fmt.Errorf("error running migration %04d_%s: %s", m.Version, m.Name, err)
+	}
+	_, err = tx.Exec(record, args...)
+	if err != nil {
+		return fmt.Errorf("error recording migration %04d_%s: %s", m.Version, m.Name, err)
+	}
+	return tx.Commit()
+}
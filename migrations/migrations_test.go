@@ -0,0 +1,93 @@
+package migrations
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/glebarez/go-sqlite"
+)
+
+func TestLoadPairsUpAndDownInOrder(t *testing.T) {
+	migrations, err := Load("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d has version %d, want %d", i, m.Version, i+1)
+		}
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			t.Errorf("migration %04d_%s is missing a direction", m.Version, m.Name)
+		}
+	}
+}
+
+func TestLoadRejectsUnknownDriver(t *testing.T) {
+	_, err := Load("oracle")
+	if err == nil || !strings.Contains(err.Error(), `"oracle"`) {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestDialectsHaveTheSameVersions(t *testing.T) {
+	postgres, err := Load("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite, err := Load("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("sqlite has %d migrations, postgres has %d", len(sqlite), len(postgres))
+	}
+	for i := range postgres {
+		if sqlite[i].Version != postgres[i].Version || sqlite[i].Name != postgres[i].Name {
+			t.Errorf("sqlite migration %04d_%s, postgres has %04d_%s", sqlite[i].Version, sqlite[i].Name, postgres[i].Version, postgres[i].Name)
+		}
+	}
+}
+
+func TestSQLiteUpAndDown(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "library.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	applied, err := Up(db, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := Load("sqlite")
+	if len(applied) != len(all) {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(all))
+	}
+
+	_, err = db.Exec("INSERT INTO audit_log (actor, action) VALUES ($1, $2)", "admin", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("DELETE FROM audit_log")
+	if err == nil || !strings.Contains(err.Error(), "append-only") {
+		t.Errorf("deleting from audit_log = %v, want it refused", err)
+	}
+
+	reverted, err := Down(db, "sqlite", len(all))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(all) {
+		t.Errorf("reverted %d migrations, want %d", len(reverted), len(all))
+	}
+	if again, err := Up(db, "sqlite"); err != nil || len(again) != len(all) {
+		t.Errorf("Up after Down applied %d, %v", len(again), err)
+	}
+}
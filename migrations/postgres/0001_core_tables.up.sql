@@ -0,0 +1,32 @@
+-- The tables the application was originally run against, created by hand.
+-- Columns later code relies on are added separately so databases built
+-- from the old createTable statement pick them up too.
+CREATE TABLE IF NOT EXISTS user_table (
+	id SERIAL PRIMARY KEY,
+	email VARCHAR(255),
+	username VARCHAR(255),
+	password VARCHAR(255),
+	isActivated BOOLEAN DEFAULT FALSE
+);
+
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS isadmin BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS confirmation VARCHAR(255);
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS token VARCHAR(255);
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS otp VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS user_table_token_idx ON user_table (token);
+
+CREATE TABLE IF NOT EXISTS books (
+	id SERIAL PRIMARY KEY,
+	book_name VARCHAR(255) NOT NULL,
+	book_author VARCHAR(255) NOT NULL DEFAULT '',
+	book_genre VARCHAR(255) NOT NULL DEFAULT '',
+	book_date VARCHAR(32) NOT NULL DEFAULT '',
+	borrowed BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS borrowings (
+	book_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	borrowed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,9 @@
+ALTER TABLE user_table DROP COLUMN IF EXISTS email_holds;
+ALTER TABLE user_table DROP COLUMN IF EXISTS email_reminders;
+ALTER TABLE user_table DROP COLUMN IF EXISTS email_announcements;
+ALTER TABLE user_table DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE user_table DROP COLUMN IF EXISTS deletion_requested_at;
+ALTER TABLE user_table DROP COLUMN IF EXISTS email_confirmation;
+ALTER TABLE user_table DROP COLUMN IF EXISTS pending_email;
+ALTER TABLE user_table DROP COLUMN IF EXISTS avatar;
+ALTER TABLE user_table DROP COLUMN IF EXISTS display_name;
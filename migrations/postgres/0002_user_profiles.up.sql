@@ -0,0 +1,9 @@
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS display_name VARCHAR(64);
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS avatar VARCHAR(255);
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS pending_email VARCHAR(255);
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS email_confirmation VARCHAR(255);
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS deletion_requested_at TIMESTAMP;
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS email_announcements BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS email_reminders BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS email_holds BOOLEAN NOT NULL DEFAULT TRUE;
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS loan_reminders;
+
+DELETE FROM borrowings WHERE user_id IS NULL OR returned_at IS NOT NULL;
+ALTER TABLE borrowings ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE borrowings DROP COLUMN IF EXISTS due_at;
+ALTER TABLE borrowings DROP COLUMN IF EXISTS returned_at;
+ALTER TABLE borrowings DROP COLUMN IF EXISTS id;
@@ -0,0 +1,16 @@
+-- Borrowings are kept after return as loan history, and user_id becomes
+-- nullable so history survives account deletion.
+ALTER TABLE borrowings ADD COLUMN IF NOT EXISTS id SERIAL PRIMARY KEY;
+ALTER TABLE borrowings ADD COLUMN IF NOT EXISTS returned_at TIMESTAMP;
+ALTER TABLE borrowings ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE borrowings ADD COLUMN IF NOT EXISTS due_at TIMESTAMP;
+
+-- Loans made before due dates were tracked get the default loan period.
+UPDATE borrowings SET due_at = borrowed_at + INTERVAL '14 days' WHERE due_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS loan_reminders (
+	borrowing_id INTEGER NOT NULL,
+	kind VARCHAR(32) NOT NULL,
+	sent_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (borrowing_id, kind)
+);
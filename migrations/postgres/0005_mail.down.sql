@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS mail_suppressions;
+DROP TABLE IF EXISTS mail_deliveries;
+DROP TABLE IF EXISTS mail_campaign_recipients;
+DROP TABLE IF EXISTS mail_campaigns;
+DROP TABLE IF EXISTS mail_outbox;
@@ -0,0 +1,6 @@
+-- Reset links used to be kept in the session token column, where any new
+-- login overwrote them. Links issued that way are dropped.
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS reset_token VARCHAR(64);
+ALTER TABLE user_table ADD COLUMN IF NOT EXISTS reset_expires_at TIMESTAMP;
+CREATE UNIQUE INDEX IF NOT EXISTS user_table_reset_token_idx ON user_table (reset_token);
+UPDATE user_table SET token = NULL WHERE token LIKE 'reset:%';
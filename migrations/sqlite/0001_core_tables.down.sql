@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS borrowings;
+DROP TABLE IF EXISTS books;
+DROP TABLE IF EXISTS user_table;
@@ -0,0 +1,30 @@
+-- SQLite databases are always created by the migrations, so the columns
+-- Postgres adds separately for hand-built schemas are part of the tables.
+CREATE TABLE IF NOT EXISTS user_table (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email VARCHAR(255),
+	username VARCHAR(255),
+	password VARCHAR(255),
+	isActivated BOOLEAN DEFAULT FALSE,
+	isadmin BOOLEAN NOT NULL DEFAULT FALSE,
+	confirmation VARCHAR(255),
+	token VARCHAR(255),
+	otp VARCHAR(255)
+);
+
+CREATE INDEX IF NOT EXISTS user_table_token_idx ON user_table (token);
+
+CREATE TABLE IF NOT EXISTS books (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	book_name VARCHAR(255) NOT NULL,
+	book_author VARCHAR(255) NOT NULL DEFAULT '',
+	book_genre VARCHAR(255) NOT NULL DEFAULT '',
+	book_date VARCHAR(32) NOT NULL DEFAULT '',
+	borrowed BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS borrowings (
+	book_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	borrowed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
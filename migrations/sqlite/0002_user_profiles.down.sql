@@ -0,0 +1,9 @@
+ALTER TABLE user_table DROP COLUMN email_holds;
+ALTER TABLE user_table DROP COLUMN email_reminders;
+ALTER TABLE user_table DROP COLUMN email_announcements;
+ALTER TABLE user_table DROP COLUMN deleted_at;
+ALTER TABLE user_table DROP COLUMN deletion_requested_at;
+ALTER TABLE user_table DROP COLUMN email_confirmation;
+ALTER TABLE user_table DROP COLUMN pending_email;
+ALTER TABLE user_table DROP COLUMN avatar;
+ALTER TABLE user_table DROP COLUMN display_name;
@@ -0,0 +1,9 @@
+ALTER TABLE user_table ADD COLUMN display_name VARCHAR(64);
+ALTER TABLE user_table ADD COLUMN avatar VARCHAR(255);
+ALTER TABLE user_table ADD COLUMN pending_email VARCHAR(255);
+ALTER TABLE user_table ADD COLUMN email_confirmation VARCHAR(255);
+ALTER TABLE user_table ADD COLUMN deletion_requested_at TIMESTAMP;
+ALTER TABLE user_table ADD COLUMN deleted_at TIMESTAMP;
+ALTER TABLE user_table ADD COLUMN email_announcements BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE user_table ADD COLUMN email_reminders BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE user_table ADD COLUMN email_holds BOOLEAN NOT NULL DEFAULT TRUE;
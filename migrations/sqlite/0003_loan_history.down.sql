@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS loan_reminders;
+
+CREATE TABLE borrowings_open (
+	book_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	borrowed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO borrowings_open (book_id, user_id, borrowed_at)
+	SELECT book_id, user_id, borrowed_at FROM borrowings WHERE user_id IS NOT NULL AND returned_at IS NULL;
+
+DROP TABLE borrowings;
+ALTER TABLE borrowings_open RENAME TO borrowings;
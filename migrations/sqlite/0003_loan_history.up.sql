@@ -0,0 +1,25 @@
+-- Borrowings are kept after return as loan history, and user_id becomes
+-- nullable so history survives account deletion. SQLite can't add a primary
+-- key or relax NOT NULL in place, so the table is rebuilt.
+CREATE TABLE borrowings_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	book_id INTEGER NOT NULL,
+	user_id INTEGER,
+	borrowed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	returned_at TIMESTAMP,
+	due_at TIMESTAMP
+);
+
+-- Loans made before due dates were tracked get the default loan period.
+INSERT INTO borrowings_history (book_id, user_id, borrowed_at, due_at)
+	SELECT book_id, user_id, borrowed_at, datetime(borrowed_at, '+14 days') FROM borrowings;
+
+DROP TABLE borrowings;
+ALTER TABLE borrowings_history RENAME TO borrowings;
+
+CREATE TABLE IF NOT EXISTS loan_reminders (
+	borrowing_id INTEGER NOT NULL,
+	kind VARCHAR(32) NOT NULL,
+	sent_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (borrowing_id, kind)
+);
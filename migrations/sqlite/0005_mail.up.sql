@@ -0,0 +1,66 @@
+CREATE TABLE IF NOT EXISTS mail_outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	recipients TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	text_body TEXT NOT NULL DEFAULT '',
+	html_body TEXT NOT NULL DEFAULT '',
+	status VARCHAR(16) NOT NULL DEFAULT 'queued',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	locked_at TIMESTAMP,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	sent_at TIMESTAMP,
+	headers TEXT NOT NULL DEFAULT '',
+	attachments TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS mail_outbox_pending_idx ON mail_outbox (status, next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS mail_campaigns (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	subject TEXT NOT NULL,
+	text_body TEXT NOT NULL DEFAULT '',
+	html_body TEXT NOT NULL DEFAULT '',
+	segment VARCHAR(32) NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'draft',
+	total INTEGER NOT NULL DEFAULT 0,
+	sent INTEGER NOT NULL DEFAULT 0,
+	failed INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	started_at TIMESTAMP,
+	finished_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS mail_campaign_recipients (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	campaign_id INTEGER NOT NULL REFERENCES mail_campaigns (id),
+	email VARCHAR(255) NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'pending',
+	error TEXT NOT NULL DEFAULT '',
+	sent_at TIMESTAMP,
+	UNIQUE (campaign_id, email)
+);
+
+CREATE INDEX IF NOT EXISTS mail_campaign_recipients_status_idx ON mail_campaign_recipients (campaign_id, status);
+
+CREATE TABLE IF NOT EXISTS mail_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	message_id VARCHAR(255) NOT NULL,
+	recipient VARCHAR(255) NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	detail TEXT NOT NULL DEFAULT '',
+	outbox_id INTEGER,
+	campaign_id INTEGER,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS mail_deliveries_message_idx ON mail_deliveries (message_id);
+CREATE INDEX IF NOT EXISTS mail_deliveries_recipient_idx ON mail_deliveries (recipient, created_at);
+
+CREATE TABLE IF NOT EXISTS mail_suppressions (
+	email VARCHAR(255) PRIMARY KEY,
+	reason TEXT NOT NULL DEFAULT '',
+	message_id VARCHAR(255) NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
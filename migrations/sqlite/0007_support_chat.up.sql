@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS chat_conversations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL UNIQUE,
+	admin_unread INTEGER NOT NULL DEFAULT 0,
+	member_unread INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_message_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS chat_messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	conversation_id INTEGER NOT NULL REFERENCES chat_conversations (id) ON DELETE CASCADE,
+	sender_id INTEGER,
+	from_admin BOOLEAN NOT NULL DEFAULT FALSE,
+	body TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS chat_messages_conversation_idx ON chat_messages (conversation_id, id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS user_table_reset_token_idx;
+ALTER TABLE user_table DROP COLUMN reset_expires_at;
+ALTER TABLE user_table DROP COLUMN reset_token;
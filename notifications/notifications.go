@@ -0,0 +1,184 @@
+package notifications
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"main.go/events"
+)
+
+var log = logrus.New()
+
+// Notification types.
+const (
+	Borrowed     = "borrowed"
+	Returned     = "returned"
+	DueSoon      = "due_soon"
+	Overdue      = "overdue"
+	HoldReady    = "hold_ready"
+	AdminMessage = "admin_message"
+)
+
+type Notification struct {
+	ID        int        `json:"id"`
+	Type      string     `json:"type"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	Link      string     `json:"link,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+func (n Notification) Unread() bool {
+	return n.ReadAt == nil
+}
+
+var ErrNotFound = errors.New("notification not found")
+
+// Notifier is what services send member notices through.
+type Notifier interface {
+	Create(userID int, notificationType, title, body, link string)
+	CreateForEmail(email string, notificationType, title, body, link string)
+}
+
+// Inbox is the Notifier backed by the notifications table.
+type Inbox struct {
+	db *sql.DB
+}
+
+func NewInbox(db *sql.DB) *Inbox {
+	return &Inbox{db: db}
+}
+
+// Create stores a notice in the member's inbox and pushes it, with the new
+// unread count, to any page they have open. Failures are logged rather
+// than returned: a missing notice should never fail the action behind it.
+func (i *Inbox) Create(userID int, notificationType, title, body, link string) {
+	n := Notification{Type: notificationType, Title: title, Body: body, Link: link, CreatedAt: time.Now().UTC()}
+
+	err := i.db.QueryRow("INSERT INTO notifications (user_id, type, title, body, link, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		userID, n.Type, n.Title, n.Body, n.Link, n.CreatedAt).Scan(&n.ID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Error creating notification")
+		return
+	}
+
+	publish(i.db, userID, &n)
+}
+
+// CreateForEmail is Create for callers that only know the member's email
+// address. Addresses that don't belong to a member are ignored.
+func (i *Inbox) CreateForEmail(email string, notificationType, title, body, link string) {
+	var userID int
+	err := i.db.QueryRow("SELECT id FROM user_table WHERE LOWER(email) = LOWER($1) AND deleted_at IS NULL", strings.TrimSpace(email)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("Error looking up notification recipient")
+		return
+	}
+	i.Create(userID, notificationType, title, body, link)
+}
+
+// publish tells the member's open pages about a new notice, or with nil
+// just that the unread count changed.
+func publish(db *sql.DB, userID int, n *Notification) {
+	unread, err := UnreadCount(db, userID)
+	if err != nil {
+		log.WithError(err).Error("Error counting unread notifications")
+		return
+	}
+	events.Publish(userID, events.Notification, map[string]interface{}{
+		"notification": n,
+		"unread":       unread,
+	})
+}
+
+// History returns every notice the member has received, oldest first, for
+// their data export.
+func (i *Inbox) History(userID int) ([]Notification, error) {
+	rows, err := i.db.Query("SELECT id, type, title, body, link, created_at, read_at FROM notifications WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading notifications: %s", err)
+	}
+	return scanNotifications(rows)
+}
+
+func List(db *sql.DB, userID int, limit int) ([]Notification, error) {
+	rows, err := db.Query("SELECT id, type, title, body, link, created_at, read_at FROM notifications WHERE user_id = $1 ORDER BY id DESC LIMIT $2", userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error loading notifications: %s", err)
+	}
+	return scanNotifications(rows)
+}
+
+func scanNotifications(rows *sql.Rows) ([]Notification, error) {
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var readAt sql.NullTime
+		if err := rows.Scan(&n.ID, &n.Type, &n.Title, &n.Body, &n.Link, &n.CreatedAt, &readAt); err != nil {
+			return nil, fmt.Errorf("error scanning notification: %s", err)
+		}
+		if readAt.Valid {
+			n.ReadAt = &readAt.Time
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func UnreadCount(db *sql.DB, userID int) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL", userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting unread notifications: %s", err)
+	}
+	return count, nil
+}
+
+// MarkRead marks one of the member's notices read. Marking a read notice
+// again is not an error.
+func MarkRead(db *sql.DB, userID int, id int) error {
+	result, err := db.Exec("UPDATE notifications SET read_at = COALESCE(read_at, $1) WHERE id = $2 AND user_id = $3", time.Now().UTC(), id, userID)
+	if err != nil {
+		return fmt.Errorf("error marking notification read: %s", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNotFound
+	}
+	publish(db, userID, nil)
+	return nil
+}
+
+func MarkAllRead(db *sql.DB, userID int) error {
+	_, err := db.Exec("UPDATE notifications SET read_at = $1 WHERE user_id = $2 AND read_at IS NULL", time.Now().UTC(), userID)
+	if err != nil {
+		return fmt.Errorf("error marking notifications read: %s", err)
+	}
+	publish(db, userID, nil)
+	return nil
+}
+
+func init() {
+	// Create or open the log file
+	file, err := os.OpenFile("logfile.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err == nil {
+		// Set the logrus output to the file
+		log.SetOutput(file)
+	} else {
+		// If unable to open the log file, log to standard output
+		log.Warn("Failed to open log file. Logging to standard output.")
+	}
+
+	log.SetFormatter(&logrus.JSONFormatter{})
+	log.SetLevel(logrus.InfoLevel)
+}
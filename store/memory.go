@@ -0,0 +1,451 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory implements every repository in process. It is safe for concurrent
+// use and is meant for tests.
+type Memory struct {
+	mu        sync.Mutex
+	users     map[int]User
+	books     map[int]Book
+	loans     map[int]Loan
+	reminders map[reminderKey]time.Time
+	nextUser  int
+	nextBook  int
+	nextLoan  int
+}
+
+type reminderKey struct {
+	loanID int
+	kind   string
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:     map[int]User{},
+		books:     map[int]Book{},
+		loans:     map[int]Loan{},
+		reminders: map[reminderKey]time.Time{},
+	}
+}
+
+// copyTime keeps callers from changing stored records through a pointer.
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func (u User) clone() User {
+	u.DeletionRequestedAt = copyTime(u.DeletionRequestedAt)
+	u.DeletedAt = copyTime(u.DeletedAt)
+	u.ResetExpiresAt = copyTime(u.ResetExpiresAt)
+	return u
+}
+
+func (l Loan) clone() Loan {
+	l.DueAt = copyTime(l.DueAt)
+	l.ReturnedAt = copyTime(l.ReturnedAt)
+	return l
+}
+
+// withBook fills in the book fields, which are read at query time in
+// the SQL store too.
+func (m *Memory) withBook(l Loan) Loan {
+	l = l.clone()
+	b := m.books[l.BookID]
+	l.BookName, l.BookAuthor, l.BookGenre = b.Name, b.Author, b.Genre
+	return l
+}
+
+func (m *Memory) CreateUser(u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextUser++
+	u.ID = m.nextUser
+	u.EmailAnnouncements, u.EmailReminders, u.EmailHolds = true, true, true
+	m.users[u.ID] = u.clone()
+	return nil
+}
+
+func (m *Memory) User(id int) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u.clone(), nil
+}
+
+func (m *Memory) findUser(match func(User) bool) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range m.userIDs() {
+		if u := m.users[id]; match(u) {
+			return u.clone(), nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *Memory) userIDs() []int {
+	ids := make([]int, 0, len(m.users))
+	for id := range m.users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (m *Memory) UserByEmail(email string) (User, error) {
+	return m.findUser(func(u User) bool {
+		return u.DeletedAt == nil && strings.EqualFold(u.Email, email)
+	})
+}
+
+func (m *Memory) UserByToken(token string) (User, error) {
+	return m.findUser(func(u User) bool {
+		return token != "" && u.DeletedAt == nil && u.Token == token
+	})
+}
+
+func (m *Memory) UserByResetToken(token string) (User, error) {
+	return m.findUser(func(u User) bool {
+		return token != "" && u.DeletedAt == nil && u.ResetToken == token
+	})
+}
+
+func (m *Memory) UserByConfirmation(code string) (User, error) {
+	return m.findUser(func(u User) bool {
+		return code != "" && u.Confirmation == code
+	})
+}
+
+func (m *Memory) UserByEmailConfirmation(code string) (User, error) {
+	return m.findUser(func(u User) bool {
+		return code != "" && u.EmailConfirmation == code
+	})
+}
+
+func (m *Memory) EmailTaken(email string, exceptID int) (bool, error) {
+	_, err := m.findUser(func(u User) bool {
+		return u.ID != exceptID && strings.EqualFold(u.Email, email)
+	})
+	return err == nil, nil
+}
+
+func (m *Memory) UsernameTaken(username string, exceptID int) (bool, error) {
+	_, err := m.findUser(func(u User) bool {
+		return u.ID != exceptID && strings.EqualFold(u.Username, username)
+	})
+	return err == nil, nil
+}
+
+func (m *Memory) UpdateUser(u User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[u.ID]; !ok {
+		return ErrNotFound
+	}
+	m.users[u.ID] = u.clone()
+	return nil
+}
+
+func (m *Memory) DeleteUser(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.users, id)
+	for loanID, l := range m.loans {
+		if l.UserID == id {
+			l.UserID = 0
+			m.loans[loanID] = l
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ListUsers(filter UserFilter) ([]UserSummary, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	search := strings.ToLower(filter.Search)
+	var matched []UserSummary
+	for _, id := range m.userIDs() {
+		u := m.users[id]
+		if u.DeletedAt != nil {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(u.Email), search) && !strings.Contains(strings.ToLower(u.Username), search) {
+			continue
+		}
+		if filter.Activated != nil && u.IsActivated != *filter.Activated {
+			continue
+		}
+		if filter.Admin != nil && u.IsAdmin != *filter.Admin {
+			continue
+		}
+
+		s := UserSummary{User: u.clone()}
+		for _, l := range m.loans {
+			if l.UserID != id || !l.Open() {
+				continue
+			}
+			s.OpenLoans++
+			if l.OverdueAt(filter.Now) {
+				s.OverdueLoans++
+			}
+		}
+		if filter.Overdue && s.OverdueLoans == 0 {
+			continue
+		}
+		matched = append(matched, s)
+	}
+
+	less := func(a, b UserSummary) bool { return a.ID < b.ID }
+	switch filter.Sort {
+	case "email":
+		less = func(a, b UserSummary) bool { return strings.ToLower(a.Email) < strings.ToLower(b.Email) }
+	case "username":
+		less = func(a, b UserSummary) bool { return strings.ToLower(a.Username) < strings.ToLower(b.Username) }
+	case "activated":
+		less = func(a, b UserSummary) bool { return !a.IsActivated && b.IsActivated }
+	case "admin":
+		less = func(a, b UserSummary) bool { return !a.IsAdmin && b.IsAdmin }
+	case "overdue":
+		less = func(a, b UserSummary) bool { return a.OverdueLoans < b.OverdueLoans }
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if filter.Desc {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+
+	return page(matched, filter.Limit, filter.Offset), len(matched), nil
+}
+
+func page[T any](items []T, limit int, offset int) []T {
+	if offset >= len(items) {
+		return nil
+	}
+	items = items[offset:]
+	if limit >= 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+func (m *Memory) DeletedUsers() ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var users []User
+	for _, id := range m.userIDs() {
+		if u := m.users[id]; u.DeletedAt != nil {
+			users = append(users, u.clone())
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool { return users[i].DeletedAt.After(*users[j].DeletedAt) })
+	return users, nil
+}
+
+func (m *Memory) DeletionRequests(before time.Time) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var users []User
+	for _, id := range m.userIDs() {
+		u := m.users[id]
+		if u.DeletionRequestedAt != nil && !u.DeletionRequestedAt.After(before) {
+			users = append(users, u.clone())
+		}
+	}
+	return users, nil
+}
+
+func (m *Memory) CreateBook(b *Book) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextBook++
+	b.ID = m.nextBook
+	m.books[b.ID] = *b
+	return nil
+}
+
+func (m *Memory) Book(id int) (Book, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.books[id]
+	if !ok {
+		return Book{}, ErrNotFound
+	}
+	return b, nil
+}
+
+func (m *Memory) filterBooks(filter BookFilter) []Book {
+	search := strings.ToLower(filter.Search)
+	var books []Book
+	for _, b := range m.books {
+		if filter.AvailableOnly && b.Borrowed {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(b.Name), search) &&
+			!strings.Contains(strings.ToLower(b.Author), search) && !strings.Contains(strings.ToLower(b.Genre), search) {
+			continue
+		}
+		books = append(books, b)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].ID < books[j].ID })
+	return books
+}
+
+func (m *Memory) ListBooks(filter BookFilter) ([]Book, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	books := m.filterBooks(filter)
+	key := map[string]func(Book) string{
+		"book_name":   func(b Book) string { return strings.ToLower(b.Name) },
+		"book_author": func(b Book) string { return strings.ToLower(b.Author) },
+		"book_genre":  func(b Book) string { return strings.ToLower(b.Genre) },
+		"book_date":   func(b Book) string { return b.Date },
+	}[filter.Sort]
+	if key != nil {
+		sort.SliceStable(books, func(i, j int) bool { return key(books[i]) < key(books[j]) })
+	}
+	return page(books, filter.Limit, filter.Offset), nil
+}
+
+func (m *Memory) CountBooks(filter BookFilter) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.filterBooks(filter)), nil
+}
+
+func (m *Memory) Borrow(bookID int, userID int, borrowedAt time.Time, dueAt time.Time) (Loan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.books[bookID]
+	if !ok {
+		return Loan{}, ErrNotFound
+	}
+	if b.Borrowed {
+		return Loan{}, ErrUnavailable
+	}
+	b.Borrowed = true
+	m.books[bookID] = b
+
+	m.nextLoan++
+	l := Loan{ID: m.nextLoan, BookID: bookID, UserID: userID, BorrowedAt: borrowedAt, DueAt: &dueAt}
+	m.loans[l.ID] = l.clone()
+	return m.withBook(l), nil
+}
+
+// sortedLoans returns the loans matching keep in the order the SQL store returns
+// them: by borrowing time, then id.
+func (m *Memory) sortedLoans(keep func(Loan) bool) []Loan {
+	var loans []Loan
+	for _, l := range m.loans {
+		if keep(l) {
+			loans = append(loans, m.withBook(l))
+		}
+	}
+	sort.Slice(loans, func(i, j int) bool {
+		if !loans[i].BorrowedAt.Equal(loans[j].BorrowedAt) {
+			return loans[i].BorrowedAt.Before(loans[j].BorrowedAt)
+		}
+		return loans[i].ID < loans[j].ID
+	})
+	return loans
+}
+
+func (m *Memory) Return(userID int, bookName string, returnedAt time.Time) (Loan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	open := m.sortedLoans(func(l Loan) bool {
+		return l.UserID == userID && l.Open() && m.books[l.BookID].Name == bookName
+	})
+	if len(open) == 0 {
+		return Loan{}, ErrNotFound
+	}
+
+	l := open[0]
+	l.ReturnedAt = &returnedAt
+	m.loans[l.ID] = l.clone()
+
+	b := m.books[l.BookID]
+	b.Borrowed = false
+	m.books[l.BookID] = b
+	return l, nil
+}
+
+func (m *Memory) Loans(userID int) ([]Loan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.sortedLoans(func(l Loan) bool { return userID != 0 && l.UserID == userID }), nil
+}
+
+func (m *Memory) OpenLoans(userID int) ([]Loan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.sortedLoans(func(l Loan) bool { return userID != 0 && l.UserID == userID && l.Open() }), nil
+}
+
+func (m *Memory) DueLoans(before time.Time) ([]Loan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	loans := m.sortedLoans(func(l Loan) bool {
+		return l.Open() && l.UserID != 0 && l.DueAt != nil && !l.DueAt.After(before)
+	})
+	sort.SliceStable(loans, func(i, j int) bool {
+		if loans[i].UserID != loans[j].UserID {
+			return loans[i].UserID < loans[j].UserID
+		}
+		return loans[i].DueAt.Before(*loans[j].DueAt)
+	})
+	return loans, nil
+}
+
+func (m *Memory) ClaimReminder(loanID int, kind string, sentAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := reminderKey{loanID, kind}
+	if _, ok := m.reminders[key]; ok {
+		return false, nil
+	}
+	m.reminders[key] = sentAt
+	return true, nil
+}
+
+func (m *Memory) ReleaseReminder(loanID int, kind string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.reminders, reminderKey{loanID, kind})
+	return nil
+}
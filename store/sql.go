@@ -0,0 +1,537 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQL implements every repository on one database. Its queries run on both
+// Postgres and SQLite.
+type SQL struct {
+	db *sql.DB
+}
+
+func NewSQL(db *sql.DB) *SQL {
+	return &SQL{db: db}
+}
+
+const userColumns = `id, COALESCE(email, ''), COALESCE(username, ''), COALESCE(display_name, ''), COALESCE(password, ''),
+	COALESCE(confirmation, ''), COALESCE(token, ''), COALESCE(otp, ''), COALESCE(isactivated, FALSE), isadmin,
+	COALESCE(avatar, ''), COALESCE(pending_email, ''), COALESCE(email_confirmation, ''), deletion_requested_at, deleted_at,
+	email_announcements, email_reminders, email_holds, COALESCE(reset_token, ''), reset_expires_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row scanner) (User, error) {
+	var u User
+	var deletionRequestedAt, deletedAt, resetExpiresAt sql.NullTime
+	err := row.Scan(&u.ID, &u.Email, &u.Username, &u.DisplayName, &u.PasswordHash,
+		&u.Confirmation, &u.Token, &u.OTP, &u.IsActivated, &u.IsAdmin,
+		&u.Avatar, &u.PendingEmail, &u.EmailConfirmation, &deletionRequestedAt, &deletedAt,
+		&u.EmailAnnouncements, &u.EmailReminders, &u.EmailHolds, &u.ResetToken, &resetExpiresAt)
+	if err != nil {
+		return u, err
+	}
+	u.DeletionRequestedAt = nullTime(deletionRequestedAt)
+	u.DeletedAt = nullTime(deletedAt)
+	u.ResetExpiresAt = nullTime(resetExpiresAt)
+	return u, nil
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// nullString stores empty strings as NULL, which is what the columns held
+// before the repositories existed.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (p *SQL) findUser(where string, args ...interface{}) (User, error) {
+	u, err := scanUser(p.db.QueryRow("SELECT "+userColumns+" FROM user_table WHERE "+where, args...))
+	if err == sql.ErrNoRows {
+		return u, ErrNotFound
+	}
+	if err != nil {
+		return u, fmt.Errorf("error retrieving user: %s", err)
+	}
+	return u, nil
+}
+
+func (p *SQL) findUsers(where string, args ...interface{}) ([]User, error) {
+	rows, err := p.db.Query("SELECT "+userColumns+" FROM user_table WHERE "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving users: %s", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning user: %s", err)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (p *SQL) CreateUser(u *User) error {
+	err := p.db.QueryRow("INSERT INTO user_table (email, username, password, confirmation, token, isactivated, isadmin) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		u.Email, u.Username, u.PasswordHash, nullString(u.Confirmation), nullString(u.Token), u.IsActivated, u.IsAdmin).Scan(&u.ID)
+	if err != nil {
+		return fmt.Errorf("error inserting user into database: %s", err)
+	}
+
+	// Preferences default to opted in; read them back rather than assume.
+	created, err := p.User(u.ID)
+	if err != nil {
+		return err
+	}
+	*u = created
+	return nil
+}
+
+func (p *SQL) User(id int) (User, error) {
+	return p.findUser("id = $1", id)
+}
+
+func (p *SQL) UserByEmail(email string) (User, error) {
+	return p.findUser("LOWER(email) = LOWER($1) AND deleted_at IS NULL", email)
+}
+
+func (p *SQL) UserByToken(token string) (User, error) {
+	if token == "" {
+		return User{}, ErrNotFound
+	}
+	return p.findUser("token = $1 AND deleted_at IS NULL", token)
+}
+
+func (p *SQL) UserByResetToken(token string) (User, error) {
+	if token == "" {
+		return User{}, ErrNotFound
+	}
+	return p.findUser("reset_token = $1 AND deleted_at IS NULL", token)
+}
+
+func (p *SQL) UserByConfirmation(code string) (User, error) {
+	if code == "" {
+		return User{}, ErrNotFound
+	}
+	return p.findUser("confirmation = $1", code)
+}
+
+func (p *SQL) UserByEmailConfirmation(code string) (User, error) {
+	if code == "" {
+		return User{}, ErrNotFound
+	}
+	return p.findUser("email_confirmation = $1", code)
+}
+
+func (p *SQL) taken(column string, value string, exceptID int) (bool, error) {
+	var count int
+	err := p.db.QueryRow("SELECT COUNT(*) FROM user_table WHERE LOWER("+column+") = LOWER($1) AND id <> $2", value, exceptID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error checking %s uniqueness: %s", column, err)
+	}
+	return count > 0, nil
+}
+
+func (p *SQL) EmailTaken(email string, exceptID int) (bool, error) {
+	return p.taken("email", email, exceptID)
+}
+
+func (p *SQL) UsernameTaken(username string, exceptID int) (bool, error) {
+	return p.taken("username", username, exceptID)
+}
+
+func (p *SQL) UpdateUser(u User) error {
+	result, err := p.db.Exec(`UPDATE user_table SET email = $1, username = $2, display_name = $3, password = $4,
+		confirmation = $5, token = $6, otp = $7, isactivated = $8, isadmin = $9,
+		avatar = $10, pending_email = $11, email_confirmation = $12, deletion_requested_at = $13, deleted_at = $14,
+		email_announcements = $15, email_reminders = $16, email_holds = $17, reset_token = $18, reset_expires_at = $19
+		WHERE id = $20`,
+		u.Email, u.Username, nullString(u.DisplayName), u.PasswordHash,
+		nullString(u.Confirmation), nullString(u.Token), nullString(u.OTP), u.IsActivated, u.IsAdmin,
+		nullString(u.Avatar), nullString(u.PendingEmail), nullString(u.EmailConfirmation), u.DeletionRequestedAt, u.DeletedAt,
+		u.EmailAnnouncements, u.EmailReminders, u.EmailHolds, nullString(u.ResetToken), u.ResetExpiresAt,
+		u.ID)
+	if err != nil {
+		return fmt.Errorf("error updating user: %s", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (p *SQL) DeleteUser(id int) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error deleting user: %s", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE borrowings SET user_id = NULL WHERE user_id = $1", id)
+	if err != nil {
+		return fmt.Errorf("error anonymizing borrowings: %s", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM notifications WHERE user_id = $1", id)
+	if err != nil {
+		return fmt.Errorf("error deleting notifications: %s", err)
+	}
+
+	// The conversation goes with its messages, so a new account that is
+	// given the same id starts with an empty chat. Replies the user sent as
+	// an admin stay in other members' conversations without a sender.
+	_, err = tx.Exec("DELETE FROM chat_messages WHERE conversation_id IN (SELECT id FROM chat_conversations WHERE user_id = $1)", id)
+	if err != nil {
+		return fmt.Errorf("error deleting chat messages: %s", err)
+	}
+	_, err = tx.Exec("DELETE FROM chat_conversations WHERE user_id = $1", id)
+	if err != nil {
+		return fmt.Errorf("error deleting chat conversation: %s", err)
+	}
+	_, err = tx.Exec("UPDATE chat_messages SET sender_id = NULL WHERE sender_id = $1", id)
+	if err != nil {
+		return fmt.Errorf("error anonymizing chat replies: %s", err)
+	}
+
+	result, err := tx.Exec("DELETE FROM user_table WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("error deleting user: %s", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNotFound
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error deleting user: %s", err)
+	}
+	return nil
+}
+
+// userSortColumns whitelists the columns the user list can be sorted by.
+var userSortColumns = map[string]string{
+	"id":        "u.id",
+	"email":     "LOWER(u.email)",
+	"username":  "LOWER(u.username)",
+	"activated": "u.isactivated",
+	"admin":     "u.isadmin",
+	"overdue":   "overdue_loans",
+}
+
+func (p *SQL) ListUsers(filter UserFilter) ([]UserSummary, int, error) {
+	var args []interface{}
+	param := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := []string{"u.deleted_at IS NULL"}
+	if filter.Search != "" {
+		search := param("%" + strings.ToLower(filter.Search) + "%")
+		where = append(where, "(LOWER(u.email) LIKE "+search+" OR LOWER(u.username) LIKE "+search+")")
+	}
+	if filter.Activated != nil {
+		where = append(where, "u.isactivated = "+param(*filter.Activated))
+	}
+	if filter.Admin != nil {
+		where = append(where, "u.isadmin = "+param(*filter.Admin))
+	}
+	if filter.Overdue {
+		where = append(where, "EXISTS (SELECT 1 FROM borrowings b WHERE b.user_id = u.id AND b.returned_at IS NULL AND b.due_at < "+param(filter.Now)+")")
+	}
+	conditions := strings.Join(where, " AND ")
+
+	var total int
+	err := p.db.QueryRow("SELECT COUNT(*) FROM user_table u WHERE "+conditions, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting users: %s", err)
+	}
+
+	order, ok := userSortColumns[filter.Sort]
+	if !ok {
+		order = userSortColumns["id"]
+	}
+	if filter.Desc {
+		order += " DESC"
+	}
+
+	// Build the statement before passing args: param appends to it.
+	statement := `SELECT ` + userColumns + `,
+			(SELECT COUNT(*) FROM borrowings b WHERE b.user_id = u.id AND b.returned_at IS NULL) AS open_loans,
+			(SELECT COUNT(*) FROM borrowings b WHERE b.user_id = u.id AND b.returned_at IS NULL AND b.due_at < ` + param(filter.Now) + `) AS overdue_loans
+		FROM user_table u
+		WHERE ` + conditions + `
+		ORDER BY ` + order + `, u.id
+		LIMIT ` + param(filter.Limit) + ` OFFSET ` + param(filter.Offset)
+
+	rows, err := p.db.Query(statement, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error querying users: %s", err)
+	}
+	defer rows.Close()
+
+	var users []UserSummary
+	for rows.Next() {
+		var s UserSummary
+		var deletionRequestedAt, deletedAt, resetExpiresAt sql.NullTime
+		err := rows.Scan(&s.ID, &s.Email, &s.Username, &s.DisplayName, &s.PasswordHash,
+			&s.Confirmation, &s.Token, &s.OTP, &s.IsActivated, &s.IsAdmin,
+			&s.Avatar, &s.PendingEmail, &s.EmailConfirmation, &deletionRequestedAt, &deletedAt,
+			&s.EmailAnnouncements, &s.EmailReminders, &s.EmailHolds, &s.ResetToken, &resetExpiresAt,
+			&s.OpenLoans, &s.OverdueLoans)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error scanning user: %s", err)
+		}
+		s.DeletionRequestedAt = nullTime(deletionRequestedAt)
+		s.DeletedAt = nullTime(deletedAt)
+		s.ResetExpiresAt = nullTime(resetExpiresAt)
+		users = append(users, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error querying users: %s", err)
+	}
+
+	return users, total, nil
+}
+
+func (p *SQL) DeletedUsers() ([]User, error) {
+	return p.findUsers("deleted_at IS NOT NULL ORDER BY deleted_at DESC")
+}
+
+func (p *SQL) DeletionRequests(before time.Time) ([]User, error) {
+	return p.findUsers("deletion_requested_at IS NOT NULL AND deletion_requested_at <= $1 ORDER BY id", before)
+}
+
+const bookColumns = "id, book_name, COALESCE(book_author, ''), COALESCE(book_genre, ''), COALESCE(book_date, ''), borrowed"
+
+func scanBook(row scanner) (Book, error) {
+	var b Book
+	err := row.Scan(&b.ID, &b.Name, &b.Author, &b.Genre, &b.Date, &b.Borrowed)
+	return b, err
+}
+
+func (p *SQL) CreateBook(b *Book) error {
+	err := p.db.QueryRow("INSERT INTO books (book_name, book_author, book_genre, book_date, borrowed) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		b.Name, b.Author, b.Genre, b.Date, b.Borrowed).Scan(&b.ID)
+	if err != nil {
+		return fmt.Errorf("error inserting book: %s", err)
+	}
+	return nil
+}
+
+func (p *SQL) Book(id int) (Book, error) {
+	b, err := scanBook(p.db.QueryRow("SELECT "+bookColumns+" FROM books WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return b, ErrNotFound
+	}
+	if err != nil {
+		return b, fmt.Errorf("error retrieving book: %s", err)
+	}
+	return b, nil
+}
+
+// bookSortColumns whitelists the columns the catalogue can be sorted by.
+var bookSortColumns = map[string]string{
+	"book_name":   "LOWER(book_name)",
+	"book_author": "LOWER(book_author)",
+	"book_genre":  "LOWER(book_genre)",
+	"book_date":   "book_date",
+}
+
+func bookConditions(filter BookFilter) (string, []interface{}) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if filter.AvailableOnly {
+		where = append(where, "borrowed = FALSE")
+	}
+	if filter.Search != "" {
+		args = append(args, "%"+strings.ToLower(filter.Search)+"%")
+		where = append(where, "(LOWER(book_name) LIKE $1 OR LOWER(book_author) LIKE $1 OR LOWER(book_genre) LIKE $1)")
+	}
+	return strings.Join(where, " AND "), args
+}
+
+func (p *SQL) ListBooks(filter BookFilter) ([]Book, error) {
+	conditions, args := bookConditions(filter)
+
+	order := "id"
+	if column, ok := bookSortColumns[filter.Sort]; ok {
+		order = column + ", id"
+	}
+	args = append(args, filter.Limit, filter.Offset)
+	statement := fmt.Sprintf("SELECT %s FROM books WHERE %s ORDER BY %s LIMIT $%d OFFSET $%d", bookColumns, conditions, order, len(args)-1, len(args))
+
+	rows, err := p.db.Query(statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying books: %s", err)
+	}
+	defer rows.Close()
+
+	var books []Book
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning book: %s", err)
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+func (p *SQL) CountBooks(filter BookFilter) (int, error) {
+	conditions, args := bookConditions(filter)
+
+	var count int
+	err := p.db.QueryRow("SELECT COUNT(*) FROM books WHERE "+conditions, args...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting books: %s", err)
+	}
+	return count, nil
+}
+
+const loanColumns = `b.id, b.book_id, COALESCE(b.user_id, 0), k.book_name, COALESCE(k.book_author, ''), COALESCE(k.book_genre, ''),
+	b.borrowed_at, b.due_at, b.returned_at
+	FROM borrowings b JOIN books k ON k.id = b.book_id`
+
+func scanLoan(row scanner) (Loan, error) {
+	var l Loan
+	var dueAt, returnedAt sql.NullTime
+	err := row.Scan(&l.ID, &l.BookID, &l.UserID, &l.BookName, &l.BookAuthor, &l.BookGenre, &l.BorrowedAt, &dueAt, &returnedAt)
+	l.DueAt = nullTime(dueAt)
+	l.ReturnedAt = nullTime(returnedAt)
+	return l, err
+}
+
+func (p *SQL) findLoans(where string, args ...interface{}) ([]Loan, error) {
+	rows, err := p.db.Query("SELECT "+loanColumns+" WHERE "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving loans: %s", err)
+	}
+	defer rows.Close()
+
+	var loans []Loan
+	for rows.Next() {
+		l, err := scanLoan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning loan: %s", err)
+		}
+		loans = append(loans, l)
+	}
+	return loans, rows.Err()
+}
+
+func (p *SQL) Borrow(bookID int, userID int, borrowedAt time.Time, dueAt time.Time) (Loan, error) {
+	loan := Loan{BookID: bookID, UserID: userID, BorrowedAt: borrowedAt, DueAt: &dueAt}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return loan, fmt.Errorf("error borrowing book: %s", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("UPDATE books SET borrowed = TRUE WHERE id = $1 AND borrowed = FALSE RETURNING book_name, COALESCE(book_author, ''), COALESCE(book_genre, '')", bookID).
+		Scan(&loan.BookName, &loan.BookAuthor, &loan.BookGenre)
+	if err == sql.ErrNoRows {
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM books WHERE id = $1)", bookID).Scan(&exists)
+		if err == nil && !exists {
+			return loan, ErrNotFound
+		}
+		if err == nil {
+			return loan, ErrUnavailable
+		}
+	}
+	if err != nil {
+		return loan, fmt.Errorf("error borrowing book: %s", err)
+	}
+
+	err = tx.QueryRow("INSERT INTO borrowings (book_id, user_id, borrowed_at, due_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		bookID, userID, borrowedAt, dueAt).Scan(&loan.ID)
+	if err != nil {
+		return loan, fmt.Errorf("error recording loan: %s", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return loan, fmt.Errorf("error borrowing book: %s", err)
+	}
+	return loan, nil
+}
+
+func (p *SQL) Return(userID int, bookName string, returnedAt time.Time) (Loan, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return Loan{}, fmt.Errorf("error returning book: %s", err)
+	}
+	defer tx.Rollback()
+
+	loan, err := scanLoan(tx.QueryRow("SELECT "+loanColumns+" WHERE k.book_name = $1 AND b.user_id = $2 AND b.returned_at IS NULL ORDER BY b.borrowed_at LIMIT 1", bookName, userID))
+	if err == sql.ErrNoRows {
+		return loan, ErrNotFound
+	}
+	if err != nil {
+		return loan, fmt.Errorf("error retrieving loan: %s", err)
+	}
+
+	_, err = tx.Exec("UPDATE borrowings SET returned_at = $1 WHERE id = $2", returnedAt, loan.ID)
+	if err != nil {
+		return loan, fmt.Errorf("error closing loan: %s", err)
+	}
+	_, err = tx.Exec("UPDATE books SET borrowed = FALSE WHERE id = $1", loan.BookID)
+	if err != nil {
+		return loan, fmt.Errorf("error returning book: %s", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return loan, fmt.Errorf("error returning book: %s", err)
+	}
+	loan.ReturnedAt = &returnedAt
+	return loan, nil
+}
+
+func (p *SQL) Loans(userID int) ([]Loan, error) {
+	return p.findLoans("b.user_id = $1 ORDER BY b.borrowed_at, b.id", userID)
+}
+
+func (p *SQL) OpenLoans(userID int) ([]Loan, error) {
+	return p.findLoans("b.user_id = $1 AND b.returned_at IS NULL ORDER BY b.borrowed_at, b.id", userID)
+}
+
+func (p *SQL) DueLoans(before time.Time) ([]Loan, error) {
+	return p.findLoans("b.returned_at IS NULL AND b.user_id IS NOT NULL AND b.due_at IS NOT NULL AND b.due_at <= $1 ORDER BY b.user_id, b.due_at", before)
+}
+
+func (p *SQL) ClaimReminder(loanID int, kind string, sentAt time.Time) (bool, error) {
+	result, err := p.db.Exec("INSERT INTO loan_reminders (borrowing_id, kind, sent_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", loanID, kind, sentAt)
+	if err != nil {
+		return false, fmt.Errorf("error recording loan reminder: %s", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+func (p *SQL) ReleaseReminder(loanID int, kind string) error {
+	_, err := p.db.Exec("DELETE FROM loan_reminders WHERE borrowing_id = $1 AND kind = $2", loanID, kind)
+	if err != nil {
+		return fmt.Errorf("error releasing loan reminder: %s", err)
+	}
+	return nil
+}
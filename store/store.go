@@ -0,0 +1,154 @@
+// Package store defines the repositories the users and books services keep
+// their records in. SQL backs the server on Postgres or SQLite; Memory keeps
+// everything in process so the services can be tested without a database.
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("record not found")
+	ErrUnavailable = errors.New("book is already borrowed")
+)
+
+// User is one row of the user table. Empty strings stand for NULL columns.
+type User struct {
+	ID                  int
+	Email               string
+	Username            string
+	DisplayName         string
+	PasswordHash        string
+	Confirmation        string
+	Token               string
+	OTP                 string
+	IsActivated         bool
+	IsAdmin             bool
+	Avatar              string
+	PendingEmail        string
+	EmailConfirmation   string
+	DeletionRequestedAt *time.Time
+	DeletedAt           *time.Time
+	EmailAnnouncements  bool
+	EmailReminders      bool
+	EmailHolds          bool
+	ResetToken          string // hash of a pending password reset link
+	ResetExpiresAt      *time.Time
+}
+
+// UserFilter selects a page of the admin user list. Trashed users are never
+// included.
+type UserFilter struct {
+	Search    string // matched against email and username
+	Activated *bool
+	Admin     *bool
+	Overdue   bool   // only users with an overdue loan
+	Sort      string // "id", "email", "username", "activated", "admin" or "overdue"
+	Desc      bool
+	Limit     int
+	Offset    int
+	Now       time.Time // what counts as overdue
+}
+
+// UserSummary is a user list row with their loan counts.
+type UserSummary struct {
+	User
+	OpenLoans    int
+	OverdueLoans int
+}
+
+type UserRepository interface {
+	// CreateUser inserts u and sets its ID.
+	CreateUser(u *User) error
+	User(id int) (User, error)
+	// UserByEmail matches case-insensitively and skips trashed users.
+	UserByEmail(email string) (User, error)
+	// UserByToken finds the user with this session token, skipping trashed
+	// users.
+	UserByToken(token string) (User, error)
+	// UserByResetToken finds the user with this pending password reset,
+	// skipping trashed users. Whether it has expired is up to the caller.
+	UserByResetToken(token string) (User, error)
+	UserByConfirmation(code string) (User, error)
+	UserByEmailConfirmation(code string) (User, error)
+	// EmailTaken and UsernameTaken compare case-insensitively against every
+	// user except exceptID, trashed ones included.
+	EmailTaken(email string, exceptID int) (bool, error)
+	UsernameTaken(username string, exceptID int) (bool, error)
+	UpdateUser(u User) error
+	// DeleteUser removes the user for good, along with their notifications
+	// and support chat, detaching their borrowing history so loan statistics
+	// are kept without pointing at a person.
+	DeleteUser(id int) error
+	ListUsers(filter UserFilter) ([]UserSummary, int, error)
+	// DeletedUsers returns the trash, most recently deleted first.
+	DeletedUsers() ([]User, error)
+	DeletionRequests(before time.Time) ([]User, error)
+}
+
+type Book struct {
+	ID       int
+	Name     string
+	Author   string
+	Genre    string
+	Date     string
+	Borrowed bool
+}
+
+type BookFilter struct {
+	Search        string // matched against name, author and genre
+	AvailableOnly bool
+	Sort          string // "book_name", "book_author", "book_genre" or "book_date"; by id otherwise
+	Limit         int
+	Offset        int
+}
+
+type BookRepository interface {
+	// CreateBook inserts b and sets its ID.
+	CreateBook(b *Book) error
+	Book(id int) (Book, error)
+	ListBooks(filter BookFilter) ([]Book, error)
+	// CountBooks ignores the filter's sort and paging.
+	CountBooks(filter BookFilter) (int, error)
+}
+
+// Loan is a borrowing with the book it is for. UserID is 0 once the
+// borrower's account has been deleted.
+type Loan struct {
+	ID         int
+	BookID     int
+	UserID     int
+	BookName   string
+	BookAuthor string
+	BookGenre  string
+	BorrowedAt time.Time
+	DueAt      *time.Time
+	ReturnedAt *time.Time
+}
+
+func (l Loan) Open() bool {
+	return l.ReturnedAt == nil
+}
+
+func (l Loan) OverdueAt(now time.Time) bool {
+	return l.Open() && l.DueAt != nil && l.DueAt.Before(now)
+}
+
+type BorrowingRepository interface {
+	// Borrow records the loan and marks the book borrowed, failing with
+	// ErrUnavailable if someone else has it.
+	Borrow(bookID int, userID int, borrowedAt time.Time, dueAt time.Time) (Loan, error)
+	// Return closes the user's open loan of the named book and makes the
+	// book available again.
+	Return(userID int, bookName string, returnedAt time.Time) (Loan, error)
+	// Loans returns the user's loan history, oldest first.
+	Loans(userID int) ([]Loan, error)
+	OpenLoans(userID int) ([]Loan, error)
+	// DueLoans returns open loans due by the given time, grouped by user.
+	DueLoans(before time.Time) ([]Loan, error)
+	// ClaimReminder records that a reminder went out for a loan and reports
+	// false if it had been recorded already.
+	ClaimReminder(loanID int, kind string, sentAt time.Time) (bool, error)
+	ReleaseReminder(loanID int, kind string) error
+}
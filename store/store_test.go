@@ -0,0 +1,294 @@
+package store
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/glebarez/go-sqlite"
+	_ "github.com/lib/pq"
+
+	"main.go/migrations"
+)
+
+// repositories is what every implementation provides.
+type repositories interface {
+	UserRepository
+	BookRepository
+	BorrowingRepository
+}
+
+func TestMemory(t *testing.T) {
+	testRepositories(t, func(t *testing.T) repositories { return NewMemory() })
+}
+
+// TestPostgres runs the same checks against the database in TEST_CONN_STR.
+// Every table the store uses is emptied first.
+func TestPostgres(t *testing.T) {
+	connStr := os.Getenv("TEST_CONN_STR")
+	if connStr == "" {
+		t.Skip("TEST_CONN_STR is not set")
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := migrations.Up(db, "postgres"); err != nil {
+		t.Fatal(err)
+	}
+
+	testRepositories(t, func(t *testing.T) repositories {
+		_, err := db.Exec("TRUNCATE user_table, books, borrowings, loan_reminders RESTART IDENTITY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewSQL(db)
+	})
+}
+
+// TestSQLite runs the same checks against a fresh SQLite file per subtest.
+func TestSQLite(t *testing.T) {
+	testRepositories(t, func(t *testing.T) repositories {
+		return NewSQL(openSQLite(t))
+	})
+}
+
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "library.db")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrations.Up(db, "sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestSQLDeleteUserRemovesPersonalData checks the tables only the SQL store
+// has: a deleted user's notifications and chat go with them.
+func TestSQLDeleteUserRemovesPersonalData(t *testing.T) {
+	db := openSQLite(t)
+	r := NewSQL(db)
+
+	// The deleted user is an admin who also asked for help themselves.
+	leaving := User{Email: "admin@example.com", Username: "admin", IsAdmin: true}
+	other := User{Email: "bob@example.com", Username: "bob"}
+	for _, u := range []*User{&leaving, &other} {
+		if err := r.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, statement := range []string{
+		"INSERT INTO notifications (user_id, type, title) VALUES ($1, 'borrowed', 'You borrowed Emma')",
+		"INSERT INTO chat_conversations (id, user_id) VALUES (10, $1)",
+		"INSERT INTO chat_messages (conversation_id, sender_id, body) VALUES (10, $1, 'Hello')",
+	} {
+		if _, err := db.Exec(statement, leaving.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO chat_conversations (id, user_id) VALUES (20, $1)", other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO chat_messages (conversation_id, sender_id, from_admin, body) VALUES (20, $1, TRUE, 'Hi')", leaving.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.DeleteUser(leaving.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for query, want := range map[string]int{
+		"SELECT COUNT(*) FROM notifications":                            0,
+		"SELECT COUNT(*) FROM chat_conversations":                       1,
+		"SELECT COUNT(*) FROM chat_messages WHERE conversation_id = 10": 0,
+		"SELECT COUNT(*) FROM chat_messages WHERE sender_id IS NULL":    1,
+		"SELECT COUNT(*) FROM chat_messages WHERE conversation_id = 20": 1,
+	} {
+		var got int
+		if err := db.QueryRow(query).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s = %d, want %d", query, got, want)
+		}
+	}
+}
+
+func testRepositories(t *testing.T, open func(t *testing.T) repositories) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("users", func(t *testing.T) {
+		r := open(t)
+
+		u := User{Email: "Ada@example.com", Username: "ada", PasswordHash: "hash", Confirmation: "code"}
+		if err := r.CreateUser(&u); err != nil {
+			t.Fatal(err)
+		}
+		if u.ID == 0 || !u.EmailReminders {
+			t.Fatalf("created user = %+v", u)
+		}
+
+		found, err := r.UserByEmail("ada@EXAMPLE.com")
+		if err != nil || found.ID != u.ID {
+			t.Fatalf("UserByEmail = %+v, %v", found, err)
+		}
+		if _, err := r.UserByConfirmation("code"); err != nil {
+			t.Errorf("UserByConfirmation: %v", err)
+		}
+		if _, err := r.UserByToken(""); err != ErrNotFound {
+			t.Errorf("UserByToken with no token = %v, want ErrNotFound", err)
+		}
+		if _, err := r.UserByResetToken(""); err != ErrNotFound {
+			t.Errorf("UserByResetToken with no token = %v, want ErrNotFound", err)
+		}
+
+		expires := now.Add(time.Hour)
+		found.Token = "session"
+		found.ResetToken = "reset"
+		found.ResetExpiresAt = &expires
+		if err := r.UpdateUser(found); err != nil {
+			t.Fatal(err)
+		}
+		reset, err := r.UserByResetToken("reset")
+		if err != nil || reset.ID != u.ID || reset.Token != "session" || reset.ResetExpiresAt == nil || !reset.ResetExpiresAt.Equal(expires) {
+			t.Errorf("UserByResetToken = %+v, %v", reset, err)
+		}
+		if _, err := r.UserByToken("reset"); err != ErrNotFound {
+			t.Errorf("UserByToken with a reset token = %v, want ErrNotFound", err)
+		}
+
+		taken, _ := r.UsernameTaken("ADA", 0)
+		if !taken {
+			t.Error("username should be taken")
+		}
+		taken, _ = r.UsernameTaken("ada", u.ID)
+		if taken {
+			t.Error("username should not count against its own user")
+		}
+
+		deleted := now
+		found.Token = "session"
+		found.DeletedAt = &deleted
+		if err := r.UpdateUser(found); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.UserByToken("session"); err != ErrNotFound {
+			t.Errorf("UserByToken for trashed user = %v, want ErrNotFound", err)
+		}
+		if _, err := r.UserByResetToken("reset"); err != ErrNotFound {
+			t.Errorf("UserByResetToken for trashed user = %v, want ErrNotFound", err)
+		}
+		trash, _ := r.DeletedUsers()
+		if len(trash) != 1 || trash[0].ID != u.ID {
+			t.Errorf("DeletedUsers = %+v", trash)
+		}
+
+		if err := r.DeleteUser(u.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.User(u.ID); err != ErrNotFound {
+			t.Errorf("User after delete = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("loans", func(t *testing.T) {
+		r := open(t)
+
+		u := User{Email: "bob@example.com", Username: "bob"}
+		if err := r.CreateUser(&u); err != nil {
+			t.Fatal(err)
+		}
+		b := Book{Name: "Dune", Author: "Herbert", Genre: "Science fiction", Date: "1965"}
+		if err := r.CreateBook(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		loan, err := r.Borrow(b.ID, u.ID, now, now.AddDate(0, 0, 14))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loan.BookName != "Dune" || !loan.Open() {
+			t.Errorf("loan = %+v", loan)
+		}
+		if _, err := r.Borrow(b.ID, u.ID, now, now); err != ErrUnavailable {
+			t.Errorf("second Borrow = %v, want ErrUnavailable", err)
+		}
+		if _, err := r.Borrow(b.ID+100, u.ID, now, now); err != ErrNotFound {
+			t.Errorf("Borrow of missing book = %v, want ErrNotFound", err)
+		}
+
+		available, _ := r.CountBooks(BookFilter{AvailableOnly: true})
+		if available != 0 {
+			t.Errorf("available books = %d, want 0", available)
+		}
+
+		users, total, err := r.ListUsers(UserFilter{Overdue: true, Limit: 10, Now: now.AddDate(0, 1, 0)})
+		if err != nil || total != 1 || users[0].OverdueLoans != 1 {
+			t.Errorf("overdue users = %+v, %d, %v", users, total, err)
+		}
+
+		due, _ := r.DueLoans(now.AddDate(0, 0, 14))
+		if len(due) != 1 {
+			t.Fatalf("DueLoans = %+v", due)
+		}
+		claimed, _ := r.ClaimReminder(due[0].ID, "due", now)
+		again, _ := r.ClaimReminder(due[0].ID, "due", now)
+		if !claimed || again {
+			t.Errorf("ClaimReminder = %v then %v, want true then false", claimed, again)
+		}
+
+		if _, err := r.Return(u.ID, "Dune", now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Return(u.ID, "Dune", now.Add(time.Hour)); err != ErrNotFound {
+			t.Errorf("second Return = %v, want ErrNotFound", err)
+		}
+		book, _ := r.Book(b.ID)
+		if book.Borrowed {
+			t.Error("book is still borrowed after return")
+		}
+
+		if err := r.DeleteUser(u.ID); err != nil {
+			t.Fatal(err)
+		}
+		history, _ := r.Loans(0)
+		if len(history) != 0 {
+			t.Errorf("Loans(0) = %+v; detached loans should not belong to anyone", history)
+		}
+	})
+
+	t.Run("books", func(t *testing.T) {
+		r := open(t)
+
+		for _, b := range []Book{
+			{Name: "Emma", Author: "Austen", Genre: "Novel"},
+			{Name: "Beloved", Author: "Morrison", Genre: "Novel"},
+			{Name: "Cosmos", Author: "Sagan", Genre: "Science"},
+		} {
+			if err := r.CreateBook(&b); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		books, err := r.ListBooks(BookFilter{Search: "novel", Sort: "book_name", Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(books) != 2 || books[0].Name != "Beloved" || books[1].Name != "Emma" {
+			t.Errorf("books = %+v", books)
+		}
+
+		books, _ = r.ListBooks(BookFilter{Sort: "'; DROP TABLE books; --", Limit: 1, Offset: 1})
+		if len(books) != 1 || books[0].Name != "Beloved" {
+			t.Errorf("page of unknown sort = %+v, want ordering by id", books)
+		}
+	})
+}
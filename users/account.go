@@ -0,0 +1,262 @@
+package users
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"main.go/chat"
+	mail "main.go/mail-service"
+	"main.go/notifications"
+	"main.go/store"
+)
+
+// DataExport is a member's profile, loans, in-app notices, support chat and
+// the emails sent to their address. Holds are not recorded anywhere yet, so
+// they are not part of it.
+type DataExport struct {
+	ExportedAt    time.Time                    `json:"exported_at"`
+	Profile       ExportedUser                 `json:"profile"`
+	Loans         []ExportLoan                 `json:"loans"`
+	Notifications []notifications.Notification `json:"notifications"`
+	Chat          []chat.Message               `json:"chat"`
+	Emails        []mail.ReceivedEmail         `json:"emails"`
+}
+
+// NotificationHistory, ChatHistory and EmailHistory are where the export
+// reads a member's notices, support conversation and received emails from.
+type NotificationHistory interface {
+	History(userID int) ([]notifications.Notification, error)
+}
+
+type ChatHistory interface {
+	History(userID int) ([]chat.Message, error)
+}
+
+type EmailHistory interface {
+	Received(email string) ([]mail.ReceivedEmail, error)
+}
+
+type ExportedUser struct {
+	ID                  int        `json:"id"`
+	Email               string     `json:"email"`
+	Username            string     `json:"username"`
+	DisplayName         string     `json:"display_name,omitempty"`
+	Avatar              string     `json:"avatar,omitempty"`
+	IsActivated         bool       `json:"is_activated"`
+	IsAdmin             bool       `json:"is_admin"`
+	DeletionRequestedAt *time.Time `json:"deletion_requested_at,omitempty"`
+}
+
+type ExportLoan struct {
+	BookName   string     `json:"book_name"`
+	BookAuthor string     `json:"book_author"`
+	BookGenre  string     `json:"book_genre"`
+	BorrowedAt time.Time  `json:"borrowed_at"`
+	ReturnedAt *time.Time `json:"returned_at,omitempty"`
+}
+
+func (s userService) ExportData(userID int) (DataExport, error) {
+	export := DataExport{ExportedAt: time.Now().UTC(), Loans: []ExportLoan{}}
+
+	u, err := s.user(userID)
+	if err != nil {
+		return export, fmt.Errorf("error retrieving user for export: %s", err)
+	}
+	export.Profile = ExportedUser{
+		ID:                  u.ID,
+		Email:               u.Email,
+		Username:            u.Username,
+		DisplayName:         u.DisplayName,
+		Avatar:              u.Avatar,
+		IsActivated:         u.IsActivated,
+		IsAdmin:             u.IsAdmin,
+		DeletionRequestedAt: u.DeletionRequestedAt,
+	}
+
+	loans, err := s.Borrowings.Loans(userID)
+	if err != nil {
+		return export, fmt.Errorf("error retrieving loans for export: %s", err)
+	}
+	for _, loan := range loans {
+		export.Loans = append(export.Loans, ExportLoan{
+			BookName:   loan.BookName,
+			BookAuthor: loan.BookAuthor,
+			BookGenre:  loan.BookGenre,
+			BorrowedAt: loan.BorrowedAt,
+			ReturnedAt: loan.ReturnedAt,
+		})
+	}
+
+	export.Notifications, err = s.Notifications.History(userID)
+	if err != nil {
+		return export, fmt.Errorf("error retrieving notifications for export: %s", err)
+	}
+
+	export.Chat, err = s.Chats.History(userID)
+	if err != nil {
+		return export, fmt.Errorf("error retrieving chat history for export: %s", err)
+	}
+
+	export.Emails, err = s.Emails.Received(u.Email)
+	if err != nil {
+		return export, fmt.Errorf("error retrieving received emails for export: %s", err)
+	}
+
+	return export, nil
+}
+
+// WriteExportArchive writes the export as a ZIP holding data.json and, if
+// the member uploaded one, their avatar image.
+func WriteExportArchive(w io.Writer, export DataExport) error {
+	archive := zip.NewWriter(w)
+
+	file, err := archive.Create("data.json")
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(export)
+	if err != nil {
+		return err
+	}
+
+	if export.Profile.Avatar != "" {
+		avatar, err := os.Open(filepath.Join(AvatarDir(), filepath.Base(export.Profile.Avatar)))
+		if err == nil {
+			defer avatar.Close()
+
+			file, err := archive.Create("avatar" + filepath.Ext(export.Profile.Avatar))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, avatar)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return archive.Close()
+}
+
+// RequestDeletion schedules the account for deletion once the grace period
+// has passed. Members with books still on loan have to return them first.
+func (s userService) RequestDeletion(r *http.Request, userID int, password string) error {
+	u, err := s.user(userID)
+	if err != nil {
+		return fmt.Errorf("error retrieving user password hash: %s", err)
+	}
+
+	_, err = verifyPassword(u.PasswordHash, password)
+	if err != nil {
+		return ValidationErrors{"password": "Password is incorrect"}
+	}
+
+	openLoans, err := s.Borrowings.OpenLoans(userID)
+	if err != nil {
+		return fmt.Errorf("error checking open loans: %s", err)
+	}
+	if len(openLoans) > 0 {
+		return ValidationErrors{"account": fmt.Sprintf("Return your %d borrowed book(s) before deleting your account", len(openLoans))}
+	}
+
+	if u.DeletionRequestedAt == nil {
+		now := time.Now().UTC()
+		u.DeletionRequestedAt = &now
+		err = s.Users.UpdateUser(u)
+		if err != nil {
+			log.WithError(err).Error("Error requesting account deletion")
+			return fmt.Errorf("error requesting account deletion: %s", err)
+		}
+	}
+
+	s.Audit.Record(r, "user.deletion_requested", strconv.Itoa(userID), nil, nil)
+
+	log.WithFields(logrus.Fields{
+		"action":  "request_deletion",
+		"user_id": userID,
+	}).Info("Account deletion requested")
+
+	return nil
+}
+
+func (s userService) CancelDeletion(r *http.Request, userID int) error {
+	u, err := s.user(userID)
+	if err != nil {
+		return fmt.Errorf("error cancelling account deletion: %s", err)
+	}
+
+	u.DeletionRequestedAt = nil
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		log.WithError(err).Error("Error cancelling account deletion")
+		return fmt.Errorf("error cancelling account deletion: %s", err)
+	}
+
+	s.Audit.Record(r, "user.deletion_cancelled", strconv.Itoa(userID), nil, nil)
+
+	return nil
+}
+
+// PurgeDeletionRequests removes every account whose deletion request is
+// older than the grace period. Accounts that borrowed a book in the meantime
+// are skipped until it is returned.
+func (s userService) PurgeDeletionRequests() (int, error) {
+	cutoff := time.Now().UTC().Add(-settings.deletionGracePeriod())
+
+	requests, err := s.Users.DeletionRequests(cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("error querying deletion requests: %s", err)
+	}
+
+	purged := 0
+	for _, u := range requests {
+		openLoans, err := s.Borrowings.OpenLoans(u.ID)
+		if err != nil {
+			return purged, fmt.Errorf("error checking open loans: %s", err)
+		}
+		if len(openLoans) > 0 {
+			continue
+		}
+
+		err = s.purgeUser(u)
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// purgeUser deletes a user for good; the repository keeps their loan
+// history without pointing at them.
+func (s userService) purgeUser(u store.User) error {
+	err := s.Users.DeleteUser(u.ID)
+	if err != nil {
+		return fmt.Errorf("error deleting user: %s", err)
+	}
+
+	if u.Avatar != "" {
+		os.Remove(filepath.Join(AvatarDir(), filepath.Base(u.Avatar)))
+	}
+
+	s.Audit.Record(nil, "user.purge", strconv.Itoa(u.ID), map[string]string{"email": u.Email}, nil)
+
+	log.WithFields(logrus.Fields{
+		"action":  "purge_user",
+		"user_id": u.ID,
+	}).Info("User deleted")
+
+	return nil
+}
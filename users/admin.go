@@ -0,0 +1,261 @@
+package users
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"main.go/events"
+	mail "main.go/mail-service"
+)
+
+// AdminUser is a user record as shown on the admin edit page.
+type AdminUser struct {
+	ID          int
+	Email       string
+	Username    string
+	DisplayName string
+	IsActivated bool
+	IsAdmin     bool
+	Loans       []AdminLoan
+}
+
+type AdminLoan struct {
+	BookName   string
+	BookAuthor string
+	BorrowedAt time.Time
+	DueAt      sql.NullTime
+	ReturnedAt sql.NullTime
+}
+
+func (l AdminLoan) Overdue() bool {
+	return !l.ReturnedAt.Valid && l.DueAt.Valid && l.DueAt.Time.Before(time.Now())
+}
+
+// AdminUserUpdate holds the fields an admin can change on a user.
+type AdminUserUpdate struct {
+	Email       string
+	Username    string
+	DisplayName string
+	IsAdmin     bool
+}
+
+func (s userService) GetAdminUser(userID int) (AdminUser, error) {
+	u, err := s.user(userID)
+	if err != nil {
+		return AdminUser{}, err
+	}
+	if u.DeletedAt != nil {
+		return AdminUser{}, errUserNotFound
+	}
+
+	admin := AdminUser{
+		ID:          u.ID,
+		Email:       u.Email,
+		Username:    u.Username,
+		DisplayName: u.DisplayName,
+		IsActivated: u.IsActivated,
+		IsAdmin:     u.IsAdmin,
+	}
+
+	loans, err := s.Borrowings.Loans(userID)
+	if err != nil {
+		return admin, fmt.Errorf("error retrieving loans: %s", err)
+	}
+
+	// Most recent first.
+	for i := len(loans) - 1; i >= 0; i-- {
+		loan := AdminLoan{
+			BookName:   loans[i].BookName,
+			BookAuthor: loans[i].BookAuthor,
+			BorrowedAt: loans[i].BorrowedAt,
+		}
+		if loans[i].DueAt != nil {
+			loan.DueAt = sql.NullTime{Time: *loans[i].DueAt, Valid: true}
+		}
+		if loans[i].ReturnedAt != nil {
+			loan.ReturnedAt = sql.NullTime{Time: *loans[i].ReturnedAt, Valid: true}
+		}
+		admin.Loans = append(admin.Loans, loan)
+	}
+
+	return admin, nil
+}
+
+func (s userService) ShowAdminUser(w http.ResponseWriter, userID int) error {
+	u, err := s.GetAdminUser(userID)
+	if err != nil {
+		return err
+	}
+
+	ts, err := template.ParseFiles("userEdit.html")
+	if err != nil {
+		log.WithError(err).Error("Error parsing user edit template")
+		return errors.New("failed to parse HTML template")
+	}
+
+	err = ts.Execute(w, u)
+	if err != nil {
+		log.WithError(err).Error("Error executing HTML template")
+		return errors.New("failed to render user edit template")
+	}
+
+	return nil
+}
+
+func (s userService) AdminUpdateUser(r *http.Request, userID int, update AdminUserUpdate) error {
+	update.Email = strings.TrimSpace(update.Email)
+	update.Username = strings.TrimSpace(update.Username)
+	update.DisplayName = strings.TrimSpace(update.DisplayName)
+
+	errs := ValidationErrors{}
+	if msg := validateEmail(update.Email); msg != "" {
+		errs["email"] = msg
+	}
+	if msg := validateUsername(update.Username); msg != "" {
+		errs["username"] = msg
+	}
+	if utf8.RuneCountInString(update.DisplayName) > maxDisplayNameLength {
+		errs["display_name"] = fmt.Sprintf("Display name must be at most %d characters", maxDisplayNameLength)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	emailTaken, err := s.Users.EmailTaken(update.Email, userID)
+	if err != nil {
+		return err
+	}
+	usernameTaken, err := s.Users.UsernameTaken(update.Username, userID)
+	if err != nil {
+		return err
+	}
+	if emailTaken {
+		errs["email"] = "Email is already registered"
+	}
+	if usernameTaken {
+		errs["username"] = "Username is already taken"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	u, err := s.user(userID)
+	if err != nil {
+		return err
+	}
+	if u.DeletedAt != nil {
+		return errUserNotFound
+	}
+	before := u
+
+	u.Email = update.Email
+	u.Username = update.Username
+	u.DisplayName = update.DisplayName
+	u.IsAdmin = update.IsAdmin
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		log.WithError(err).Error("Error updating user")
+		return fmt.Errorf("error updating user: %s", err)
+	}
+
+	action := "user.update"
+	if before.IsAdmin != update.IsAdmin {
+		action = "user.role_change"
+	}
+	s.Audit.Record(r, action, strconv.Itoa(userID), AdminUserUpdate{
+		Email:       before.Email,
+		Username:    before.Username,
+		DisplayName: before.DisplayName,
+		IsAdmin:     before.IsAdmin,
+	}, update)
+
+	events.Publish(userID, events.AccountUpdated, map[string]string{"message": "An administrator updated your account details."})
+
+	log.WithFields(logrus.Fields{
+		"action":  "admin_update_user",
+		"user_id": userID,
+	}).Info("User updated by admin")
+
+	return nil
+}
+
+// ToggleActivation flips the activated flag and returns the new value.
+func (s userService) ToggleActivation(r *http.Request, userID int) (bool, error) {
+	u, err := s.user(userID)
+	if err != nil {
+		return false, err
+	}
+	if u.DeletedAt != nil {
+		return false, errUserNotFound
+	}
+
+	u.IsActivated = !u.IsActivated
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		return false, fmt.Errorf("error toggling activation: %s", err)
+	}
+	activated := u.IsActivated
+
+	s.Audit.Record(r, "user.activation", strconv.Itoa(userID), map[string]bool{"activated": !activated}, map[string]bool{"activated": activated})
+	events.Publish(userID, events.AccountUpdated, map[string]bool{"activated": activated})
+
+	log.WithFields(logrus.Fields{
+		"action":    "toggle_activation",
+		"user_id":   userID,
+		"activated": activated,
+	}).Info("User activation changed")
+
+	return activated, nil
+}
+
+// ResetPassword clears the user's password, ends their session and emails
+// them a single-use link to choose a new one.
+func (s userService) ResetPassword(r *http.Request, userID int) error {
+	u, err := s.user(userID)
+	if err != nil {
+		return err
+	}
+	if u.DeletedAt != nil {
+		return errUserNotFound
+	}
+
+	code, stored, err := newResetCode()
+	if err != nil {
+		return fmt.Errorf("error generating reset link: %s", err)
+	}
+
+	// Clearing the password and session logs the user out everywhere.
+	expiresAt := time.Now().UTC().Add(resetLinkLifetime)
+	u.PasswordHash = ""
+	u.Token = ""
+	u.ResetToken = stored
+	u.ResetExpiresAt = &expiresAt
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		log.WithError(err).Error("Error resetting password")
+		return fmt.Errorf("error resetting password: %s", err)
+	}
+
+	s.Audit.Record(r, "user.password_reset", strconv.Itoa(userID), nil, nil)
+
+	err = mail.SendTemplate(s.Mailer, "reset", u.Email, mail.TemplateData{Name: u.Username, Link: settings.APIURL + "/reset/" + code})
+	if err != nil {
+		log.WithError(err).Error("error sending password reset email")
+		return errors.New("error sending password reset email")
+	}
+
+	log.WithFields(logrus.Fields{
+		"action":  "reset_password",
+		"user_id": userID,
+	}).Info("Password reset by admin")
+
+	return nil
+}
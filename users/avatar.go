@@ -0,0 +1,162 @@
+package users
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"main.go/token"
+)
+
+const (
+	MaxAvatarUploadSize = 5 << 20
+	maxAvatarDimension  = 4096
+	avatarSize          = 256
+)
+
+var allowedAvatarTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// AvatarDir is where resized avatars are written and served from.
+func AvatarDir() string {
+	return filepath.Join(settings.StorageDir, "avatars")
+}
+
+// UpdateAvatar validates an uploaded image, crops it to a square, scales it
+// to avatarSize and stores it as PNG, replacing the user's previous avatar.
+func (s userService) UpdateAvatar(userID int, upload io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(upload, MaxAvatarUploadSize+1))
+	if err != nil {
+		return fmt.Errorf("error reading avatar upload: %s", err)
+	}
+	if len(data) > MaxAvatarUploadSize {
+		return ValidationErrors{"avatar": "Image must be smaller than 5 MB"}
+	}
+
+	if !allowedAvatarTypes[http.DetectContentType(data)] {
+		return ValidationErrors{"avatar": "Image must be a JPEG, PNG or GIF"}
+	}
+
+	// Check the declared size before decoding so a tiny file can't make us
+	// allocate a huge bitmap.
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ValidationErrors{"avatar": "Image could not be read"}
+	}
+	if config.Width > maxAvatarDimension || config.Height > maxAvatarDimension {
+		return ValidationErrors{"avatar": fmt.Sprintf("Image must be at most %dx%d pixels", maxAvatarDimension, maxAvatarDimension)}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ValidationErrors{"avatar": "Image could not be read"}
+	}
+
+	suffix, err := token.GenerateToken()
+	if err != nil {
+		return err
+	}
+
+	dir := AvatarDir()
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating avatar directory: %s", err)
+	}
+
+	fileName := fmt.Sprintf("%d-%s.png", userID, suffix[:16])
+	file, err := os.Create(filepath.Join(dir, fileName))
+	if err != nil {
+		return fmt.Errorf("error creating avatar file: %s", err)
+	}
+
+	err = png.Encode(file, resizeSquare(img, avatarSize))
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filepath.Join(dir, fileName))
+		return fmt.Errorf("error writing avatar: %s", err)
+	}
+
+	u, err := s.user(userID)
+	if err != nil {
+		os.Remove(filepath.Join(dir, fileName))
+		return err
+	}
+
+	previous := u.Avatar
+	u.Avatar = fileName
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		os.Remove(filepath.Join(dir, fileName))
+		log.WithError(err).Error("Error saving avatar")
+		return fmt.Errorf("error saving avatar: %s", err)
+	}
+
+	if previous != "" {
+		os.Remove(filepath.Join(dir, filepath.Base(previous)))
+	}
+
+	return nil
+}
+
+// resizeSquare center-crops img to a square and scales it to size×size by
+// averaging every source pixel that falls into each destination pixel.
+func resizeSquare(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		sy0 := y0 + dy*side/size
+		sy1 := y0 + (dy+1)*side/size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for dx := 0; dx < size; dx++ {
+			sx0 := x0 + dx*side/size
+			sx1 := x0 + (dx+1)*side/size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+
+			dst.Set(dx, dy, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
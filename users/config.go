@@ -0,0 +1,88 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config holds the account settings. The env tags name the variables the
+// config package reads them from.
+type Config struct {
+	APIURL     string `env:"API_URL"` // site URL used in confirmation links
+	StorageDir string `env:"STORAGE_DIR"`
+
+	PasswordHash  string `env:"PASSWORD_HASH"` // "argon2id" or "bcrypt"
+	BcryptCost    int    `env:"BCRYPT_COST"`
+	Argon2Memory  int    `env:"ARGON2_MEMORY"` // KiB
+	Argon2Time    int    `env:"ARGON2_TIME"`
+	Argon2Threads int    `env:"ARGON2_THREADS"`
+
+	PasswordMinLength     int    `env:"PASSWORD_MIN_LENGTH"`
+	BreachedPasswordsFile string `env:"BREACHED_PASSWORDS_FILE"`
+
+	RetentionDays     int `env:"USER_RETENTION_DAYS"`         // how long deleted users stay in the trash
+	DeletionGraceDays int `env:"ACCOUNT_DELETION_GRACE_DAYS"` // how long a member can cancel a deletion request
+}
+
+// DefaultConfig uses argon2id with the RFC 9106 second recommended option
+// (64 MiB, 3 passes) and two lanes.
+func DefaultConfig() Config {
+	return Config{
+		StorageDir:            "storage",
+		PasswordHash:          hashArgon2id,
+		BcryptCost:            bcrypt.DefaultCost,
+		Argon2Memory:          64 * 1024,
+		Argon2Time:            3,
+		Argon2Threads:         2,
+		PasswordMinLength:     8,
+		BreachedPasswordsFile: "breached-passwords.txt",
+		RetentionDays:         30,
+		DeletionGraceDays:     14,
+	}
+}
+
+func (c Config) Validate() error {
+	switch {
+	case !strings.EqualFold(c.PasswordHash, hashArgon2id) && !strings.EqualFold(c.PasswordHash, hashBcrypt):
+		return fmt.Errorf("PASSWORD_HASH must be %s or %s, got %q", hashArgon2id, hashBcrypt, c.PasswordHash)
+	case c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost:
+		return fmt.Errorf("BCRYPT_COST must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, c.BcryptCost)
+	case c.Argon2Memory < 8*1024:
+		return fmt.Errorf("ARGON2_MEMORY must be at least 8192 KiB, got %d", c.Argon2Memory)
+	case c.Argon2Time < 1:
+		return fmt.Errorf("ARGON2_TIME must be at least 1, got %d", c.Argon2Time)
+	case c.Argon2Threads < 1 || c.Argon2Threads > 255:
+		return fmt.Errorf("ARGON2_THREADS must be between 1 and 255, got %d", c.Argon2Threads)
+	case c.PasswordMinLength < 8:
+		return fmt.Errorf("PASSWORD_MIN_LENGTH must be at least 8, got %d", c.PasswordMinLength)
+	case c.RetentionDays < 1:
+		return fmt.Errorf("USER_RETENTION_DAYS must be at least 1, got %d", c.RetentionDays)
+	case c.DeletionGraceDays < 0:
+		return fmt.Errorf("ACCOUNT_DELETION_GRACE_DAYS must not be negative, got %d", c.DeletionGraceDays)
+	}
+	return nil
+}
+
+var settings = DefaultConfig()
+
+// Configure applies the settings loaded at startup.
+func Configure(c Config) {
+	c.PasswordHash = strings.ToLower(c.PasswordHash)
+	c.APIURL = strings.TrimRight(c.APIURL, "/")
+	settings = c
+}
+
+func (c Config) argon2Params() argon2Config {
+	return argon2Config{Memory: uint32(c.Argon2Memory), Time: uint32(c.Argon2Time), Threads: uint8(c.Argon2Threads)}
+}
+
+func (c Config) retentionPeriod() time.Duration {
+	return time.Duration(c.RetentionDays) * 24 * time.Hour
+}
+
+func (c Config) deletionGracePeriod() time.Duration {
+	return time.Duration(c.DeletionGraceDays) * 24 * time.Hour
+}
@@ -0,0 +1,135 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"main.go/store"
+)
+
+const (
+	hashArgon2id = "argon2id"
+	hashBcrypt   = "bcrypt"
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var (
+	errPasswordMismatch = errors.New("password does not match")
+	errUnknownHash      = errors.New("unrecognized password hash format")
+)
+
+type argon2Config struct {
+	Memory  uint32 // KiB
+	Time    uint32
+	Threads uint8
+}
+
+// getPasswordHash hashes the password with the configured algorithm.
+func getPasswordHash(password string) (string, error) {
+	if settings.PasswordHash == hashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), settings.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	params := settings.argon2Params()
+	return encodeArgon2id(params, salt, argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, argon2KeyLength)), nil
+}
+
+// verifyPassword checks the password against a stored bcrypt or argon2id
+// hash. needsRehash reports whether the hash was produced with a different
+// algorithm or weaker parameters than currently configured.
+func verifyPassword(storedHash string, password string) (needsRehash bool, err error) {
+	if strings.HasPrefix(storedHash, "$"+hashArgon2id+"$") {
+		params, salt, key, err := decodeArgon2id(storedHash)
+		if err != nil {
+			return false, err
+		}
+
+		computed := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, errPasswordMismatch
+		}
+
+		return settings.PasswordHash != hashArgon2id || params != settings.argon2Params(), nil
+	}
+
+	cost, err := bcrypt.Cost([]byte(storedHash))
+	if err != nil {
+		return false, errUnknownHash
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password))
+	if err != nil {
+		return false, errPasswordMismatch
+	}
+
+	return settings.PasswordHash != hashBcrypt || cost < settings.BcryptCost, nil
+}
+
+// upgradePasswordHash re-hashes a password that was just verified, for the
+// caller to save with the rest of the login. Failures are logged only: the
+// user has already authenticated and the upgrade will be retried on the next
+// login.
+func upgradePasswordHash(u *store.User, password string) {
+	newHash, err := getPasswordHash(password)
+	if err != nil {
+		log.WithError(err).Error("Error re-hashing password")
+		return
+	}
+
+	u.PasswordHash = newHash
+	log.WithField("algorithm", settings.PasswordHash).Info("Password hash upgraded")
+}
+
+func encodeArgon2id(params argon2Config, salt, key []byte) string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		hashArgon2id, argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// decodeArgon2id parses the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func decodeArgon2id(encoded string) (argon2Config, []byte, []byte, error) {
+	var params argon2Config
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, errUnknownHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, errUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errUnknownHash
+	}
+
+	return params, salt, key, nil
+}
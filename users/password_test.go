@@ -0,0 +1,127 @@
+package users
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"main.go/store"
+)
+
+// useHashing configures cheap hashing parameters for the test.
+func useHashing(t *testing.T, algorithm string) {
+	t.Helper()
+	settings.PasswordHash = algorithm
+	settings.BcryptCost = bcrypt.MinCost
+	settings.Argon2Memory, settings.Argon2Time, settings.Argon2Threads = 8*1024, 1, 1
+	t.Cleanup(func() { settings = DefaultConfig() })
+}
+
+func TestVerifyPassword(t *testing.T) {
+	useHashing(t, hashArgon2id)
+	current, err := getPasswordHash("Correct-horse-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(current, "$argon2id$v=19$m=8192,t=1,p=1$") {
+		t.Fatalf("hash = %s", current)
+	}
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("Correct-horse-7"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings.Argon2Time = 2
+	stronger, err := getPasswordHash("Correct-horse-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Argon2Time = 1
+
+	tests := []struct {
+		name        string
+		hash        string
+		password    string
+		needsRehash bool
+		err         error
+	}{
+		{"current argon2id", current, "Correct-horse-7", false, nil},
+		{"wrong password", current, "correct-horse-7", false, errPasswordMismatch},
+		{"bcrypt is upgraded", string(legacy), "Correct-horse-7", true, nil},
+		{"wrong bcrypt password", string(legacy), "Wrong-horse-7", false, errPasswordMismatch},
+		{"other argon2 parameters", stronger, "Correct-horse-7", true, nil},
+		{"unknown format", "plaintext", "plaintext", false, errUnknownHash},
+		{"corrupt argon2id", "$argon2id$v=19$m=8192$salt$key", "Correct-horse-7", false, errUnknownHash},
+	}
+
+	for _, test := range tests {
+		needsRehash, err := verifyPassword(test.hash, test.password)
+		if needsRehash != test.needsRehash || err != test.err {
+			t.Errorf("%s: verifyPassword = %v, %v; want %v, %v", test.name, needsRehash, err, test.needsRehash, test.err)
+		}
+	}
+}
+
+func TestVerifyPasswordBcryptCost(t *testing.T) {
+	useHashing(t, hashBcrypt)
+	hash, err := getPasswordHash("Correct-horse-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if needsRehash, err := verifyPassword(hash, "Correct-horse-7"); needsRehash || err != nil {
+		t.Errorf("at the configured cost: %v, %v", needsRehash, err)
+	}
+	settings.BcryptCost = bcrypt.MinCost + 1
+	if needsRehash, err := verifyPassword(hash, "Correct-horse-7"); !needsRehash || err != nil {
+		t.Errorf("below the configured cost: %v, %v", needsRehash, err)
+	}
+	settings.PasswordHash = hashArgon2id
+	if needsRehash, err := verifyPassword(hash, "Correct-horse-7"); !needsRehash || err != nil {
+		t.Errorf("after switching to argon2id: %v, %v", needsRehash, err)
+	}
+}
+
+func TestLoginUpgradesPasswordHash(t *testing.T) {
+	useHashing(t, hashArgon2id)
+	s, repos := newTestService()
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("Correct-horse-7"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := store.User{Email: "ada@example.com", Username: "ada", PasswordHash: string(legacy), IsActivated: true}
+	if err := repos.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AuthenticateUser(nil, u.Email, "Wrong-horse-7", "session"); err == nil {
+		t.Fatal("logged in with the wrong password")
+	}
+	if stored, _ := repos.User(u.ID); stored.PasswordHash != string(legacy) {
+		t.Error("a failed login changed the stored hash")
+	}
+
+	if err := s.AuthenticateUser(nil, u.Email, "Correct-horse-7", "session"); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := repos.User(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.PasswordHash, "$argon2id$") || stored.Token != "session" {
+		t.Fatalf("after login: hash %s, token %q", stored.PasswordHash, stored.Token)
+	}
+	if needsRehash, err := verifyPassword(stored.PasswordHash, "Correct-horse-7"); needsRehash || err != nil {
+		t.Errorf("upgraded hash: %v, %v", needsRehash, err)
+	}
+
+	// The next login keeps the upgraded hash.
+	if err := s.AuthenticateUser(nil, u.Email, "Correct-horse-7", "session-2"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := repos.User(u.ID); again.PasswordHash != stored.PasswordHash {
+		t.Error("an up-to-date hash was rewritten")
+	}
+}
@@ -0,0 +1,88 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	mail "main.go/mail-service"
+	"main.go/store"
+)
+
+// Preferences records which optional emails a member wants. Account emails
+// such as activation and password resets are always sent.
+type Preferences struct {
+	Announcements bool
+	Reminders     bool
+	Holds         bool
+}
+
+func (s userService) GetPreferences(userID int) (Preferences, error) {
+	u, err := s.user(userID)
+	if err != nil {
+		return Preferences{}, fmt.Errorf("error retrieving email preferences: %s", err)
+	}
+	return preferencesOf(u), nil
+}
+
+func preferencesOf(u store.User) Preferences {
+	return Preferences{Announcements: u.EmailAnnouncements, Reminders: u.EmailReminders, Holds: u.EmailHolds}
+}
+
+func (s userService) UpdatePreferences(r *http.Request, userID int, p Preferences) error {
+	u, err := s.user(userID)
+	if err != nil {
+		return fmt.Errorf("error retrieving email preferences: %s", err)
+	}
+	before := preferencesOf(u)
+
+	u.EmailAnnouncements, u.EmailReminders, u.EmailHolds = p.Announcements, p.Reminders, p.Holds
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		log.WithError(err).Error("Error updating email preferences")
+		return fmt.Errorf("error updating email preferences: %s", err)
+	}
+
+	s.Audit.Record(r, "user.preferences_update", strconv.Itoa(userID), before, p)
+
+	return nil
+}
+
+// Unsubscribe opts the owner of email out of category. It is reached from a
+// signed link, so it works without a session.
+func (s userService) Unsubscribe(r *http.Request, email string, category string) error {
+	u, err := s.Users.UserByEmail(email)
+	if err == store.ErrNotFound {
+		return errUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error unsubscribing: %s", err)
+	}
+
+	switch category {
+	case mail.CategoryAnnouncements:
+		u.EmailAnnouncements = false
+	case mail.CategoryReminders:
+		u.EmailReminders = false
+	case mail.CategoryHolds:
+		u.EmailHolds = false
+	default:
+		return fmt.Errorf("unknown email category %q", category)
+	}
+
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		log.WithError(err).Error("Error unsubscribing user")
+		return fmt.Errorf("error unsubscribing: %s", err)
+	}
+
+	s.Audit.Record(r, "user.unsubscribe", email, nil, map[string]string{"category": category})
+
+	log.WithFields(logrus.Fields{
+		"action":   "unsubscribe",
+		"category": category,
+	}).Info("User unsubscribed")
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	mail "main.go/mail-service"
+	"main.go/store"
+)
+
+const maxDisplayNameLength = 64
+
+// Profile is the part of a user record members can see and edit themselves.
+type Profile struct {
+	ID           int
+	Email        string
+	Username     string
+	DisplayName  string
+	Avatar       string
+	PendingEmail string
+}
+
+// CurrentUserID resolves the logged-in user from the token cookie.
+func CurrentUserID(r *http.Request) (int, error) {
+	u, err := DefaultUserService.currentUser(r)
+	if err != nil {
+		return 0, err
+	}
+	return u.ID, nil
+}
+
+func (s userService) GetProfile(userID int) (Profile, error) {
+	u, err := s.user(userID)
+	if err != nil {
+		return Profile{}, fmt.Errorf("error retrieving profile: %s", err)
+	}
+
+	return Profile{
+		ID:           u.ID,
+		Email:        u.Email,
+		Username:     u.Username,
+		DisplayName:  u.DisplayName,
+		Avatar:       u.Avatar,
+		PendingEmail: u.PendingEmail,
+	}, nil
+}
+
+func (s userService) UpdateProfile(userID int, username string, displayName string) error {
+	username = strings.TrimSpace(username)
+	displayName = strings.TrimSpace(displayName)
+
+	errs := ValidationErrors{}
+	if msg := validateUsername(username); msg != "" {
+		errs["username"] = msg
+	} else {
+		taken, err := s.Users.UsernameTaken(username, userID)
+		if err != nil {
+			log.WithError(err).Error("Error checking username uniqueness")
+			return err
+		}
+		if taken {
+			errs["username"] = "Username is already taken"
+		}
+	}
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		errs["display_name"] = fmt.Sprintf("Display name must be at most %d characters", maxDisplayNameLength)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	u, err := s.user(userID)
+	if err != nil {
+		return err
+	}
+	u.Username = username
+	u.DisplayName = displayName
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		log.WithError(err).Error("Error updating profile")
+		return fmt.Errorf("error updating profile: %s", err)
+	}
+
+	log.WithFields(logrus.Fields{
+		"action":  "update_profile",
+		"user_id": userID,
+	}).Info("Profile updated")
+
+	return nil
+}
+
+// RequestEmailChange stores the new address as pending and mails a
+// verification link to it. The account keeps its current email until the
+// link is followed.
+func (s userService) RequestEmailChange(r *http.Request, userID int, newEmail string, password string) error {
+	newEmail = strings.TrimSpace(newEmail)
+
+	u, err := s.user(userID)
+	if err != nil {
+		return fmt.Errorf("error retrieving user password hash: %s", err)
+	}
+
+	_, err = verifyPassword(u.PasswordHash, password)
+	if err != nil {
+		return ValidationErrors{"password": "Password is incorrect"}
+	}
+
+	if msg := validateEmail(newEmail); msg != "" {
+		return ValidationErrors{"email": msg}
+	}
+
+	err = s.checkUsername(newEmail)
+	if err != nil {
+		if err == errUserExists {
+			return ValidationErrors{"email": "Email is already registered"}
+		}
+		return err
+	}
+
+	confirmation := uuid.New().String()
+	u.PendingEmail = newEmail
+	u.EmailConfirmation = confirmation
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		log.WithError(err).Error("Error saving pending email")
+		return fmt.Errorf("error saving pending email: %s", err)
+	}
+
+	s.Audit.Record(r, "user.email_change_requested", strconv.Itoa(userID), nil, map[string]string{"pending_email": newEmail})
+
+	link := settings.APIURL + "/confirm-email/" + confirmation
+	err = mail.SendTemplate(s.Mailer, "email-change", newEmail, mail.TemplateData{Name: u.Username, Link: link})
+	if err != nil {
+		log.WithError(err).Error("error sending email change confirmation")
+		return errors.New("error sending email change confirmation")
+	}
+
+	return nil
+}
+
+func (s userService) ConfirmEmailChange(r *http.Request, link string) error {
+	u, err := s.Users.UserByEmailConfirmation(link)
+	if err != nil {
+		if err == store.ErrNotFound {
+			return errors.New("link not found")
+		}
+		return fmt.Errorf("error checking link existence: %s", err)
+	}
+
+	if u.PendingEmail == "" {
+		return errors.New("no email change pending")
+	}
+
+	// The address may have been registered by someone else since the
+	// change was requested.
+	err = s.checkUsername(u.PendingEmail)
+	if err != nil {
+		return err
+	}
+
+	email := u.Email
+	u.Email = u.PendingEmail
+	u.PendingEmail = ""
+	u.EmailConfirmation = ""
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		log.WithError(err).Error("Error confirming email change")
+		return fmt.Errorf("error confirming email change: %s", err)
+	}
+
+	s.Audit.Record(r, "user.email_change", strconv.Itoa(u.ID), map[string]string{"email": email}, map[string]string{"email": u.Email})
+
+	log.WithFields(logrus.Fields{
+		"action":  "change_email",
+		"user_id": u.ID,
+	}).Info("Email changed")
+
+	return nil
+}
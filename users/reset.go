@@ -0,0 +1,95 @@
+package users
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"main.go/store"
+	"main.go/token"
+)
+
+// resetLinkLifetime is how long a password reset link can be used.
+const resetLinkLifetime = 24 * time.Hour
+
+var ErrResetLinkInvalid = errors.New("reset link is invalid or has expired")
+
+// newResetCode returns the code for a reset link and the hash to keep in
+// the reset_token column; the code itself is never stored.
+func newResetCode() (code string, stored string, err error) {
+	code, err = token.GenerateToken()
+	if err != nil {
+		return "", "", err
+	}
+	return code, resetToken(code), nil
+}
+
+func resetToken(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckResetLink reports whether the code from a reset link can still be
+// used.
+func (s userService) CheckResetLink(code string) error {
+	_, err := s.userByResetCode(code, time.Now())
+	return err
+}
+
+func (s userService) userByResetCode(code string, now time.Time) (store.User, error) {
+	if code == "" {
+		return store.User{}, ErrResetLinkInvalid
+	}
+
+	u, err := s.Users.UserByResetToken(resetToken(code))
+	if err == store.ErrNotFound {
+		return u, ErrResetLinkInvalid
+	}
+	if err != nil {
+		return u, fmt.Errorf("error checking reset link: %s", err)
+	}
+	if u.ResetExpiresAt == nil || !now.Before(*u.ResetExpiresAt) {
+		return u, ErrResetLinkInvalid
+	}
+	return u, nil
+}
+
+// CompletePasswordReset sets the password chosen through a reset link.
+// The link stops working once it has been used.
+func (s userService) CompletePasswordReset(r *http.Request, code string, newpassword string) error {
+	u, err := s.userByResetCode(code, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if msg := validatePassword(User{Email: u.Email, Username: u.Username, Password: newpassword}); msg != "" {
+		return ValidationErrors{"password": msg}
+	}
+
+	u.PasswordHash, err = getPasswordHash(newpassword)
+	if err != nil {
+		log.WithError(err).Error("Error hashing new password")
+		return fmt.Errorf("error hashing new password: %s", err)
+	}
+	u.ResetToken = ""
+	u.ResetExpiresAt = nil
+	err = s.Users.UpdateUser(u)
+	if err != nil {
+		log.WithError(err).Error("Error saving reset password")
+		return fmt.Errorf("error saving reset password: %s", err)
+	}
+
+	s.Audit.Record(r, "user.password_reset_completed", strconv.Itoa(u.ID), nil, nil)
+
+	log.WithFields(logrus.Fields{
+		"action":  "complete_password_reset",
+		"user_id": u.ID,
+	}).Info("Password reset completed")
+
+	return nil
+}
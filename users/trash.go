@@ -0,0 +1,95 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+type TrashedUser struct {
+	ID        int
+	Email     string
+	Username  string
+	DeletedAt time.Time
+	PurgeAt   time.Time
+}
+
+func (s userService) ShowTrash(w http.ResponseWriter, r *http.Request) error {
+	isAdmin, err := s.IsAdmin(r)
+	if err != nil {
+		return err
+	}
+
+	if !isAdmin {
+		http.Error(w, "Access denied: Only admins can view deleted users", http.StatusUnauthorized)
+		return nil
+	}
+
+	deleted, err := s.Users.DeletedUsers()
+	if err != nil {
+		log.WithError(err).Error("Error getting deleted users from database")
+		return errors.New("failed to retrieve deleted users from the database")
+	}
+
+	var trashed []TrashedUser
+	for _, u := range deleted {
+		trashed = append(trashed, TrashedUser{
+			ID:        u.ID,
+			Email:     u.Email,
+			Username:  u.Username,
+			DeletedAt: *u.DeletedAt,
+			PurgeAt:   u.DeletedAt.Add(settings.retentionPeriod()),
+		})
+	}
+
+	ts, err := template.ParseFiles("trash.html")
+	if err != nil {
+		log.WithError(err).Error("Error parsing trash template")
+		return errors.New("failed to parse HTML template")
+	}
+
+	err = ts.Execute(w, trashed)
+	if err != nil {
+		log.WithError(err).Error("Error executing HTML template")
+		return errors.New("failed to render trash template")
+	}
+
+	return nil
+}
+
+// PurgeDeletedUsers permanently removes users that have been in the trash
+// longer than the retention period. Users with books still out are kept
+// until they are returned, so the books do not stay borrowed forever.
+func (s userService) PurgeDeletedUsers() (int, error) {
+	cutoff := time.Now().UTC().Add(-settings.retentionPeriod())
+
+	deleted, err := s.Users.DeletedUsers()
+	if err != nil {
+		return 0, fmt.Errorf("error querying deleted users: %s", err)
+	}
+
+	purged := 0
+	for _, u := range deleted {
+		if u.DeletedAt.After(cutoff) {
+			continue
+		}
+
+		openLoans, err := s.Borrowings.OpenLoans(u.ID)
+		if err != nil {
+			return purged, fmt.Errorf("error checking open loans: %s", err)
+		}
+		if len(openLoans) > 0 {
+			continue
+		}
+
+		err = s.purgeUser(u)
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,61 @@
+package users
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"main.go/store"
+)
+
+// discardAudit is an audit.Auditor that drops every entry.
+type discardAudit struct{}
+
+func (discardAudit) Record(r *http.Request, action, target string, before, after interface{}) {}
+
+func newTestService() (userService, *store.Memory) {
+	repos := store.NewMemory()
+	return userService{Users: repos, Borrowings: repos, Audit: discardAudit{}}, repos
+}
+
+func TestPurgeDeletedUsersKeepsUsersWithOpenLoans(t *testing.T) {
+	s, repos := newTestService()
+
+	deletedAt := time.Now().UTC().Add(-settings.retentionPeriod() - time.Hour)
+	borrower := store.User{Email: "borrower@example.com", Username: "borrower", DeletedAt: &deletedAt}
+	idle := store.User{Email: "idle@example.com", Username: "idle", DeletedAt: &deletedAt}
+	for _, u := range []*store.User{&borrower, &idle} {
+		if err := repos.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	book := store.Book{Name: "Dune", Author: "Frank Herbert"}
+	if err := repos.CreateBook(&book); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Borrow(book.ID, borrower.ID, deletedAt, deletedAt.Add(14*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := s.PurgeDeletedUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("purged %d users, want 1", purged)
+	}
+	if _, err := repos.User(borrower.ID); err != nil {
+		t.Errorf("user with a book out was purged: %v", err)
+	}
+	if _, err := repos.User(idle.ID); err != store.ErrNotFound {
+		t.Errorf("idle user lookup = %v, want ErrNotFound", err)
+	}
+
+	if _, err := repos.Return(borrower.ID, book.Name, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := s.PurgeDeletedUsers(); err != nil || purged != 1 {
+		t.Errorf("after the return: purged %d, %v; want 1, nil", purged, err)
+	}
+}
@@ -0,0 +1,205 @@
+package users
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"main.go/store"
+)
+
+const userListPageSize = 25
+
+// userListSorts lists the columns the user list can be sorted by.
+var userListSorts = map[string]bool{
+	"id":        true,
+	"email":     true,
+	"username":  true,
+	"activated": true,
+	"admin":     true,
+	"overdue":   true,
+}
+
+// UserListQuery is the search, filter, sort and page state of the admin
+// user list, read from the request's query string.
+type UserListQuery struct {
+	Search    string
+	Activated string // "yes", "no" or "" for both
+	Admin     string // "yes", "no" or "" for both
+	Overdue   bool
+	Sort      string
+	Desc      bool
+	Page      int
+}
+
+func parseUserListQuery(values url.Values) UserListQuery {
+	q := UserListQuery{
+		Search:    strings.TrimSpace(values.Get("q")),
+		Activated: yesNo(values.Get("activated")),
+		Admin:     yesNo(values.Get("admin")),
+		Overdue:   values.Get("overdue") == "yes",
+		Sort:      values.Get("sort"),
+		Desc:      values.Get("dir") == "desc",
+	}
+
+	if !userListSorts[q.Sort] {
+		q.Sort = "id"
+	}
+
+	page, err := strconv.Atoi(values.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	q.Page = page
+
+	return q
+}
+
+func yesNo(value string) string {
+	if value == "yes" || value == "no" {
+		return value
+	}
+	return ""
+}
+
+// Encode returns the query string for this state with the page replaced,
+// so templates can link to other pages without losing the filters.
+func (q UserListQuery) Encode(page int) template.URL {
+	values := url.Values{}
+	if q.Search != "" {
+		values.Set("q", q.Search)
+	}
+	if q.Activated != "" {
+		values.Set("activated", q.Activated)
+	}
+	if q.Admin != "" {
+		values.Set("admin", q.Admin)
+	}
+	if q.Overdue {
+		values.Set("overdue", "yes")
+	}
+	values.Set("sort", q.Sort)
+	if q.Desc {
+		values.Set("dir", "desc")
+	}
+	values.Set("page", strconv.Itoa(page))
+	return template.URL(values.Encode())
+}
+
+// sortQuery links a column header to sorting by that column, flipping the
+// direction when the list is already sorted by it.
+func sortQuery(q UserListQuery, column string) template.URL {
+	q.Desc = q.Sort == column && !q.Desc
+	q.Sort = column
+	return q.Encode(1)
+}
+
+func (s userService) ShowUserList(w http.ResponseWriter, r *http.Request) error {
+	isAdmin, err := s.IsAdmin(r)
+	if err != nil {
+		return err
+	}
+
+	if !isAdmin {
+		http.Error(w, "Access denied: Only admins can view user list", http.StatusUnauthorized)
+		return nil
+	}
+
+	query := parseUserListQuery(r.URL.Query())
+
+	users, total, err := s.userList(query)
+	if err != nil {
+		log.WithError(err).Error("Error getting user list from database")
+		return errors.New("failed to retrieve user list from the database")
+	}
+
+	totalPages := (total + userListPageSize - 1) / userListPageSize
+
+	data := struct {
+		Users      []DisplayUser
+		Query      UserListQuery
+		Total      int
+		Pages      []int
+		PrevPage   int
+		NextPage   int
+		TotalPages int
+	}{
+		Users:      users,
+		Query:      query,
+		Total:      total,
+		TotalPages: totalPages,
+	}
+
+	for i := 1; i <= totalPages; i++ {
+		data.Pages = append(data.Pages, i)
+	}
+	if query.Page > 1 {
+		data.PrevPage = query.Page - 1
+	}
+	if query.Page < totalPages {
+		data.NextPage = query.Page + 1
+	}
+
+	ts, err := template.New("userList.html").Funcs(template.FuncMap{
+		"sortQuery": sortQuery,
+	}).ParseFiles("userList.html")
+	if err != nil {
+		log.WithError(err).Error("Error parsing user list template")
+		return errors.New("failed to parse HTML template")
+	}
+
+	err = ts.Execute(w, data)
+	if err != nil {
+		log.WithError(err).Error("Error executing HTML template")
+		return errors.New("failed to render user list template")
+	}
+
+	log.Info("User list displayed successfully")
+	return nil
+}
+
+// userList returns one page of users matching the query together with the
+// total number of matches.
+func (s userService) userList(query UserListQuery) ([]DisplayUser, int, error) {
+	filter := store.UserFilter{
+		Search:  query.Search,
+		Overdue: query.Overdue,
+		Sort:    query.Sort,
+		Desc:    query.Desc,
+		Limit:   userListPageSize,
+		Offset:  (query.Page - 1) * userListPageSize,
+		Now:     time.Now().UTC(),
+	}
+	if query.Activated != "" {
+		activated := query.Activated == "yes"
+		filter.Activated = &activated
+	}
+	if query.Admin != "" {
+		admin := query.Admin == "yes"
+		filter.Admin = &admin
+	}
+
+	summaries, total, err := s.Users.ListUsers(filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var users []DisplayUser
+	for _, u := range summaries {
+		users = append(users, DisplayUser{
+			ID:           u.ID,
+			Email:        u.Email,
+			Username:     u.Username,
+			IsActivated:  u.IsActivated,
+			IsAdmin:      u.IsAdmin,
+			OpenLoans:    u.OpenLoans,
+			OverdueLoans: u.OverdueLoans,
+		})
+	}
+
+	return users, total, nil
+}
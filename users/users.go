@@ -1,81 +1,68 @@
 package users
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
-	"text/template"
+	"strconv"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
-)
-
-var (
-	port       = goDotEnvVariable("PORT")
-	connStr    = goDotEnvVariable("CONN_STR")
-	driverName = goDotEnvVariable("DRIVERNAME")
-	tableName  = goDotEnvVariable("TABLENAME")
+	"main.go/audit"
+	mail "main.go/mail-service"
+	"main.go/store"
 )
 
 type DisplayUser struct {
-	ID          int
-	Email       string
-	Username    string
-	IsActivated bool
-	IsAdmin     bool
-}
-
-type User struct {
-	Email    string
-	Username string
-	Password string
-}
-
-type authUser struct {
 	ID           int
 	Email        string
 	Username     string
-	PasswordHash string
-	Confirmation string
-	Token        string
 	IsActivated  bool
 	IsAdmin      bool
+	OpenLoans    int
+	OverdueLoans int
+}
+
+type User struct {
+	Email           string
+	Username        string
+	Password        string
+	PasswordConfirm string
 }
 
 var DefaultUserService userService
 var log = logrus.New()
 
+var (
+	errUserExists   = errors.New("user already exists")
+	errUserNotFound = errors.New("user not found")
+)
+
 type userService struct {
+	Mailer        mail.Mailer
+	Users         store.UserRepository
+	Borrowings    store.BorrowingRepository
+	Audit         audit.Auditor
+	Notifications NotificationHistory
+	Chats         ChatHistory
+	Emails        EmailHistory
 }
 
-func goDotEnvVariable(key string) string {
-
-	// load .env file
-	err := godotenv.Load(".env")
-
-	if err != nil {
-		log.Fatal("Error loading .env file", err)
-
+// user loads a user by id, trashed ones included.
+func (s userService) user(id int) (store.User, error) {
+	u, err := s.Users.User(id)
+	if err == store.ErrNotFound {
+		return u, errUserNotFound
 	}
-
-	return os.Getenv(key)
+	return u, err
 }
 
-func getPasswordHash(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
-	return string(hash), err
-}
-
-func (userService) CreateUser(db *sql.DB, newUser User, token string) error {
-	err := checkUsername(db, newUser.Email)
+func (s userService) CreateUser(newUser User, token string) error {
+	err := s.validateRegistration(newUser)
 	if err != nil {
-		log.Warn("User already exists")
-		return errors.New("user already exists")
+		log.WithError(err).Warn("Registration rejected")
+		return err
 	}
 
 	passwordHash, err := getPasswordHash(newUser.Password)
@@ -87,7 +74,7 @@ func (userService) CreateUser(db *sql.DB, newUser User, token string) error {
 	confiramtionString := uuid.New()
 	fmt.Println(confiramtionString.String())
 
-	newAuthUser := authUser{
+	newAuthUser := store.User{
 		Email:        newUser.Email,
 		Username:     newUser.Username,
 		PasswordHash: passwordHash,
@@ -95,19 +82,23 @@ func (userService) CreateUser(db *sql.DB, newUser User, token string) error {
 		Token:        token,
 	}
 
-	err = insertUserDB(db, newAuthUser)
+	err = s.Users.CreateUser(&newAuthUser)
 	if err != nil {
 		log.WithError(err).Error("Error inserting user into database")
 		return err
 	}
 
+	log.WithFields(logrus.Fields{
+		"action": "insert_user",
+		"user":   newAuthUser.Username,
+	}).Info("User inserted into database successfully")
+
 	//Confirmation link
-	apiURL := goDotEnvVariable("API_URL")
 	confiramtionLink := "activate/" + confiramtionString.String()
-	fullLink := apiURL + "/" + confiramtionLink
+	fullLink := settings.APIURL + "/" + confiramtionLink
 	fmt.Println(fullLink)
 
-	// err = mail.SendConfirmationEmail(newAuthUser.Email, fullLink)
+	err = mail.SendConfirmationEmail(s.Mailer, newAuthUser.Email, newAuthUser.Username, fullLink)
 	if err != nil {
 		log.WithError(err).Error("error sending confirmation email")
 		return errors.New("error sending confirmation email")
@@ -121,150 +112,212 @@ func (userService) CreateUser(db *sql.DB, newUser User, token string) error {
 	return nil
 }
 
-func (userService) DeleteUser(db *sql.DB, userID string) error {
-	_, err := db.Exec("DELETE FROM user_table WHERE id = $1", userID)
+// DeleteUser moves a user to the trash: they can no longer log in and drop
+// out of the user list, but an admin can restore them until the retention
+// period runs out and PurgeDeletedUsers removes the row.
+func (s userService) DeleteUser(r *http.Request, userID string) error {
+	id, err := strconv.Atoi(userID)
+	if err != nil {
+		return fmt.Errorf("invalid user id: %s", userID)
+	}
+
+	u, err := s.user(id)
+	if err != nil {
+		return err
+	}
+	if u.DeletedAt != nil {
+		return errUserNotFound
+	}
+
+	now := time.Now().UTC()
+	u.DeletedAt = &now
+	u.Token = ""
+	err = s.Users.UpdateUser(u)
 	if err != nil {
-		// Handle the error
 		return fmt.Errorf("error deleting user: %s", err)
 	}
 
+	s.Audit.Record(r, "user.delete", userID, nil, nil)
+
+	log.WithFields(logrus.Fields{
+		"action":  "delete_user",
+		"user_id": id,
+	}).Info("User moved to trash")
+
 	return nil
 }
 
-func (userService) Activate(db *sql.DB, link string) error {
-
-	var count int
-	fmt.Println("Activate link:" + link)
+func (s userService) RestoreUser(r *http.Request, userID string) error {
+	id, err := strconv.Atoi(userID)
+	if err != nil {
+		return fmt.Errorf("invalid user id: %s", userID)
+	}
 
-	// Prepare the SQL query with placeholders for parameters
-	query := "SELECT COUNT(*) FROM user_table WHERE confirmation = $1"
+	u, err := s.Users.User(id)
+	if err == store.ErrNotFound || (err == nil && u.DeletedAt == nil) {
+		return errors.New("user not found in trash")
+	}
+	if err != nil {
+		return err
+	}
 
-	// Execute the SQL query with the link parameter
-	err := db.QueryRow(query, link).Scan(&count)
+	u.DeletedAt = nil
+	err = s.Users.UpdateUser(u)
 	if err != nil {
-		return fmt.Errorf("error checking link existence: %s", err)
+		return fmt.Errorf("error restoring user: %s", err)
 	}
-	fmt.Println("Count:", count)
 
-	if count == 0 {
+	s.Audit.Record(r, "user.restore", userID, nil, nil)
+
+	log.WithFields(logrus.Fields{
+		"action":  "restore_user",
+		"user_id": id,
+	}).Info("User restored")
+
+	return nil
+}
+
+func (s userService) Activate(link string) error {
+	fmt.Println("Activate link:" + link)
+
+	u, err := s.Users.UserByConfirmation(link)
+	if err == store.ErrNotFound {
 		return errors.New("link not found")
 	}
+	if err != nil {
+		return fmt.Errorf("error checking link existence: %s", err)
+	}
 
-	// Prepare the SQL query for updating isActivated
-	updateQuery := "UPDATE user_table SET isactivated = true WHERE confirmation = $1"
+	if u.IsActivated {
+		// Already activated, e.g. the link was opened twice
+		return nil
+	}
 
-	// Execute the SQL update query with the link parameter
-	_, err = db.Exec(updateQuery, link)
+	u.IsActivated = true
+	err = s.Users.UpdateUser(u)
 	if err != nil {
 		log.Printf("Error updating user: %v\n", err)
 		return fmt.Errorf("error updating user: %s", err)
 	}
 
-	return nil
-}
-
-func SaveToken(db *sql.DB, email string, token string) error {
-	_, err := db.Exec("UPDATE "+tableName+" SET token = $1 WHERE email = $2", token, email)
+	err = mail.SendTemplate(s.Mailer, "welcome", u.Email, mail.TemplateData{Name: u.Username})
 	if err != nil {
-		log.WithError(err).Error("Error saving token in database")
-		return fmt.Errorf("error saving token in database: %s", err)
+		log.WithError(err).Error("error sending welcome email")
 	}
+
 	return nil
 }
 
-func (userService) AuthenticateUser(db *sql.DB, username string, password string, token string) error {
-	var storedPasswordHash string
-	var storedOTP *string
-	err := db.QueryRow("SELECT password, otp FROM "+tableName+" WHERE email = $1", username).Scan(&storedPasswordHash, &storedOTP) //
+func (s userService) AuthenticateUser(r *http.Request, username string, password string, token string) error {
+	u, err := s.Users.UserByEmail(username)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == store.ErrNotFound {
+			s.Audit.Record(r, "user.login_failed", username, nil, "unknown user")
 			log.WithError(err).Warn("User not found")
-			return errors.New("user not found")
+			return errUserNotFound
 		}
 		log.WithError(err).Error("Error retrieving user password hash from database")
 		return fmt.Errorf("error retrieving user password hash: %s", err)
 	}
 
-	if storedOTP != nil && password == *storedOTP {
+	if u.OTP != "" && password == u.OTP {
 		// Clear OTP from database
-		_, err := db.Exec("UPDATE "+tableName+" SET otp = NULL WHERE email = $1", username)
+		u.OTP = ""
+		err := s.Users.UpdateUser(u)
 		if err != nil {
 			log.WithError(err).Error("Error clearing OTP in database")
 			return fmt.Errorf("error clearing OTP in database: %s", err)
 		}
+		s.Audit.Record(r, "user.login", username, nil, "otp")
 		return nil // Successfully authenticated with OTP
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(storedPasswordHash), []byte(password))
+	needsRehash, err := verifyPassword(u.PasswordHash, password)
 	if err != nil {
+		s.Audit.Record(r, "user.login_failed", username, nil, "incorrect password")
 		return errors.New("incorrect password")
 	}
 
-	if storedOTP != nil {
-		_, err = db.Exec("UPDATE "+tableName+" SET otp = NULL WHERE email = $1", username)
-		if err != nil {
-			log.WithError(err).Error("Error clearing OTP in database")
-			return fmt.Errorf("error clearing OTP in database: %s", err)
-		}
+	if needsRehash {
+		upgradePasswordHash(&u, password)
 	}
 
-	err = SaveToken(db, username, token)
+	// Clearing an unused OTP and saving the session token is one update.
+	u.OTP = ""
+	u.Token = token
+	err = s.Users.UpdateUser(u)
 	if err != nil {
-		// Handle error
-		log.WithError(err).Error("Error saving token")
-		return err
+		log.WithError(err).Error("Error saving token in database")
+		return fmt.Errorf("error saving token in database: %s", err)
 	}
 
+	s.Audit.Record(r, "user.login", username, nil, "password")
+
 	return nil
 }
 
-func (userService) ChangePassword(db *sql.DB, email string, password string, newpassword string) error {
-	var storedPasswordHash string
-	err := db.QueryRow("SELECT password FROM "+tableName+" WHERE email = $1", email).Scan(&storedPasswordHash)
+func (s userService) ChangePassword(r *http.Request, email string, password string, newpassword string) error {
+	u, err := s.Users.UserByEmail(email)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == store.ErrNotFound {
 			// Username not found
 			log.WithError(err).Warn("User not found")
-			return errors.New("user not found")
+			return errUserNotFound
 		}
 		log.WithError(err).Error("Error retrieving user password hash from database")
 		return fmt.Errorf("error retrieving user password hash: %s", err)
 	}
 
 	// Compare the stored password hash with the provided password
-	err = bcrypt.CompareHashAndPassword([]byte(storedPasswordHash), []byte(password))
+	_, err = verifyPassword(u.PasswordHash, password)
 	if err != nil {
 		// Passwords don't match
+		s.Audit.Record(r, "user.password_change_failed", email, nil, nil)
 		return errors.New("incorrect password")
 	}
 
+	if msg := validatePassword(User{Email: u.Email, Username: u.Username, Password: newpassword}); msg != "" {
+		return errors.New(msg)
+	}
+
 	// Hash the new password
-	newPasswordHash, err := bcrypt.GenerateFromPassword([]byte(newpassword), bcrypt.DefaultCost)
+	u.PasswordHash, err = getPasswordHash(newpassword)
 	if err != nil {
 		log.WithError(err).Error("Error hashing new password")
 		return fmt.Errorf("error hashing new password: %s", err)
 	}
 
 	// Update the password in the database
-	_, err = db.Exec("UPDATE "+tableName+" SET password = $1 WHERE email = $2", newPasswordHash, email)
+	err = s.Users.UpdateUser(u)
 	if err != nil {
 		log.WithError(err).Error("Error updating password in database")
 		return fmt.Errorf("error updating password in database: %s", err)
 	}
 
+	s.Audit.Record(r, "user.password_change", email, nil, nil)
+
 	return nil
 }
 
-func (userService) OTPservice(db *sql.DB, email string) error {
-	otp := uuid.New()
+func (s userService) OTPservice(email string) error {
+	u, err := s.Users.UserByEmail(email)
+	if err == store.ErrNotFound {
+		// Don't reveal whether the address is registered
+		log.WithField("email", email).Warn("OTP requested for unknown user")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error retrieving user: %s", err)
+	}
 
-	_, err := db.Exec("UPDATE "+tableName+" SET otp = $1 WHERE email = $2", otp, email)
+	u.OTP = uuid.New().String()
+	err = s.Users.UpdateUser(u)
 	if err != nil {
 		log.WithError(err).Error("Error updating password in database")
 		return fmt.Errorf("error updating password in database: %s", err)
 	}
 
-	// err = mail.SendOTPEmail(email, otp.String())
+	err = mail.SendOTPEmail(s.Mailer, u.Email, u.OTP)
 	if err != nil {
 		log.WithError(err).Error("error sending confirmation email")
 		return errors.New("error sending confirmation email")
@@ -273,98 +326,49 @@ func (userService) OTPservice(db *sql.DB, email string) error {
 	return nil
 }
 
-func (userService) ShowUserList(w http.ResponseWriter, r *http.Request, db *sql.DB) error {
+// currentUser resolves the logged-in user from the token cookie.
+func (s userService) currentUser(r *http.Request) (store.User, error) {
 	cookie, err := r.Cookie("token")
 	if err != nil {
-		return errors.New("token not found in cookies")
-	}
-	token := cookie.Value
-
-	var isAdmin bool
-	err = db.QueryRow("SELECT isadmin FROM user_table WHERE token = $1", token).Scan(&isAdmin)
-	if err != nil {
-		return errors.New("error checking user admin status")
-	}
-
-	if !isAdmin {
-		http.Error(w, "Access denied: Only admins can view user list", http.StatusUnauthorized)
-		return nil
-	}
-
-	users, err := getUserListDB(db)
-	if err != nil {
-		log.WithError(err).Error("Error getting user list from database")
-		return errors.New("failed to retrieve user list from the database")
+		return store.User{}, errors.New("token not found in cookies")
 	}
 
-	ts, err := template.ParseFiles("userList.html")
-	if err != nil {
-		log.WithError(err).Error("Error parsing user list template")
-		return errors.New("failed to parse HTML template")
+	u, err := s.Users.UserByToken(cookie.Value)
+	if err == store.ErrNotFound {
+		return u, errUserNotFound
 	}
-
-	err = ts.Execute(w, users)
 	if err != nil {
-		log.WithError(err).Error("Error executing HTML template")
-		return errors.New("failed to render user list template")
+		return u, fmt.Errorf("error retrieving user by token: %s", err)
 	}
-
-	log.Info("User list displayed successfully")
-	return nil
+	return u, nil
 }
 
-func getUserListDB(db *sql.DB) ([]authUser, error) {
-	// rows, err := db.Query(`SELECT id, email, username, isactivated, isadmin FROM user_table`)
-	rows, err := db.Query(`SELECT id, email, isactivated, isadmin FROM user_table LIMIT 10000`)
-
+// IsAdmin reports whether the user behind the request's token cookie is an
+// admin.
+func (s userService) IsAdmin(r *http.Request) (bool, error) {
+	u, err := s.currentUser(r)
 	if err != nil {
-		return nil, fmt.Errorf("error querying database: %s", err)
-	}
-	defer rows.Close()
-
-	var users []authUser
-
-	for rows.Next() {
-		var u authUser
-		// err := rows.Scan(&u.ID, &u.Email, &u.Username, &u.IsActivated, &u.IsAdmin)
-		err := rows.Scan(&u.ID, &u.Email, &u.IsActivated, &u.IsAdmin)
-
-		if err != nil {
-			return nil, fmt.Errorf("error scanning row: %s", err)
+		if _, cookieErr := r.Cookie("token"); cookieErr != nil {
+			return false, err
 		}
-		users = append(users, u)
+		return false, errors.New("error checking user admin status")
 	}
-	return users, nil
+
+	return u.IsAdmin, nil
 }
 
-func checkUsername(db *sql.DB, email string) error {
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM " + tableName + " WHERE email = '" + email + "'").Scan(&count)
+func (s userService) checkUsername(email string) error {
+	taken, err := s.Users.EmailTaken(email, 0)
 	if err != nil {
 		log.WithError(err).Error("Error checking email uniqueness")
-		return fmt.Errorf("error checking email uniqueness: %s", err)
+		return err
 	}
 
-	if count > 0 {
+	if taken {
 		log.Warn("User already exists")
-		return errors.New("user already exists")
-	}
-
-	return nil
-}
-
-func insertUserDB(db *sql.DB, data authUser) error {
-	_, err := db.Exec("INSERT INTO "+tableName+" (email, username, password, confirmation, token) VALUES ($1, $2, $3, $4, $5)",
-		data.Email, data.Username, data.PasswordHash, data.Confirmation, data.Token)
-	if err != nil {
-		log.WithError(err).Error("Error inserting user into database")
-		return fmt.Errorf("error inserting user into database: %s", err)
+		return errUserExists
 	}
 
-	log.WithFields(logrus.Fields{
-		"action": "insert_user",
-		"user":   data.Username,
-	}).Info("User inserted into database successfully")
-
 	return nil
 }
+
\ No newline at end of file
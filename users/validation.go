@@ -0,0 +1,205 @@
+package users
+
+import (
+	"bufio"
+	"fmt"
+	"net/mail"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	maxPasswordLength = 72 // bcrypt ignores everything past 72 bytes
+	maxEmailLength    = 254
+)
+
+var (
+	usernamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+	breachedOnce      sync.Once
+	breachedPasswords map[string]struct{}
+)
+
+// ValidationErrors maps a registration form field to the reason its value
+// was rejected, so the form can be re-rendered with per-field messages.
+type ValidationErrors map[string]string
+
+func (v ValidationErrors) Error() string {
+	fields := make([]string, 0, len(v))
+	for field := range v {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		parts = append(parts, field+": "+v[field])
+	}
+	return "invalid registration: " + strings.Join(parts, "; ")
+}
+
+func (s userService) validateRegistration(newUser User) error {
+	errs := ValidationErrors{}
+
+	if msg := validateEmail(newUser.Email); msg != "" {
+		errs["email"] = msg
+	}
+	if msg := validateUsername(newUser.Username); msg != "" {
+		errs["username"] = msg
+	}
+	if msg := validatePassword(newUser); msg != "" {
+		errs["password"] = msg
+	}
+	if newUser.PasswordConfirm != newUser.Password {
+		errs["passwordConfirm"] = "Passwords do not match"
+	}
+
+	if _, ok := errs["email"]; !ok {
+		err := s.checkUsername(newUser.Email)
+		if err != nil {
+			if err != errUserExists {
+				return err
+			}
+			errs["email"] = "Email is already registered"
+		}
+	}
+
+	if _, ok := errs["username"]; !ok {
+		taken, err := s.Users.UsernameTaken(newUser.Username, 0)
+		if err != nil {
+			return err
+		}
+		if taken {
+			errs["username"] = "Username is already taken"
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateEmail(email string) string {
+	if email == "" {
+		return "Email is required"
+	}
+	if len(email) > maxEmailLength {
+		return "Email is too long"
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "Email address is not valid"
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at > 64 {
+		return "Email address is not valid"
+	}
+	if !strings.Contains(email[at+1:], ".") {
+		return "Email domain is not valid"
+	}
+
+	return ""
+}
+
+func validateUsername(username string) string {
+	if username == "" {
+		return "Username is required"
+	}
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return fmt.Sprintf("Username must be between %d and %d characters", minUsernameLength, maxUsernameLength)
+	}
+	if !usernamePattern.MatchString(username) {
+		return "Username must start with a letter and contain only letters, digits, '.', '-' or '_'"
+	}
+	return ""
+}
+
+func validatePassword(newUser User) string {
+	password := newUser.Password
+	if password == "" {
+		return "Password is required"
+	}
+	if len(password) < settings.PasswordMinLength {
+		return fmt.Sprintf("Password must be at least %d characters", settings.PasswordMinLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Sprintf("Password must be at most %d bytes", maxPasswordLength)
+	}
+
+	var lower, upper, digit, other bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	if classes < 3 {
+		return "Password must contain at least three of: lowercase letters, uppercase letters, digits, symbols"
+	}
+
+	lowered := strings.ToLower(password)
+	if newUser.Username != "" && strings.Contains(lowered, strings.ToLower(newUser.Username)) {
+		return "Password must not contain your username"
+	}
+	if at := strings.Index(newUser.Email, "@"); at >= minUsernameLength && strings.Contains(lowered, strings.ToLower(newUser.Email[:at])) {
+		return "Password must not contain your email address"
+	}
+
+	if isBreachedPassword(password) {
+		return "This password has appeared in a data breach, please choose another one"
+	}
+
+	return ""
+}
+
+// isBreachedPassword checks the password against the local list of known
+// breached passwords. The list is loaded once; a missing file disables the
+// check instead of failing registration.
+func isBreachedPassword(password string) bool {
+	breachedOnce.Do(func() {
+		breachedPasswords = map[string]struct{}{}
+
+		file, err := os.Open(settings.BreachedPasswordsFile)
+		if err != nil {
+			log.WithError(err).Warn("Breached password list not loaded")
+			return
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			breachedPasswords[strings.ToLower(line)] = struct{}{}
+		}
+		if err := scanner.Err(); err != nil {
+			log.WithError(err).Warn("Error reading breached password list")
+		}
+	})
+
+	_, found := breachedPasswords[strings.ToLower(password)]
+	return found
+}
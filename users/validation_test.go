@@ -0,0 +1,61 @@
+package users
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"main.go/store"
+)
+
+func TestValidatePassword(t *testing.T) {
+	settings.BreachedPasswordsFile = filepath.Join("..", "breached-passwords.txt")
+	defer func() { settings = DefaultConfig() }()
+
+	tests := []struct {
+		name string
+		user User
+		want string // a prefix of the message, "" when accepted
+	}{
+		{"empty", User{}, "Password is required"},
+		{"too short", User{Password: "Ab1!xyz"}, "Password must be at least 8 characters"},
+		{"too long", User{Password: strings.Repeat("Ab1", 25)}, "Password must be at most 72 bytes"},
+		{"multibyte past 72 bytes", User{Password: strings.Repeat("Ä", 40) + "b1"}, "Password must be at most 72 bytes"},
+		{"two character classes", User{Password: "abcdefgh1"}, "Password must contain at least three of"},
+		{"three character classes", User{Password: "correct-horse-7"}, ""},
+		{"all four classes", User{Password: "Correct-horse-7"}, ""},
+		{"contains username", User{Username: "Lovelace", Password: "my-lovelace-7"}, "Password must not contain your username"},
+		{"contains email name", User{Email: "grace@example.com", Password: "Grace-2024-x"}, "Password must not contain your email address"},
+		{"short email name is allowed", User{Email: "al@example.com", Password: "Always-on-7"}, ""},
+		{"breached", User{Password: "Password123!"}, "This password has appeared in a data breach"},
+	}
+
+	for _, test := range tests {
+		got := validatePassword(test.user)
+		if test.want == "" && got != "" || !strings.HasPrefix(got, test.want) {
+			t.Errorf("%s: validatePassword = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestChangePasswordRejectsUsername(t *testing.T) {
+	useHashing(t, hashBcrypt)
+	s, repos := newTestService()
+
+	hash, err := getPasswordHash("Old-secret-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := store.User{Email: "ada@example.com", Username: "lovelace", PasswordHash: hash}
+	if err := repos.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.ChangePassword(nil, u.Email, "Old-secret-1", "Lovelace-2024!")
+	if err == nil || err.Error() != "Password must not contain your username" {
+		t.Errorf("ChangePassword = %v, want the username rule", err)
+	}
+	if err := s.ChangePassword(nil, u.Email, "Old-secret-1", "New-secret-2"); err != nil {
+		t.Errorf("ChangePassword to a valid password: %s", err)
+	}
+}